@@ -0,0 +1,80 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package async
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"procurementlistenerservice/model"
+	"time"
+)
+
+// Notification is the message that is sent to the marketplace when a pending event is completed.
+type Notification struct {
+	model.EntitlementEventResponse
+
+	// EntitlementId is the id of the entitlement that the completed event was for.
+	EntitlementId string `json:"entitlementId"`
+
+	// Status is the final status of the event, either "ACCEPTED" or "REJECTED".
+	Status string `json:"status"`
+}
+
+// Notifier delivers completion notifications to the marketplace.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// HTTPNotifier is a Notifier that POSTs the notifications, as JSON, to a configured marketplace endpoint.
+type HTTPNotifier struct {
+	url    string
+	client *http.Client
+}
+
+var _ Notifier = &HTTPNotifier{}
+
+// CreateHTTPNotifier creates a new HTTPNotifier that posts notifications to the given url.
+func CreateHTTPNotifier(url string) *HTTPNotifier {
+	return &HTTPNotifier{
+		url: url,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+func (n *HTTPNotifier) Notify(notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	response, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to notify marketplace: '%v'.", err)
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Marketplace rejected notification: code='%d'.", response.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package async contains the infrastructure for handling entitlement events asynchronously. Events that a backend
+// responds to with RESPONSESTATUS_ASYNC are recorded durably as pending, and are later completed as accepted or
+// rejected, at which point the marketplace is notified.
+package async
+
+import (
+	"encoding/json"
+	"fmt"
+	"procurementlistenerservice/internal/fileutil"
+	"procurementlistenerservice/model"
+	"sort"
+	"time"
+)
+
+// PendingEvent is the durable record of an event that has been responded to with RESPONSESTATUS_ASYNC, and that is
+// yet to be completed.
+type PendingEvent struct {
+	// Event is the original event, as received from the marketplace.
+	Event model.EntitlementEvent `json:"event"`
+
+	// ReceivedAt is the time at which the event was first received.
+	ReceivedAt time.Time `json:"receivedAt"`
+
+	// Notification is set once the event has been completed by the backend, but the marketplace could not be
+	// notified yet.
+	Notification *Notification `json:"notification,omitempty"`
+}
+
+// PendingStore is the storage interface for pending events.
+type PendingStore interface {
+	// Get returns the pending event with the given event id, if it exists.
+	Get(eventId string) (PendingEvent, bool, error)
+
+	// Put inserts or replaces the given pending event.
+	Put(p PendingEvent) error
+
+	// Delete removes the pending event with the given event id. Deleting a non-existent event is not an error.
+	Delete(eventId string) error
+
+	// List returns all pending events, ordered by the time they were received.
+	List() ([]PendingEvent, error)
+}
+
+// FilePendingStore is a PendingStore that keeps the pending events in memory, and writes them through to a JSON file
+// on every change.
+type FilePendingStore struct {
+	events *fileutil.JsonMap
+}
+
+var _ PendingStore = &FilePendingStore{}
+
+// OpenFilePendingStore opens the FilePendingStore that is backed by the file at the given path. The file is created
+// on the first write, if it doesn't exist.
+func OpenFilePendingStore(path string) (*FilePendingStore, error) {
+	events, err := fileutil.OpenJsonMap(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open pending events file: '%v'.", err)
+	}
+	return &FilePendingStore{events: events}, nil
+}
+
+func (s *FilePendingStore) Get(eventId string) (PendingEvent, bool, error) {
+	var p PendingEvent
+	found, err := s.events.Get(eventId, &p)
+	return p, found, err
+}
+
+func (s *FilePendingStore) Put(p PendingEvent) error {
+	return s.events.Put(p.Event.EventId, p)
+}
+
+func (s *FilePendingStore) Delete(eventId string) error {
+	return s.events.Delete(eventId)
+}
+
+func (s *FilePendingStore) List() ([]PendingEvent, error) {
+	var result []PendingEvent
+	err := s.events.Each(func(eventId string, value json.RawMessage) error {
+		var p PendingEvent
+		err := json.Unmarshal(value, &p)
+		if err != nil {
+			return fmt.Errorf("Unable to parse pending event '%s': '%v'.", eventId, err)
+		}
+		result = append(result, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].ReceivedAt.Before(result[j].ReceivedAt)
+	})
+	return result, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package async
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"procurementlistenerservice/internal/keylock"
+	"procurementlistenerservice/model"
+	"time"
+)
+
+// ErrPendingEventNotFound is returned when an operation refers to an event that is not pending.
+var ErrPendingEventNotFound = errors.New("Pending event not found.")
+
+// Tracker keeps track of the events that are being handled asynchronously, and drives their completion. The
+// operations on each event are serialized, but no lock is held while the marketplace is notified, so that a slow
+// marketplace does not hold up the handling of other events.
+type Tracker struct {
+	locks    *keylock.Locks
+	store    PendingStore
+	notifier Notifier
+	backend  model.PartnerBackendService
+}
+
+// CreateTracker creates a new Tracker. If backend implements model.AsyncPartnerBackendService, it is invoked upon
+// completion of each pending event. The notifier can be nil, in which case completions are not sent anywhere.
+func CreateTracker(store PendingStore, notifier Notifier, backend model.PartnerBackendService) *Tracker {
+	return &Tracker{
+		locks:    keylock.CreateLocks(),
+		store:    store,
+		notifier: notifier,
+		backend:  backend,
+	}
+}
+
+// Track records the given event as pending. Tracking an event that is already pending is a no-op.
+func (t *Tracker) Track(e model.EntitlementEvent) error {
+	defer t.locks.Lock(e.EventId)()
+
+	_, found, err := t.store.Get(e.EventId)
+	if err != nil || found {
+		return err
+	}
+
+	return t.store.Put(PendingEvent{
+		Event:      e,
+		ReceivedAt: time.Now().UTC(),
+	})
+}
+
+// Pending returns all events that are currently pending.
+func (t *Tracker) Pending() ([]PendingEvent, error) {
+	return t.store.List()
+}
+
+// Complete finishes the pending event with the given id, with the given status, and notifies the marketplace. A
+// rejection can optionally carry a reason, which takes precedence over the reason given by the backend. If the
+// notification fails, the event remains pending, and completing it again retries the notification only.
+func (t *Tracker) Complete(
+	eventId string, status model.ResponseStatus, reason *model.RejectionReason) (Notification, error) {
+
+	if status != model.RESPONSESTATUS_ACCEPTED && status != model.RESPONSESTATUS_REJECTED {
+		return Notification{}, fmt.Errorf("Invalid completion status: '%v'.", status)
+	}
+
+	pending, err := t.complete(eventId, status, reason)
+	if err != nil {
+		return Notification{}, err
+	}
+	return *pending.Notification, t.notify(pending)
+}
+
+// complete records the outcome of the pending event with the given id, unless it was already recorded, and returns
+// the pending event with its notification.
+func (t *Tracker) complete(
+	eventId string, status model.ResponseStatus, reason *model.RejectionReason) (PendingEvent, error) {
+
+	defer t.locks.Lock(eventId)()
+
+	pending, found, err := t.store.Get(eventId)
+	if err != nil {
+		return PendingEvent{}, err
+	}
+	if !found {
+		return PendingEvent{}, ErrPendingEventNotFound
+	}
+	if pending.Notification != nil {
+		return pending, nil
+	}
+
+	response := model.EntitlementEventResponse{
+		Status:  status,
+		EventId: eventId,
+	}
+
+	if backend, ok := t.backend.(model.AsyncPartnerBackendService); ok {
+		response, err = backend.OnEntitlementEventCompleted(pending.Event, status)
+		if err != nil {
+			return PendingEvent{}, err
+		}
+	}
+
+	if response.Status == model.RESPONSESTATUS_REJECTED {
+		if reason != nil {
+			response.Reason = reason
+		}
+		if response.Reason == nil {
+			response.Reason = model.NewRejection(model.REJECTIONREASON_UNSPECIFIED, "The event was rejected.")
+		}
+	}
+
+	pending.Notification = &Notification{
+		EntitlementEventResponse: response,
+		EntitlementId:            pending.Event.EntitlementId,
+		Status:                   response.Status.String(),
+	}
+	err = t.store.Put(pending)
+	if err != nil {
+		return PendingEvent{}, err
+	}
+	return pending, nil
+}
+
+// ResumeNotifications retries the notifications for the events that were completed, but whose notifications have
+// not been delivered yet. It is meant to be called at startup. A failed notification does not stop the others from
+// being retried; the number of failures is reported along with the first error.
+func (t *Tracker) ResumeNotifications() error {
+	pending, err := t.store.List()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	failed := 0
+	for _, p := range pending {
+		if p.Notification == nil {
+			continue
+		}
+		err = t.notify(p)
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("Unable to deliver '%d' completions: '%v'.", failed, firstErr)
+	}
+	return nil
+}
+
+func (t *Tracker) notify(p PendingEvent) error {
+	if t.notifier != nil {
+		err := t.notifier.Notify(*p.Notification)
+		if err != nil {
+			log.Printf("Unable to deliver completion of event '%s': '%v'\n", p.Event.EventId, err)
+			return err
+		}
+	}
+
+	log.Printf("Pending event completed: '%+v'\n", *p.Notification)
+	return t.store.Delete(p.Event.EventId)
+}
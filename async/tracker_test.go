@@ -0,0 +1,239 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package async
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"procurementlistenerservice/model"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNotifier records the notifications that it delivers. Notifications for the events in failing are refused,
+// and notifications for the events in blocking wait until release is closed.
+type fakeNotifier struct {
+	mu        sync.Mutex
+	delivered []string
+	failing   map[string]bool
+	blocking  map[string]bool
+	started   chan struct{}
+	release   chan struct{}
+}
+
+func (n *fakeNotifier) Notify(notification Notification) error {
+	if n.blocking[notification.EventId] {
+		close(n.started)
+		<-n.release
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.failing[notification.EventId] {
+		return errors.New("Marketplace is unavailable.")
+	}
+	n.delivered = append(n.delivered, notification.EventId)
+	return nil
+}
+
+// completingBackend accepts every completion, and counts them.
+type completingBackend struct {
+	mu          sync.Mutex
+	completions int
+}
+
+func (b *completingBackend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return model.EntitlementEventResponse{Status: model.RESPONSESTATUS_ASYNC, EventId: e.EventId}, nil
+}
+
+func (b *completingBackend) OnEntitlementEventCompleted(
+	e model.EntitlementEvent, status model.ResponseStatus) (model.EntitlementEventResponse, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.completions++
+	return model.EntitlementEventResponse{Status: status, EventId: e.EventId}, nil
+}
+
+func pendingEvent(eventId string) model.EntitlementEvent {
+	return model.EntitlementEvent{
+		EventId:       eventId,
+		EventType:     model.ENTITLEMENT_CREATED,
+		EntitlementId: "E" + eventId,
+	}
+}
+
+func openStore(t *testing.T) (*FilePendingStore, func()) {
+	dir, err := ioutil.TempDir("", "async")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenFilePendingStore(filepath.Join(dir, "pending.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestCompleteRetriesNotificationOnly(t *testing.T) {
+	store, cleanup := openStore(t)
+	defer cleanup()
+
+	notifier := &fakeNotifier{failing: map[string]bool{"1": true}}
+	backend := &completingBackend{}
+	tracker := CreateTracker(store, notifier, backend)
+
+	err := tracker.Track(pendingEvent("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tracker.Complete("1", model.RESPONSESTATUS_REJECTED, nil)
+	if err == nil {
+		t.Fatal("Expected an error for a failed notification.")
+	}
+	if pending, _ := tracker.Pending(); len(pending) != 1 || pending[0].Notification == nil {
+		t.Fatalf("Expected the completed event to remain pending: '%+v'", pending)
+	}
+
+	notifier.failing = nil
+	notification, err := tracker.Complete("1", model.RESPONSESTATUS_ACCEPTED, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification.Status != "REJECTED" || notification.Reason == nil {
+		t.Errorf("Expected the recorded rejection to be delivered: '%+v'", notification)
+	}
+	if backend.completions != 1 {
+		t.Errorf("Unexpected backend completions: '%d'", backend.completions)
+	}
+	if pending, _ := tracker.Pending(); len(pending) != 0 {
+		t.Errorf("Expected no pending events: '%+v'", pending)
+	}
+
+	_, err = tracker.Complete("1", model.RESPONSESTATUS_ACCEPTED, nil)
+	if err != ErrPendingEventNotFound {
+		t.Errorf("Unexpected error: actual='%v', expected='%v'", err, ErrPendingEventNotFound)
+	}
+}
+
+func TestSlowNotificationDoesNotBlockOtherEvents(t *testing.T) {
+	store, cleanup := openStore(t)
+	defer cleanup()
+
+	notifier := &fakeNotifier{
+		blocking: map[string]bool{"1": true},
+		started:  make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+	tracker := CreateTracker(store, notifier, &completingBackend{})
+	err := tracker.Track(pendingEvent("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	completed := make(chan error, 1)
+	go func() {
+		_, err := tracker.Complete("1", model.RESPONSESTATUS_ACCEPTED, nil)
+		completed <- err
+	}()
+	<-notifier.started
+
+	tracked := make(chan error, 1)
+	go func() {
+		tracked <- tracker.Track(pendingEvent("2"))
+	}()
+	select {
+	case err := <-tracked:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Tracking an event was blocked by a slow notification.")
+	}
+
+	close(notifier.release)
+	if err := <-completed; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResumeNotificationsContinuesAfterFailure(t *testing.T) {
+	store, cleanup := openStore(t)
+	defer cleanup()
+
+	for i, eventId := range []string{"1", "2", "3"} {
+		err := store.Put(PendingEvent{
+			Event:        pendingEvent(eventId),
+			ReceivedAt:   time.Unix(int64(i), 0),
+			Notification: &Notification{EntitlementEventResponse: model.EntitlementEventResponse{EventId: eventId}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notifier := &fakeNotifier{failing: map[string]bool{"1": true}}
+	tracker := CreateTracker(store, notifier, &completingBackend{})
+	err := tracker.ResumeNotifications()
+	if err == nil {
+		t.Error("Expected an error for the failed notification.")
+	}
+	if len(notifier.delivered) != 2 {
+		t.Errorf("Expected the other notifications to be delivered: '%v'", notifier.delivered)
+	}
+	if pending, _ := tracker.Pending(); len(pending) != 1 || pending[0].Event.EventId != "1" {
+		t.Errorf("Expected only the failed event to remain pending: '%+v'", pending)
+	}
+}
+
+func TestFilePendingStoreIsDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "async")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pending.json")
+	store, err := OpenFilePendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, eventId := range []string{"1", "2"} {
+		err = store.Put(PendingEvent{Event: pendingEvent(eventId), ReceivedAt: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Delete("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFilePendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Event.EventId != "2" {
+		t.Errorf("Unexpected pending events after reopening: '%+v'", pending)
+	}
+}
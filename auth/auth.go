@@ -0,0 +1,45 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth contains the HTTP middleware that authenticates the entitlement events that are pushed to the service.
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"procurementlistenerservice/model"
+)
+
+// writeUnauthenticated rejects the request with an http.StatusUnauthorized response. The reason is only logged, and
+// not sent back to the caller.
+func writeUnauthenticated(w http.ResponseWriter, r *http.Request, reason error) {
+	log.Printf("Unauthenticated request to '%s': '%v'\n", r.URL.Path, reason)
+
+	body, err := json.Marshal(model.ErrorResponse{
+		Error: model.ErrorDetail{
+			Code:    model.ERRORCODE_UNAUTHENTICATED,
+			Message: "The request could not be authenticated.",
+		},
+	})
+	if err != nil {
+		log.Printf("Error marshalling error response: '%v'\n", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(body)
+}
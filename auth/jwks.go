@@ -0,0 +1,161 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+// jsonWebKey is a public key in a JSON Web Key Set (RFC 7517). Only RSA and EC keys are supported.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// N and E are the modulus and exponent of an RSA key.
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// Crv, X and Y are the curve and coordinates of an EC key.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey is a signing key from a key set.
+type publicKey struct {
+	id  string
+	alg string
+	key crypto.PublicKey
+}
+
+// KeySet is a set of public keys that tokens can be signed with.
+type KeySet struct {
+	keys []publicKey
+}
+
+// ReadKeySetFile reads the JSON Web Key Set in the given file. Keys that are not meant for signatures are ignored.
+func ReadKeySetFile(path string) (*KeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse JWKS file '%s': '%v'.", path, err)
+	}
+
+	set := &KeySet{}
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key '%d' ('%s') in JWKS file '%s': %v", i, k.Kid, path, err)
+		}
+		set.keys = append(set.keys, publicKey{id: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(set.keys) == 0 {
+		return nil, fmt.Errorf("No signing keys in JWKS file '%s'.", path)
+	}
+	return set, nil
+}
+
+// find returns the key with the given id. A token without a key id can only be verified if there is a single key.
+func (s *KeySet) find(id string) (publicKey, bool) {
+	if id == "" {
+		if len(s.keys) == 1 {
+			return s.keys[0], true
+		}
+		return publicKey{}, false
+	}
+
+	for _, k := range s.keys {
+		if k.id == id {
+			return k, true
+		}
+	}
+	return publicKey{}, false
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid modulus: '%v'.", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exponent: '%v'.", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("Exponent is too large.")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve: '%s'.", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid x coordinate: '%v'.", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid y coordinate: '%v'.", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("Point is not on curve '%s'.", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type: '%s'.", k.Kty)
+}
+
+// decodeBigInt decodes an unpadded base64url encoded big-endian integer.
+func decodeBigInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, fmt.Errorf("Value is missing.")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,348 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"procurementlistenerservice/interceptor"
+	"procurementlistenerservice/model"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// JWT_LEEWAY is the clock skew that is tolerated when checking the expiry and not-before times of a token.
+	JWT_LEEWAY time.Duration = 30 * time.Second
+)
+
+// Audience is the "aud" claim of a token, which may be a single string or an array of strings.
+type Audience []string
+
+// UnmarshalJSON reads either form of the claim.
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var multiple []string
+	err := json.Unmarshal(data, &multiple)
+	if err != nil {
+		return fmt.Errorf("Audience must be a string or an array of strings: '%s'", data)
+	}
+	*a = Audience(multiple)
+	return nil
+}
+
+// Claims are the verified claims of a bearer token.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  Audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+
+	// All contains every claim of the token, including the registered claims above.
+	All map[string]interface{} `json:"-"`
+}
+
+// String returns the value of the given claim, if it is a string.
+func (c *Claims) String(name string) (string, bool) {
+	value, ok := c.All[name].(string)
+	return value, ok
+}
+
+// claimsKey is the context key for the verified claims.
+type claimsKey struct{}
+
+// ClaimsFromContext returns the verified claims of the bearer token that the request carried. Backends receive them
+// in the context that is passed to OnEntitlementEventContext.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// TokenVerifier verifies bearer tokens that are signed with the keys of a JSON Web Key Set file.
+type TokenVerifier struct {
+	path     string
+	issuer   string
+	audience string
+	now      func() time.Time
+
+	mu   sync.RWMutex
+	keys *KeySet
+}
+
+// CreateTokenVerifier creates a new TokenVerifier with the keys in the given JWKS file. Tokens are only accepted if
+// they were issued by the given issuer for the given audience, and have not expired.
+func CreateTokenVerifier(path string, issuer string, audience string) (*TokenVerifier, error) {
+	if issuer == "" || audience == "" {
+		return nil, fmt.Errorf("Both the issuer and the audience of the tokens are required.")
+	}
+
+	v := &TokenVerifier{
+		path:     path,
+		issuer:   issuer,
+		audience: audience,
+		now:      time.Now,
+	}
+	err := v.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload re-reads the JWKS file, e.g. after the keys were rotated. If the file is not valid, the current keys are
+// kept.
+func (v *TokenVerifier) Reload() error {
+	keys, err := ReadKeySetFile(v.path)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	return nil
+}
+
+// Verify checks the signature and the claims of the given compact serialized token, and returns the claims.
+func (v *TokenVerifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Token is not a compact serialized JWS.")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token header: '%v'.", err)
+	}
+
+	v.mu.RLock()
+	key, ok := v.keys.find(header.Kid)
+	v.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key: '%s'.", header.Kid)
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("Algorithm '%s' is not allowed for key '%s'.", header.Alg, key.id)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token signature: '%v'.", err)
+	}
+	err = verifySignature(header.Alg, key.key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	err = decodeSegment(parts[1], claims)
+	if err == nil {
+		err = decodeSegment(parts[1], &claims.All)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token claims: '%v'.", err)
+	}
+
+	err = v.checkClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims checks the issuer, audience, expiry and not-before time of the token.
+func (v *TokenVerifier) checkClaims(claims *Claims) error {
+	if claims.Issuer != v.issuer {
+		return fmt.Errorf("Unexpected issuer: '%s'.", claims.Issuer)
+	}
+
+	audience := false
+	for _, a := range claims.Audience {
+		audience = audience || a == v.audience
+	}
+	if !audience {
+		return fmt.Errorf("Unexpected audience: '%v'.", claims.Audience)
+	}
+
+	now := v.now()
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("Token has no expiry.")
+	}
+	if now.Add(-JWT_LEEWAY).After(time.Unix(claims.ExpiresAt, 0)) {
+		return fmt.Errorf("Token expired at '%v'.", time.Unix(claims.ExpiresAt, 0))
+	}
+	if claims.NotBefore != 0 && now.Add(JWT_LEEWAY).Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("Token is not valid before '%v'.", time.Unix(claims.NotBefore, 0))
+	}
+	return nil
+}
+
+// Middleware returns an http.Handler that only passes on the requests with a valid bearer token in the Authorization
+// header. The verified claims are added to the context of the request.
+func (v *TokenVerifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+			writeUnauthenticated(w, r, fmt.Errorf("Missing bearer token."))
+			return
+		}
+
+		claims, err := v.Verify(strings.TrimSpace(authorization[7:]))
+		if err != nil {
+			writeUnauthenticated(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+// OwnerLookup returns the account id of the stored entitlement with the given id, and reports whether the entitlement
+// exists.
+type OwnerLookup func(entitlementId string) (accountId string, found bool, err error)
+
+// AccountClaim returns an interceptor that refuses the events of the entitlements that are not owned by the account in
+// the given claim of the bearer token. The owner of an existing entitlement is looked up with owner, so that the
+// accountId of an event cannot be used to act on the entitlement of another account. A creation event must also carry
+// the accountId of the token. Events that were received without a verified token are passed on unchanged.
+func AccountClaim(claim string, owner OwnerLookup) interceptor.Interceptor {
+	return func(next interceptor.Handler) interceptor.Handler {
+		return func(ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+			claims, ok := ClaimsFromContext(ctx)
+			if !ok {
+				return next(ctx, e)
+			}
+
+			accountId, _ := claims.String(claim)
+			if accountId == "" {
+				return model.EntitlementEventResponse{}, model.NewFieldValidationError(model.JsonPointer("accountId"),
+					"The token has no '%s' claim.", claim)
+			}
+			created := e.EventType == model.ENTITLEMENT_CREATED
+			if e.AccountId != accountId && (created || e.AccountId != "") {
+				return model.EntitlementEventResponse{}, model.NewFieldValidationError(model.JsonPointer("accountId"),
+					"Account does not match the '%s' claim of the token: '%s'.", claim, e.AccountId)
+			}
+
+			ownerId, found, err := owner(e.EntitlementId)
+			if err != nil {
+				return model.EntitlementEventResponse{}, fmt.Errorf("Unable to look up the owner of entitlement '%s': '%v'.",
+					e.EntitlementId, err)
+			}
+			if found && ownerId != accountId || !found && !created {
+				return model.EntitlementEventResponse{}, model.NewFieldValidationError(
+					model.JsonPointer("entitlementId"), "Entitlement is not owned by the '%s' claim of the token: '%s'.",
+					claim, e.EntitlementId)
+			}
+			return next(ctx, e)
+		}
+	}
+}
+
+// IdempotencyScope returns the function that scopes the responses to redelivered events by caller (see
+// server.WithIdempotencyScope): the subject of the bearer token, along with the value of the given account claim, if
+// any. The events that were received without a verified token share one scope.
+func IdempotencyScope(accountClaim string) func(ctx context.Context) string {
+	return func(ctx context.Context) string {
+		claims, ok := ClaimsFromContext(ctx)
+		if !ok {
+			return ""
+		}
+		accountId, _ := claims.String(accountClaim)
+		return fmt.Sprintf("%q %q", claims.Subject, accountId)
+	}
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature verifies the signature of the signed content with the given algorithm and key. Only the asymmetric
+// RS, PS and ES algorithms are supported, so that a public key cannot be used as a shared secret.
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("Unsupported algorithm: '%s'.", alg)
+	}
+	family := alg[:2]
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported algorithm: '%s'.", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch family {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(k, hash, digest, signature, nil)
+		default:
+			return fmt.Errorf("Algorithm '%s' does not match RSA key.", alg)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid token signature: '%v'.", err)
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if family != "ES" || len(signature) != 2*size {
+			return fmt.Errorf("Algorithm '%s' does not match EC key.", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("Invalid token signature.")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported key: '%T'.", key)
+}
@@ -0,0 +1,300 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"procurementlistenerservice/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys are the keys that the test tokens are signed with.
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func createTestKeys(t *testing.T) testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+// writeKeySet writes the public keys as a JWKS file, and returns its path.
+func (k testKeys) writeKeySet(t *testing.T, dir string) string {
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "alg": "RS256",
+				"n": encode(k.rsa.N), "e": encode(big.NewInt(int64(k.rsa.E)))},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(k.ec.X), "y": encode(k.ec.Y)},
+			{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		},
+	}
+	data, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jwks.json")
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sign creates a token with the given header and claims, signed with the key that the algorithm calls for.
+func (k testKeys) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest.Sum(nil))
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest.Sum(nil))
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestTokenVerification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := createTestKeys(t)
+	verifier, err := CreateTokenVerifier(keys.writeKeySet(t, dir), "https://marketplace", "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":       "https://marketplace",
+			"aud":       "listener",
+			"exp":       now + 60,
+			"accountId": "A1",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	valid := keys.sign(t, "RS256", "rsa", claims(nil))
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rsa", valid, true},
+		{"ec", keys.sign(t, "ES256", "ec", claims(nil)), true},
+		{"audience array", keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{
+			"aud": []string{"other", "listener"}})), true},
+		{"within leeway", keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"exp": now - 10})), true},
+		{"expired", keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"exp": now - 3600})), false},
+		{"no expiry", keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"exp": nil})), false},
+		{"not yet valid", keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"nbf": now + 3600})), false},
+		{"wrong issuer", keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"iss": "other"})), false},
+		{"wrong audience", keys.sign(t, "RS256", "rsa", claims(map[string]interface{}{"aud": "other"})), false},
+		{"unknown key", keys.sign(t, "RS256", "missing", claims(nil)), false},
+		{"no key id", keys.sign(t, "RS256", "", claims(nil)), false},
+		{"wrong key", keys.sign(t, "RS256", "ec", claims(nil)), false},
+		{"tampered", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://marketplace",`+
+			`"aud":"listener","exp":`+fmt.Sprint(now+60)+`,"accountId":"A2"}`)) + "." + parts[2], false},
+		{"unsigned", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + parts[1] +
+			".", false},
+		{"malformed", "token", false},
+	}
+
+	for _, test := range tests {
+		claims, err := verifier.Verify(test.token)
+		if test.valid && err != nil {
+			t.Errorf("Unexpected error for '%s': '%v'", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected an error for '%s'.", test.name)
+		}
+		if err == nil {
+			if accountId, _ := claims.String("accountId"); accountId != "A1" {
+				t.Errorf("Unexpected account claim for '%s': '%s'", test.name, accountId)
+			}
+		}
+	}
+}
+
+func TestTokenMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := createTestKeys(t)
+	verifier, err := CreateTokenVerifier(keys.writeKeySet(t, dir), "https://marketplace", "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received *Claims
+	handler := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ClaimsFromContext(r.Context())
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/entitlementEvents", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected code without a token: actual='%d', expected='%d'", recorder.Code,
+			http.StatusUnauthorized)
+	}
+
+	token := keys.sign(t, "ES256", "ec", map[string]interface{}{
+		"iss": "https://marketplace", "aud": "listener", "exp": time.Now().Unix() + 60, "sub": "marketplace"})
+	request := httptest.NewRequest("POST", "/entitlementEvents", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Unexpected code: actual='%d', expected='%d'", recorder.Code, http.StatusOK)
+	}
+	if received == nil || received.Subject != "marketplace" {
+		t.Errorf("Unexpected claims: '%+v'", received)
+	}
+}
+
+func TestAccountClaim(t *testing.T) {
+	owners := map[string]string{"E1": "A1", "E2": "A2"}
+	owner := func(entitlementId string) (string, bool, error) {
+		accountId, found := owners[entitlementId]
+		return accountId, found, nil
+	}
+	handler := AccountClaim("accountId", owner)(func(
+		ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+		return model.EntitlementEventResponse{Status: model.RESPONSESTATUS_ACCEPTED, EventId: e.EventId}, nil
+	})
+	ctx := context.WithValue(context.Background(), claimsKey{}, &Claims{All: map[string]interface{}{
+		"accountId": "A1",
+	}})
+	noClaim := context.WithValue(context.Background(), claimsKey{}, &Claims{All: map[string]interface{}{}})
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		eventType     model.EntitlementEventType
+		entitlementId string
+		accountId     string
+		valid         bool
+	}{
+		{"create own", ctx, model.ENTITLEMENT_CREATED, "E3", "A1", true},
+		{"create for other account", ctx, model.ENTITLEMENT_CREATED, "E3", "A2", false},
+		{"create without account", ctx, model.ENTITLEMENT_CREATED, "E3", "", false},
+		{"create existing of other account", ctx, model.ENTITLEMENT_CREATED, "E2", "A1", false},
+		{"cancel own", ctx, model.ENTITLEMENT_CANCELLED, "E1", "", true},
+		{"cancel own with account", ctx, model.ENTITLEMENT_CANCELLED, "E1", "A1", true},
+		{"cancel of other account", ctx, model.ENTITLEMENT_CANCELLED, "E2", "", false},
+		{"delete of other account claiming own", ctx, model.ENTITLEMENT_DELETED, "E2", "A1", false},
+		{"delete unknown", ctx, model.ENTITLEMENT_DELETED, "E3", "", false},
+		{"no claim", noClaim, model.ENTITLEMENT_CANCELLED, "E1", "", false},
+		{"no token", context.Background(), model.ENTITLEMENT_DELETED, "E2", "A1", true},
+	}
+	for _, test := range tests {
+		_, err := handler(test.ctx, model.EntitlementEvent{
+			EventId:       "1",
+			EventType:     test.eventType,
+			EntitlementId: test.entitlementId,
+			AccountId:     test.accountId,
+		})
+		if test.valid && err != nil {
+			t.Errorf("Unexpected error for '%s': '%v'", test.name, err)
+		}
+		if _, ok := err.(*model.ValidationError); !test.valid && !ok {
+			t.Errorf("Expected a validation error for '%s': '%v'", test.name, err)
+		}
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	scope := IdempotencyScope("accountId")
+	withClaims := func(subject string, accountId string) context.Context {
+		return context.WithValue(context.Background(), claimsKey{}, &Claims{Subject: subject,
+			All: map[string]interface{}{"sub": subject, "accountId": accountId}})
+	}
+
+	scopes := map[string]bool{}
+	for _, ctx := range []context.Context{
+		context.Background(),
+		withClaims("", ""),
+		withClaims("S1", "A1"),
+		withClaims("S1", "A2"),
+		withClaims("S2", "A1"),
+		withClaims("S1 A", "1"),
+	} {
+		scopes[scope(ctx)] = true
+	}
+	if len(scopes) != 6 {
+		t.Errorf("Expected distinct scopes for distinct callers: '%v'", scopes)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// SIGNATURE_HEADER carries the hex encoded HMAC-SHA256 signature of the request.
+	SIGNATURE_HEADER = "X-Procurement-Signature"
+
+	// TIMESTAMP_HEADER carries the time at which the request was signed, in seconds since the Unix epoch.
+	TIMESTAMP_HEADER = "X-Procurement-Timestamp"
+
+	// NONCE_HEADER carries a value that is unique to the request, so that the request cannot be replayed.
+	NONCE_HEADER = "X-Procurement-Nonce"
+
+	// KEYID_HEADER optionally carries the id of the key that the request was signed with. Without it, every active
+	// key is tried.
+	KEYID_HEADER = "X-Procurement-Key-Id"
+
+	// DEFAULT_MAX_SKEW is the default difference that is allowed between the timestamp of a request and the local
+	// clock.
+	DEFAULT_MAX_SKEW time.Duration = 5 * time.Minute
+)
+
+// SigningKey is a shared secret that requests can be signed with.
+type SigningKey struct {
+	// Id identifies the key, e.g. in the KEYID_HEADER.
+	Id string `json:"id"`
+
+	// Secret is the shared secret.
+	Secret string `json:"secret"`
+}
+
+// SigningKeys is the content of a signing keys file. All of the keys are active, so that a new key can be added
+// before the senders switch over to it, and the old key removed afterwards.
+type SigningKeys struct {
+	Keys []SigningKey `json:"keys"`
+}
+
+// Validate checks that there is at least one key, and that the keys have distinct ids and non-empty secrets.
+func (k SigningKeys) Validate() error {
+	if len(k.Keys) == 0 {
+		return fmt.Errorf("No signing keys are defined.")
+	}
+
+	ids := map[string]bool{}
+	for i, key := range k.Keys {
+		if key.Id == "" {
+			return fmt.Errorf("Signing key '%d' has no id.", i)
+		}
+		if ids[key.Id] {
+			return fmt.Errorf("Duplicate signing key: '%s'.", key.Id)
+		}
+		ids[key.Id] = true
+		if key.Secret == "" {
+			return fmt.Errorf("Signing key '%s' has no secret.", key.Id)
+		}
+	}
+	return nil
+}
+
+// ReadSigningKeysFile reads and validates the signing keys in the given JSON file.
+func ReadSigningKeysFile(path string) (SigningKeys, error) {
+	var keys SigningKeys
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return keys, err
+	}
+
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return keys, fmt.Errorf("Unable to parse signing keys file '%s': '%v'.", path, err)
+	}
+
+	err = keys.Validate()
+	if err != nil {
+		return keys, fmt.Errorf("Invalid signing keys file '%s': %v", path, err)
+	}
+	return keys, nil
+}
+
+// Sign returns the signature of a request with the given timestamp, nonce, method, request URI and body. The
+// signature is the hex encoded HMAC-SHA256 of the timestamp, the nonce, the method, the request URI and the raw body,
+// separated by newlines, which none of the headers and request lines can contain. The nonce is covered by the
+// signature, so that a replayed request cannot be made to look new by changing its nonce, and so are the method and
+// the request URI, so that a signed body cannot be sent to another endpoint.
+func Sign(secret string, timestamp string, nonce string, method string, requestURI string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, part := range []string{timestamp, nonce, method, requestURI} {
+		mac.Write([]byte(part))
+		mac.Write([]byte("\n"))
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureVerifier verifies the signatures of incoming requests against the keys in a signing keys file.
+type SignatureVerifier struct {
+	path    string
+	maxSkew time.Duration
+	now     func() time.Time
+
+	mu   sync.RWMutex
+	keys SigningKeys
+
+	nonces *nonceCache
+}
+
+// CreateSignatureVerifier creates a new SignatureVerifier with the keys in the given file. Requests whose timestamp
+// differs from the local clock by more than maxSkew are rejected.
+func CreateSignatureVerifier(path string, maxSkew time.Duration) (*SignatureVerifier, error) {
+	if maxSkew <= 0 {
+		return nil, fmt.Errorf("Maximum clock skew must be positive: '%v'.", maxSkew)
+	}
+
+	v := &SignatureVerifier{
+		path:    path,
+		maxSkew: maxSkew,
+		now:     time.Now,
+		nonces:  createNonceCache(),
+	}
+	err := v.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload re-reads the signing keys file, e.g. after a key was added or removed. If the file is not valid, the
+// current keys are kept.
+func (v *SignatureVerifier) Reload() error {
+	keys, err := ReadSigningKeysFile(v.path)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	return nil
+}
+
+// Verify checks the signature, timestamp and nonce of the request with the given raw body. A nonce is only recorded
+// once the signature is verified, so that unsigned requests cannot fill up the record of nonces.
+func (v *SignatureVerifier) Verify(r *http.Request, body []byte) error {
+	signature, err := hex.DecodeString(r.Header.Get(SIGNATURE_HEADER))
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("Missing or malformed '%s' header.", SIGNATURE_HEADER)
+	}
+
+	timestamp := r.Header.Get(TIMESTAMP_HEADER)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Missing or malformed '%s' header: '%s'.", TIMESTAMP_HEADER, timestamp)
+	}
+	signedAt := time.Unix(seconds, 0)
+	now := v.now()
+	if signedAt.Before(now.Add(-v.maxSkew)) || signedAt.After(now.Add(v.maxSkew)) {
+		return fmt.Errorf("Timestamp is outside of the allowed skew: '%v'.", signedAt)
+	}
+
+	nonce := r.Header.Get(NONCE_HEADER)
+	if nonce == "" {
+		return fmt.Errorf("Missing '%s' header.", NONCE_HEADER)
+	}
+
+	// The request URI is the one that the request was received with, before any rewriting of its URL.
+	requestURI := r.RequestURI
+	if requestURI == "" {
+		requestURI = r.URL.RequestURI()
+	}
+
+	keyId, err := v.verifySignature(
+		r.Header.Get(KEYID_HEADER), signature, timestamp, nonce, r.Method, requestURI, body)
+	if err != nil {
+		return err
+	}
+
+	// The nonce is remembered for as long as the timestamp is within the allowed skew, after which the request is
+	// rejected based on its timestamp alone.
+	if !v.nonces.add(nonce, signedAt.Add(v.maxSkew), now) {
+		return fmt.Errorf("Replayed nonce: '%s' key: '%s'.", nonce, keyId)
+	}
+	return nil
+}
+
+// verifySignature checks the signature against the key with the given id, or against every key if the id is empty,
+// and returns the id of the matching key.
+func (v *SignatureVerifier) verifySignature(keyId string, signature []byte, timestamp string, nonce string,
+	method string, requestURI string, body []byte) (string, error) {
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	for _, key := range v.keys.Keys {
+		if keyId != "" && key.Id != keyId {
+			continue
+		}
+		expected, _ := hex.DecodeString(Sign(key.Secret, timestamp, nonce, method, requestURI, body))
+		if hmac.Equal(signature, expected) {
+			return key.Id, nil
+		}
+		if keyId != "" {
+			return "", fmt.Errorf("Signature does not match key: '%s'.", keyId)
+		}
+	}
+
+	if keyId != "" {
+		return "", fmt.Errorf("Unknown signing key: '%s'.", keyId)
+	}
+	return "", fmt.Errorf("Signature does not match any active key.")
+}
+
+// Middleware returns an http.Handler that only passes on the requests whose signature is verified. The body of the
+// request is read in full, and made available to the next handler again.
+func (v *SignatureVerifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeUnauthenticated(w, r, fmt.Errorf("Unable to read body: '%v'.", err))
+			return
+		}
+
+		err = v.Verify(r, body)
+		if err != nil {
+			writeUnauthenticated(w, r, err)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// nonceCache remembers the nonces that were seen, until they expire.
+type nonceCache struct {
+	mu        sync.Mutex
+	expiries  map[string]time.Time
+	lastPrune time.Time
+}
+
+func createNonceCache() *nonceCache {
+	return &nonceCache{
+		expiries: map[string]time.Time{},
+	}
+}
+
+// add records the nonce until the given expiry, and reports whether it was not seen before.
+func (c *nonceCache) add(nonce string, expiry time.Time, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastPrune) > time.Minute {
+		for n, e := range c.expiries {
+			if !e.After(now) {
+				delete(c.expiries, n)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if e, ok := c.expiries[nonce]; ok && e.After(now) {
+		return false
+	}
+	c.expiries[nonce] = expiry
+	return true
+}
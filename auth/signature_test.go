@@ -0,0 +1,157 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeKeys writes a signing keys file with the given keys, and returns its path.
+func writeKeys(t *testing.T, dir string, content string) string {
+	path := filepath.Join(dir, "keys.json")
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// signedRequest creates a request with the given body, signed with the given key at the given time.
+func signedRequest(key SigningKey, keyId string, at time.Time, nonce string, body string) *http.Request {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	r := httptest.NewRequest("POST", "/entitlementEvents?async=true", bytes.NewBufferString(body))
+	r.Header.Set(TIMESTAMP_HEADER, timestamp)
+	r.Header.Set(NONCE_HEADER, nonce)
+	r.Header.Set(SIGNATURE_HEADER, Sign(key.Secret, timestamp, nonce, r.Method, r.RequestURI, []byte(body)))
+	if keyId != "" {
+		r.Header.Set(KEYID_HEADER, keyId)
+	}
+	return r
+}
+
+// echoHandler writes back the body of the request.
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Write(body)
+})
+
+func TestSignatureVerification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeKeys(t, dir, `{"keys": [{"id": "old", "secret": "s1"}, {"id": "new", "secret": "s2"}]}`)
+	verifier, err := CreateSignatureVerifier(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	verifier.now = func() time.Time { return now }
+
+	oldKey := SigningKey{Id: "old", Secret: "s1"}
+	newKey := SigningKey{Id: "new", Secret: "s2"}
+	tamperedBody := signedRequest(oldKey, "", now, "n5", `{}`)
+	tamperedBody.Body = ioutil.NopCloser(bytes.NewBufferString(`{"eventId": "2"}`))
+	tamperedMethod := signedRequest(oldKey, "", now, "n11", `{}`)
+	tamperedMethod.Method = "PUT"
+	tamperedURI := signedRequest(oldKey, "", now, "n12", `{}`)
+	tamperedURI.RequestURI = "/entitlementEvents"
+	unsigned := httptest.NewRequest("POST", "/entitlementEvents", bytes.NewBufferString(`{}`))
+
+	tests := []struct {
+		name     string
+		request  *http.Request
+		expected int
+	}{
+		{"old key", signedRequest(oldKey, "", now, "n1", `{"eventId": "1"}`), http.StatusOK},
+		{"new key", signedRequest(newKey, "", now, "n2", `{"eventId": "1"}`), http.StatusOK},
+		{"key id", signedRequest(newKey, "new", now, "n3", `{"eventId": "1"}`), http.StatusOK},
+		{"wrong key id", signedRequest(newKey, "old", now, "n4", `{"eventId": "1"}`), http.StatusUnauthorized},
+		{"unknown key", signedRequest(SigningKey{Secret: "s3"}, "", now, "n6", `{}`), http.StatusUnauthorized},
+		{"tampered body", tamperedBody, http.StatusUnauthorized},
+		{"tampered method", tamperedMethod, http.StatusUnauthorized},
+		{"tampered request URI", tamperedURI, http.StatusUnauthorized},
+		{"unsigned", unsigned, http.StatusUnauthorized},
+		{"replayed nonce", signedRequest(oldKey, "", now, "n1", `{"eventId": "1"}`), http.StatusUnauthorized},
+		{"within skew", signedRequest(oldKey, "", now.Add(-50*time.Second), "n7", `{}`), http.StatusOK},
+		{"too old", signedRequest(oldKey, "", now.Add(-2*time.Minute), "n8", `{}`), http.StatusUnauthorized},
+		{"too new", signedRequest(oldKey, "", now.Add(2*time.Minute), "n9", `{}`), http.StatusUnauthorized},
+	}
+
+	handler := verifier.Middleware(echoHandler)
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, test.request)
+		if recorder.Code != test.expected {
+			t.Errorf("Unexpected code for '%s': actual='%d', expected='%d'", test.name, recorder.Code, test.expected)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, signedRequest(oldKey, "", now, "n10", `{"eventId": "1"}`))
+	if recorder.Body.String() != `{"eventId": "1"}` {
+		t.Errorf("Body was not passed on: '%s'", recorder.Body.String())
+	}
+}
+
+func TestSigningKeyReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeKeys(t, dir, `{"keys": [{"id": "old", "secret": "s1"}]}`)
+	verifier, err := CreateSignatureVerifier(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := SigningKey{Id: "new", Secret: "s2"}
+	err = verifier.Verify(signedRequest(newKey, "", time.Now(), "n1", ""), nil)
+	if err == nil {
+		t.Error("Expected an error for a key that is not active yet.")
+	}
+
+	writeKeys(t, dir, `{"keys": [{"id": "new", "secret": "s2"}]}`)
+	err = verifier.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifier.Verify(signedRequest(newKey, "", time.Now(), "n2", ""), nil)
+	if err != nil {
+		t.Errorf("Unexpected error after reload: '%v'", err)
+	}
+
+	writeKeys(t, dir, `{"keys": []}`)
+	err = verifier.Reload()
+	if err == nil {
+		t.Error("Expected an error for a file without keys.")
+	}
+	err = verifier.Verify(signedRequest(newKey, "", time.Now(), "n3", ""), nil)
+	if err != nil {
+		t.Errorf("The keys were not kept after a failed reload: '%v'", err)
+	}
+}
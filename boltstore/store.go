@@ -0,0 +1,391 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package boltstore contains an EntitlementStore that keeps the entitlements, and the ids of the processed events, in
+// an embedded bbolt database. It suits single-node deployments that do not have a SQL database.
+//
+// Each entitlement has its own bucket, that holds the entitlement, and the ids of the events that were applied to it.
+// Once the entitlement is deleted, only the id of the event that deleted it is kept, so that the ids of the events of
+// deleted entitlements do not accumulate. The entitlements are also indexed by AccountId and ServiceId. All changes are made in a single transaction, which
+// is synced to disk before it is acknowledged, so the database is consistent after a crash.
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"log"
+	"net/http"
+	"procurementlistenerservice/inmemory"
+	"reflect"
+	"time"
+)
+
+var (
+	entitlementsBucket = []byte("entitlements")
+	accountsBucket     = []byte("accountIndex")
+	servicesBucket     = []byte("serviceIndex")
+	eventsBucket       = []byte("events")
+
+	infoKey = []byte("info")
+)
+
+// OPEN_TIMEOUT is the time that Open waits for another process to release the database.
+const OPEN_TIMEOUT time.Duration = 5 * time.Second
+
+// Store is an EntitlementStore that keeps the entitlements in a bbolt database.
+type Store struct {
+	db *bolt.DB
+}
+
+var _ inmemory.EntitlementStore = &Store{}
+var _ inmemory.ProcessedEventStore = &Store{}
+
+// record is the stored form of an EntitlementInfo.
+type record struct {
+	Id          string                 `json:"id"`
+	State       string                 `json:"state"`
+	ServiceId   string                 `json:"serviceId"`
+	PlanId      string                 `json:"planId"`
+	AccountId   string                 `json:"accountId"`
+	RequestorId string                 `json:"requestorId"`
+	Parameters  map[string]interface{} `json:"parameters"`
+	Labels      map[string]string      `json:"labels"`
+}
+
+// Open opens the bbolt database at the given path, creating it if it does not exist.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: OPEN_TIMEOUT})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open database '%s': '%v'.", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{entitlementsBucket, accountsBucket, servicesBucket, eventsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to initialize database '%s': '%v'.", path, err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) Get(id string) (inmemory.EntitlementInfo, error) {
+	var info inmemory.EntitlementInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, err = get(tx, id)
+		return err
+	})
+	return info, err
+}
+
+func (s *Store) Put(info inmemory.EntitlementInfo) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		existing, err := get(tx, info.Id)
+		if err == inmemory.ErrEntitlementNotFound {
+			return put(tx, nil, info)
+		}
+		if err != nil {
+			return err
+		}
+		return put(tx, &existing, info)
+	})
+}
+
+func (s *Store) CompareAndSwap(old *inmemory.EntitlementInfo, info inmemory.EntitlementInfo) (bool, error) {
+	return s.CompareAndSwapEvent("", old, info)
+}
+
+// CompareAndSwapEvent is CompareAndSwap that also records, in the same transaction, that the event with the given id
+// was applied to the entitlement. An empty event id records nothing. When the entitlement becomes DELETED, the events
+// that were recorded before are forgotten.
+func (s *Store) CompareAndSwapEvent(
+	eventId string, old *inmemory.EntitlementInfo, info inmemory.EntitlementInfo) (bool, error) {
+
+	swapped := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		existing, err := get(tx, info.Id)
+		if err == inmemory.ErrEntitlementNotFound {
+			if old != nil {
+				return nil
+			}
+		} else if err != nil {
+			return err
+		} else if old == nil || !reflect.DeepEqual(existing, *old) {
+			return nil
+		} else {
+			old = &existing
+		}
+
+		err = put(tx, old, info)
+		if err != nil {
+			return err
+		}
+		if info.State == inmemory.DELETED {
+			err = forgetEvents(tx, info.Id)
+			if err != nil {
+				return err
+			}
+		}
+		if eventId != "" {
+			err = markProcessed(tx, eventId, info.Id)
+			if err != nil {
+				return err
+			}
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+// IsProcessed reports whether the event with the given id was recorded by CompareAndSwapEvent.
+func (s *Store) IsProcessed(eventId string) (bool, error) {
+	processed := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		processed = tx.Bucket(eventsBucket).Get([]byte(eventId)) != nil
+		return nil
+	})
+	return processed, err
+}
+
+func (s *Store) List() ([]inmemory.EntitlementInfo, error) {
+	list := make([]inmemory.EntitlementInfo, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entitlementsBucket).ForEach(func(id []byte, _ []byte) error {
+			info, err := get(tx, string(id))
+			if err != nil {
+				return err
+			}
+			list = append(list, info)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// ListByAccount returns the entitlements of the given account, ordered by id.
+func (s *Store) ListByAccount(accountId string) ([]inmemory.EntitlementInfo, error) {
+	return s.listByIndex(accountsBucket, accountId)
+}
+
+// ListByService returns the entitlements of the given service, ordered by id.
+func (s *Store) ListByService(serviceId string) ([]inmemory.EntitlementInfo, error) {
+	return s.listByIndex(servicesBucket, serviceId)
+}
+
+func (s *Store) listByIndex(index []byte, value string) ([]inmemory.EntitlementInfo, error) {
+	list := make([]inmemory.EntitlementInfo, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := indexKey(value, "")
+		c := tx.Bucket(index).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			info, err := get(tx, string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			list = append(list, info)
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (s *Store) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		existing, err := get(tx, id)
+		if err == inmemory.ErrEntitlementNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = forgetEvents(tx, id)
+		if err != nil {
+			return err
+		}
+
+		err = unindex(tx, existing)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(entitlementsBucket).DeleteBucket([]byte(id))
+	})
+}
+
+// Backup writes a consistent copy of the database to the given writer, while the database remains in use.
+func (s *Store) Backup(w io.Writer) (int64, error) {
+	var written int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		written, err = tx.WriteTo(w)
+		return err
+	})
+	return written, err
+}
+
+// BackupHandler returns a handler that responds with a consistent copy of the database.
+func (s *Store) BackupHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="entitlements.db"`)
+
+		written, err := s.Backup(w)
+		if err != nil {
+			// The response has been started, so the client can only tell from the truncated body.
+			log.Printf("Unable to write backup: '%v'\n", err)
+			return
+		}
+		log.Printf("Wrote backup: '%d' bytes\n", written)
+	})
+}
+
+func get(tx *bolt.Tx, id string) (inmemory.EntitlementInfo, error) {
+	bucket := tx.Bucket(entitlementsBucket).Bucket([]byte(id))
+	if bucket == nil {
+		return inmemory.EntitlementInfo{}, inmemory.ErrEntitlementNotFound
+	}
+
+	var r record
+	err := json.Unmarshal(bucket.Get(infoKey), &r)
+	if err != nil {
+		return inmemory.EntitlementInfo{}, fmt.Errorf("Unable to decode entitlement '%s': '%v'.", id, err)
+	}
+
+	state, err := inmemory.ParseEntitlementState(r.State)
+	if err != nil {
+		return inmemory.EntitlementInfo{}, err
+	}
+
+	return inmemory.EntitlementInfo{
+		Id:          r.Id,
+		State:       state,
+		ServiceId:   r.ServiceId,
+		PlanId:      r.PlanId,
+		AccountId:   r.AccountId,
+		RequestorId: r.RequestorId,
+		Parameters:  r.Parameters,
+		Labels:      r.Labels,
+	}, nil
+}
+
+// put stores the given entitlement, and updates the indexes. Old is the entitlement that is being replaced, if any.
+func put(tx *bolt.Tx, old *inmemory.EntitlementInfo, info inmemory.EntitlementInfo) error {
+	data, err := json.Marshal(record{
+		Id:          info.Id,
+		State:       info.State.String(),
+		ServiceId:   info.ServiceId,
+		PlanId:      info.PlanId,
+		AccountId:   info.AccountId,
+		RequestorId: info.RequestorId,
+		Parameters:  info.Parameters,
+		Labels:      info.Labels,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to encode entitlement '%s': '%v'.", info.Id, err)
+	}
+
+	bucket, err := tx.Bucket(entitlementsBucket).CreateBucketIfNotExists([]byte(info.Id))
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.CreateBucketIfNotExists(eventsBucket); err != nil {
+		return err
+	}
+	err = bucket.Put(infoKey, data)
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		err = unindex(tx, *old)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Bucket(accountsBucket).Put(indexKey(info.AccountId, info.Id), []byte{})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(servicesBucket).Put(indexKey(info.ServiceId, info.Id), []byte{})
+}
+
+func unindex(tx *bolt.Tx, info inmemory.EntitlementInfo) error {
+	err := tx.Bucket(accountsBucket).Delete(indexKey(info.AccountId, info.Id))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(servicesBucket).Delete(indexKey(info.ServiceId, info.Id))
+}
+
+func markProcessed(tx *bolt.Tx, eventId string, entitlementId string) error {
+	processedAt := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	err := tx.Bucket(entitlementsBucket).Bucket([]byte(entitlementId)).Bucket(eventsBucket).Put(
+		[]byte(eventId), processedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(eventsBucket).Put([]byte(eventId), []byte(entitlementId))
+}
+
+// forgetEvents removes the records of the events that were applied to the given entitlement.
+func forgetEvents(tx *bolt.Tx, entitlementId string) error {
+	events := tx.Bucket(entitlementsBucket).Bucket([]byte(entitlementId)).Bucket(eventsBucket)
+
+	// The keys are collected first, since a bucket must not be modified while it is iterated.
+	var eventIds [][]byte
+	err := events.ForEach(func(eventId []byte, _ []byte) error {
+		eventIds = append(eventIds, append([]byte{}, eventId...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, eventId := range eventIds {
+		err = tx.Bucket(eventsBucket).Delete(eventId)
+		if err == nil {
+			err = events.Delete(eventId)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexKey returns the key of an index entry. The indexed value is prefixed with its length, so that the entries of a
+// value can be found by prefix, whatever bytes the value and the id contain.
+func indexKey(value string, id string) []byte {
+	key := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(value)+len(id))
+	key = key[:binary.PutUvarint(key, uint64(len(value)))]
+	key = append(key, value...)
+	return append(key, id...)
+}
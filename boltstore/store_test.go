@@ -0,0 +1,194 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package boltstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"procurementlistenerservice/conformance"
+	"procurementlistenerservice/inmemory"
+	"testing"
+)
+
+func openTestStore(t *testing.T, dir string, name string) *Store {
+	store, err := Open(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openTestStore(t, dir, "entitlements.db")
+	defer store.Close()
+
+	conformance.StoreTests(t, store)
+}
+
+func TestIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openTestStore(t, dir, "entitlements.db")
+	defer store.Close()
+
+	for _, info := range []inmemory.EntitlementInfo{
+		{Id: "E1", AccountId: "A1", ServiceId: "S1"},
+		{Id: "E2", AccountId: "A1", ServiceId: "S2"},
+		{Id: "E3", AccountId: "A10", ServiceId: "S1"},
+		// An account id that starts with another one, followed by a zero byte, has entries of its own.
+		{Id: "E4", AccountId: "A1\x00E5", ServiceId: "S3"},
+	} {
+		if err := store.Put(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Moving an entitlement to another account updates the index.
+	old := inmemory.EntitlementInfo{Id: "E3", AccountId: "A10", ServiceId: "S1"}
+	if swapped, err := store.CompareAndSwap(&old, inmemory.EntitlementInfo{Id: "E3", AccountId: "A2",
+		ServiceId: "S1"}); err != nil || !swapped {
+		t.Fatalf("Unable to update entitlement: swapped='%v' err='%v'", swapped, err)
+	}
+
+	expect := func(list []inmemory.EntitlementInfo, err error, ids ...string) {
+		if err != nil || len(list) != len(ids) {
+			t.Fatalf("Unexpected entitlements: actual='%+v' expected='%v' err='%v'", list, ids, err)
+		}
+		for i := range ids {
+			if list[i].Id != ids[i] {
+				t.Fatalf("Unexpected entitlements: actual='%+v' expected='%v'", list, ids)
+			}
+		}
+	}
+
+	list, err := store.ListByAccount("A1")
+	expect(list, err, "E1", "E2")
+	list, err = store.ListByAccount("A10")
+	expect(list, err)
+	list, err = store.ListByAccount("A1\x00E5")
+	expect(list, err, "E4")
+	list, err = store.ListByService("S1")
+	expect(list, err, "E1", "E3")
+
+	if err := store.Delete("E1"); err != nil {
+		t.Fatal(err)
+	}
+	list, err = store.ListByService("S1")
+	expect(list, err, "E3")
+}
+
+func TestProcessedEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openTestStore(t, dir, "entitlements.db")
+	info := inmemory.EntitlementInfo{Id: "E1"}
+	if swapped, err := store.CompareAndSwapEvent("event1", nil, info); err != nil || !swapped {
+		t.Fatalf("Unable to create entitlement: swapped='%v' err='%v'", swapped, err)
+	}
+
+	// A failed swap does not record the event.
+	if swapped, err := store.CompareAndSwapEvent("event2", nil, info); err != nil || swapped {
+		t.Fatalf("Expected a duplicate entitlement not to be created: swapped='%v' err='%v'", swapped, err)
+	}
+	store.Close()
+
+	store = openTestStore(t, dir, "entitlements.db")
+	defer store.Close()
+
+	for eventId, expected := range map[string]bool{"event1": true, "event2": false} {
+		if processed, err := store.IsProcessed(eventId); err != nil || processed != expected {
+			t.Errorf("Unexpected processed state of '%s': '%v' '%v'", eventId, processed, err)
+		}
+	}
+
+	if err := store.Delete("E1"); err != nil {
+		t.Fatal(err)
+	}
+	if processed, _ := store.IsProcessed("event1"); processed {
+		t.Errorf("Expected the events of a deleted entitlement to be forgotten")
+	}
+
+	// Once an entitlement is DELETED, only the event that deleted it is remembered.
+	created := inmemory.EntitlementInfo{Id: "E2", State: inmemory.ACTIVE}
+	cancelled := inmemory.EntitlementInfo{Id: "E2", State: inmemory.CANCELLED}
+	deleted := inmemory.EntitlementInfo{Id: "E2", State: inmemory.DELETED}
+	for i, swap := range []struct{ old, info *inmemory.EntitlementInfo }{
+		{nil, &created}, {&created, &cancelled}, {&cancelled, &deleted}} {
+		if swapped, err := store.CompareAndSwapEvent(
+			fmt.Sprintf("event%d", i+3), swap.old, *swap.info); err != nil || !swapped {
+			t.Fatalf("Unable to update entitlement: swapped='%v' err='%v'", swapped, err)
+		}
+	}
+	for eventId, expected := range map[string]bool{"event3": false, "event4": false, "event5": true} {
+		if processed, err := store.IsProcessed(eventId); err != nil || processed != expected {
+			t.Errorf("Unexpected processed state of '%s': '%v' '%v'", eventId, processed, err)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openTestStore(t, dir, "entitlements.db")
+	defer store.Close()
+	if err := store.Put(inmemory.EntitlementInfo{Id: "E1", State: inmemory.CANCELLED}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	store.BackupHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/backup", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Unexpected code: '%d'", recorder.Code)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "backup.db"), recorder.Body.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := openTestStore(t, dir, "backup.db")
+	defer backup.Close()
+
+	info, err := backup.Get("E1")
+	if err != nil || info.State != inmemory.CANCELLED {
+		t.Errorf("Unexpected entitlement in backup: '%+v' '%v'", info, err)
+	}
+
+	var buffer bytes.Buffer
+	if written, err := store.Backup(&buffer); err != nil || written != int64(buffer.Len()) {
+		t.Errorf("Unexpected backup: written='%d' err='%v'", written, err)
+	}
+}
@@ -18,8 +18,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"procurementlistenerservice/async"
 	"procurementlistenerservice/inmemory"
+	"procurementlistenerservice/model"
 	"reflect"
 	"testing"
 )
@@ -40,9 +44,11 @@ type Action interface {
 // TestContext abstracts the externally supplied data to the conformance test suite. Each particular test implementation
 // will need to implement and supply a context.
 type TestContext interface {
-	Port() int
+	// BaseUrl is the URL of the service under test, without a trailing slash (e.g. "http://127.0.0.1:8080/prefix").
+	BaseUrl() string
 	T() *testing.T
 	GetEntitlements() []inmemory.EntitlementInfo
+	GetNotifications() []async.Notification
 }
 
 // PostEntitlementEvent is a test action that will post an entitlement event to the service and will expect a particular
@@ -50,24 +56,127 @@ type TestContext interface {
 type PostEntitlementEvent struct {
 	Request      string
 	ExpectedCode int
+
+	// ExpectedResponse, if set, is compared against the body of the response. The Status field is ignored.
+	ExpectedResponse *model.EntitlementEventResponse
+
+	// ExpectedError, if set, is compared against the error in the body of the response.
+	ExpectedError *model.ErrorDetail
 }
 
 var _ Action = PostEntitlementEvent{}
 
 func (a PostEntitlementEvent) execute(c TestContext) error {
-	response, err := post(c.Port(), "entitlementEvents", a.Request)
+	response, err := post(c.BaseUrl(), "entitlementEvents", a.Request)
 	if err != nil {
 		return err
 	}
+	defer response.Body.Close()
 
 	if response.StatusCode != a.ExpectedCode {
 		return fmt.Errorf(
 			"Unexpected HTTP response code: actual='%d', expected='%d'", response.StatusCode, a.ExpectedCode)
 	}
 
+	if a.ExpectedResponse == nil && a.ExpectedError == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if a.ExpectedError != nil {
+		var actual model.ErrorResponse
+		err = json.Unmarshal(body, &actual)
+		if err != nil {
+			return fmt.Errorf("Unable to parse error response: '%v' body: '%s'", err, body)
+		}
+
+		if !reflect.DeepEqual(*a.ExpectedError, actual.Error) {
+			return fmt.Errorf("Unexpected error: actual='%+v', expected='%+v'", actual.Error, *a.ExpectedError)
+		}
+	}
+
+	if a.ExpectedResponse != nil {
+		var actual model.EntitlementEventResponse
+		err = json.Unmarshal(body, &actual)
+		if err != nil {
+			return fmt.Errorf("Unable to parse response: '%v' body: '%s'", err, body)
+		}
+
+		expected := *a.ExpectedResponse
+		expected.Status = actual.Status
+		if !reflect.DeepEqual(expected, actual) {
+			return fmt.Errorf("Unexpected response: actual='%+v', expected='%+v'", actual, expected)
+		}
+	}
+
+	return nil
+}
+
+// ReplayEntitlementEvent is a test action that will post an entitlement event, perform the intermediate actions, and
+// then redeliver the event. Both deliveries are expected to return the given code, and the redelivered response body is
+// expected to be byte-identical to the original one.
+type ReplayEntitlementEvent struct {
+	Request string
+
+	// Redelivery, if set, is posted instead of Request the second time. It should describe the same event, possibly
+	// with a different field order.
+	Redelivery string
+
+	ExpectedCode int
+
+	// Between are the actions that are performed between the original delivery and the redelivery.
+	Between []Action
+}
+
+var _ Action = ReplayEntitlementEvent{}
+
+func (a ReplayEntitlementEvent) execute(c TestContext) error {
+	original, err := a.deliver(c, a.Request)
+	if err != nil {
+		return err
+	}
+
+	for _, action := range a.Between {
+		if err := action.execute(c); err != nil {
+			return err
+		}
+	}
+
+	redelivery := a.Redelivery
+	if redelivery == "" {
+		redelivery = a.Request
+	}
+	replayed, err := a.deliver(c, redelivery)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(original, replayed) {
+		return fmt.Errorf("Replayed response differs: actual='%s', expected='%s'", replayed, original)
+	}
+
 	return nil
 }
 
+func (a ReplayEntitlementEvent) deliver(c TestContext, request string) ([]byte, error) {
+	response, err := post(c.BaseUrl(), "entitlementEvents", request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != a.ExpectedCode {
+		return nil, fmt.Errorf(
+			"Unexpected HTTP response code: actual='%d', expected='%d'", response.StatusCode, a.ExpectedCode)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
 type ExpectEntitlements struct {
 	Entitlements []inmemory.EntitlementInfo
 }
@@ -97,8 +206,66 @@ func (a ExpectEntitlements) execute(c TestContext) error {
 	return nil
 }
 
-func post(port int, path string, payload string) (*http.Response, error) {
-	url := createUrl(path, port)
+// CompletePendingEvent is a test action that will complete a pending event with the given status, and will expect a
+// particular response.
+type CompletePendingEvent struct {
+	EventId      string
+	Status       string
+	Reason       *model.RejectionReason
+	ExpectedCode int
+}
+
+var _ Action = CompletePendingEvent{}
+
+func (a CompletePendingEvent) execute(c TestContext) error {
+	request, err := json.Marshal(map[string]interface{}{
+		"status": a.Status,
+		"reason": a.Reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("pendingEvents/%s/completion", a.EventId)
+	response, err := post(c.BaseUrl(), path, string(request))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != a.ExpectedCode {
+		return fmt.Errorf(
+			"Unexpected HTTP response code: actual='%d', expected='%d'", response.StatusCode, a.ExpectedCode)
+	}
+
+	return nil
+}
+
+// ExpectNotifications is a test action that checks the notifications that were received by the marketplace, in order.
+type ExpectNotifications struct {
+	Notifications []async.Notification
+}
+
+var _ Action = ExpectNotifications{}
+
+func (a ExpectNotifications) execute(c TestContext) error {
+	actual := c.GetNotifications()
+	if len(actual) != len(a.Notifications) {
+		return fmt.Errorf("Notification count mismatch: actual='%d', expected='%d'.",
+			len(actual), len(a.Notifications))
+	}
+
+	for i, n := range a.Notifications {
+		if !reflect.DeepEqual(n, actual[i]) {
+			return fmt.Errorf("Notification mismatch: actual='%+v', expected='%+v'", actual[i], n)
+		}
+	}
+
+	return nil
+}
+
+func post(baseUrl string, path string, payload string) (*http.Response, error) {
+	url := createUrl(baseUrl, path)
 
 	var reader io.Reader
 	if payload != "" {
@@ -108,8 +275,8 @@ func post(port int, path string, payload string) (*http.Response, error) {
 	return http.Post(url, "application/json", reader)
 }
 
-func createUrl(path string, port int) string {
-	return fmt.Sprintf("http://localhost:%d/%s", port, path)
+func createUrl(baseUrl string, path string) string {
+	return fmt.Sprintf("%s/%s", baseUrl, path)
 }
 
 func (c ConformanceTest) Execute(context TestContext) {
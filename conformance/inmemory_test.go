@@ -15,18 +15,64 @@
 package conformance
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"procurementlistenerservice/async"
+	"procurementlistenerservice/boltstore"
 	"procurementlistenerservice/inmemory"
+	"procurementlistenerservice/interceptor"
+	"procurementlistenerservice/model"
 	"procurementlistenerservice/server"
+	"procurementlistenerservice/sqlitestore"
+	"sync"
 	"testing"
 )
 
 const (
-	TEST_PORT int = 54345
+	// TEST_PATH_PREFIX is the prefix that the server under test is mounted at, so that the prefix is covered too.
+	TEST_PATH_PREFIX string = "/procurement"
 )
 
 var service *inmemory.InMemoryService
+var marketplace *fakeMarketplace
+var idempotency *server.IdempotencyCache
+var baseUrl string
+
+// fakeMarketplace records the completion notifications that it receives.
+type fakeMarketplace struct {
+	mu            sync.Mutex
+	notifications []async.Notification
+}
+
+func (m *fakeMarketplace) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var n async.Notification
+	err = json.Unmarshal(body, &n)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifications = append(m.notifications, n)
+}
+
+func (m *fakeMarketplace) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifications = nil
+}
 
 type inMemoryTestContext struct {
 	t *testing.T
@@ -34,8 +80,8 @@ type inMemoryTestContext struct {
 
 var _ TestContext = inMemoryTestContext{}
 
-func (c inMemoryTestContext) Port() int {
-	return TEST_PORT
+func (c inMemoryTestContext) BaseUrl() string {
+	return baseUrl
 }
 
 func (c inMemoryTestContext) T() *testing.T {
@@ -43,21 +89,84 @@ func (c inMemoryTestContext) T() *testing.T {
 }
 
 func (c inMemoryTestContext) GetEntitlements() []inmemory.EntitlementInfo {
-	v := make([]inmemory.EntitlementInfo, 0)
-
-	for _, value := range service.Entitlements {
-		v = append(v, value)
+	v, err := service.ListEntitlements()
+	if err != nil {
+		c.t.Errorf("Unable to list entitlements: '%v'", err)
 	}
 	return v
 }
 
+func (c inMemoryTestContext) GetNotifications() []async.Notification {
+	marketplace.mu.Lock()
+	defer marketplace.mu.Unlock()
+
+	return append([]async.Notification{}, marketplace.notifications...)
+}
+
+// currentService delegates to the service under test, so that the same server can test the service with different
+// entitlement stores.
+type currentService struct{}
+
+var _ model.AsyncPartnerBackendService = currentService{}
+
+func (currentService) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return service.OnEntitlementEvent(e)
+}
+
+func (currentService) OnEntitlementEventCompleted(
+	e model.EntitlementEvent, status model.ResponseStatus) (model.EntitlementEventResponse, error) {
+	return service.OnEntitlementEventCompleted(e, status)
+}
+
 func TestInMemoryService(t *testing.T) {
+	runTests(t, inmemory.CreateMapStore())
+}
+
+func TestSQLiteService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := sqlitestore.Open(filepath.Join(dir, "entitlements.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	runTests(t, store)
+}
+
+func TestBoltService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := boltstore.Open(filepath.Join(dir, "entitlements.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	runTests(t, store)
+}
+
+// runTests runs the conformance tests against the service, with the given entitlement store.
+func runTests(t *testing.T, store inmemory.EntitlementStore) {
+	service = inmemory.CreateServiceWithStore(metadata, store)
 	context := inMemoryTestContext{
 		t: t,
 	}
 
 	for _, test := range Tests {
-		service.Reset()
+		if err := service.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		marketplace.reset()
+		idempotency.Reset()
 		t.Run(test.Name, func(t *testing.T) {
 			test.Execute(context)
 		})
@@ -65,14 +174,42 @@ func TestInMemoryService(t *testing.T) {
 }
 
 func TestMain(m *testing.M) {
+	err := metadata.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "conformance")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pendingStore, err := async.OpenFilePendingStore(filepath.Join(dir, "pending.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	marketplace = &fakeMarketplace{}
+	marketplaceServer := httptest.NewServer(marketplace)
+	defer marketplaceServer.Close()
+
 	service = inmemory.CreateService(metadata)
-	s, err := server.CreateServer(TEST_PORT, service)
+	tracker := async.CreateTracker(pendingStore, async.CreateHTTPNotifier(marketplaceServer.URL), currentService{})
+	idempotency = server.CreateIdempotencyCache(server.DEFAULT_IDEMPOTENCY_CAPACITY, server.DEFAULT_IDEMPOTENCY_TTL)
+	s, err := server.CreateServer(0, currentService{},
+		server.WithPathPrefix(TEST_PATH_PREFIX),
+		server.WithAsyncTracker(tracker),
+		server.WithIdempotencyCache(idempotency),
+		server.WithInterceptors(interceptor.Recovery(), interceptor.Validation()))
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(-1)
 	}
 
-	go s.Start()
+	testServer := httptest.NewServer(s.Handler())
+	defer testServer.Close()
+	baseUrl = testServer.URL + TEST_PATH_PREFIX
 
 	m.Run()
 }
@@ -0,0 +1,93 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance
+
+import (
+	"procurementlistenerservice/inmemory"
+	"reflect"
+	"testing"
+)
+
+// StoreTests verifies that the given, empty EntitlementStore implements the contract of the interface.
+func StoreTests(t *testing.T, store inmemory.EntitlementStore) {
+	e1 := inmemory.EntitlementInfo{
+		Id:          "E1",
+		State:       inmemory.ACTIVE,
+		ServiceId:   "S1",
+		PlanId:      "P1",
+		AccountId:   "A1",
+		RequestorId: "R1",
+		Parameters:  map[string]interface{}{"name": "n", "size": 2.0, "nested": map[string]interface{}{"on": true}},
+		Labels:      map[string]string{"tier": "gold"},
+	}
+	e2 := inmemory.EntitlementInfo{Id: "E2", State: inmemory.PENDING, ServiceId: "S2", PlanId: "P2", AccountId: "A2"}
+
+	if _, err := store.Get("E1"); err != inmemory.ErrEntitlementNotFound {
+		t.Fatalf("Expected '%v' for a missing entitlement, got '%v'", inmemory.ErrEntitlementNotFound, err)
+	}
+
+	swapped, err := store.CompareAndSwap(nil, e1)
+	if err != nil || !swapped {
+		t.Fatalf("Expected the entitlement to be created: swapped='%v' err='%v'", swapped, err)
+	}
+	swapped, err = store.CompareAndSwap(nil, e1)
+	if err != nil || swapped {
+		t.Fatalf("Expected a duplicate entitlement not to be created: swapped='%v' err='%v'", swapped, err)
+	}
+
+	actual, err := store.Get("E1")
+	if err != nil || !reflect.DeepEqual(actual, e1) {
+		t.Fatalf("Unexpected entitlement: actual='%+v' expected='%+v' err='%v'", actual, e1, err)
+	}
+
+	updated := e1
+	updated.State = inmemory.CANCELLED
+	updated.Parameters = nil
+	swapped, err = store.CompareAndSwap(&e2, updated)
+	if err != nil || swapped {
+		t.Fatalf("Expected a stale swap to fail: swapped='%v' err='%v'", swapped, err)
+	}
+	swapped, err = store.CompareAndSwap(&e1, updated)
+	if err != nil || !swapped {
+		t.Fatalf("Expected the entitlement to be updated: swapped='%v' err='%v'", swapped, err)
+	}
+	swapped, err = store.CompareAndSwap(&e2, e2)
+	if err != nil || swapped {
+		t.Fatalf("Expected a swap of a missing entitlement to fail: swapped='%v' err='%v'", swapped, err)
+	}
+
+	err = store.Put(e2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := store.List()
+	expected := []inmemory.EntitlementInfo{updated, e2}
+	if err != nil || !reflect.DeepEqual(list, expected) {
+		t.Fatalf("Unexpected entitlements: actual='%+v' expected='%+v' err='%v'", list, expected, err)
+	}
+
+	for _, id := range []string{"E1", "E1", "E2"} {
+		err = store.Delete(id)
+		if err != nil {
+			t.Fatalf("Unable to delete entitlement '%s': '%v'", id, err)
+		}
+	}
+
+	list, err = store.List()
+	if err != nil || len(list) != 0 {
+		t.Fatalf("Expected no entitlements: actual='%+v' err='%v'", list, err)
+	}
+}
@@ -21,7 +21,9 @@ package conformance
 import (
 	"encoding/json"
 	"log"
+	"procurementlistenerservice/async"
 	"procurementlistenerservice/inmemory"
+	"procurementlistenerservice/model"
 )
 
 // This files contains behavior/conformance tests for the Procurement Partner Backend, in declarative form.
@@ -64,6 +66,102 @@ var metadata inmemory.Metadata = inmemory.Metadata{
 				},
 			},
 		},
+
+		{
+			// A service with multiple plans, with restricted upgrade/downgrade paths between them.
+			ServiceId: "Tiered",
+			Plans: []inmemory.PlanDefinition{
+				{
+					PlanId:             "Basic",
+					AllowedPlanChanges: []string{"Premium"},
+				},
+				{
+					PlanId:             "Premium",
+					AllowedPlanChanges: []string{"Basic"},
+					InputParameterSchema: createInputParameterSchema(`
+					{
+					    "title": "Tiered Premium Input Schema",
+					    "type": "object",
+					    "properties": {
+					      "seats": {
+						"type": "integer",
+						"minimum": 1
+					      }
+					    },
+					    "required": ["seats"]
+					}
+					`),
+				},
+				{
+					PlanId: "Enterprise",
+				},
+			},
+		},
+
+		{
+			// A service whose entitlements are provisioned asynchronously.
+			ServiceId: "Async",
+			Plans: []inmemory.PlanDefinition{
+				{
+					PlanId:            "AsyncPlan1",
+					AsyncProvisioning: true,
+				},
+			},
+		},
+
+		{
+			// A service that attaches static and templated labels to its entitlements.
+			ServiceId: "Labeled",
+			Plans: []inmemory.PlanDefinition{
+				{
+					PlanId: "LabeledPlan1",
+					Labels: map[string]string{
+						"tier":   "gold",
+						"origin": "{{.serviceId}}/{{.planId}}",
+						"region": "{{.parameters.region}}",
+					},
+					InputParameterSchema: createInputParameterSchema(`
+					{
+					    "title": "Labeled Input Schema",
+					    "type": "object",
+					    "properties": {
+					      "region": {
+						"type": "string"
+					      }
+					    },
+					    "required": ["region"]
+					}
+					`),
+				},
+			},
+		},
+
+		{
+			// A service with a dashboard url, which is overridden by one of its plans.
+			ServiceId:    "Dashboard",
+			DashboardUrl: "https://dashboard.example.com/{{.serviceId}}/{{.entitlementId}}?account={{.accountId}}",
+			Plans: []inmemory.PlanDefinition{
+				{
+					PlanId: "DashboardPlan1",
+				},
+				{
+					PlanId:       "DashboardPlan2",
+					DashboardUrl: "https://{{.parameters.host}}.example.com/{{.planId}}/{{.entitlementId | urlquery}}",
+					InputParameterSchema: createInputParameterSchema(`
+					{
+					    "title": "Dashboard Input Schema",
+					    "type": "object",
+					    "properties": {
+					      "host": {
+						"type": "string"
+					      }
+					    },
+					    "required": ["host"]
+					}
+					`),
+				},
+			},
+		},
 	},
 }
 
@@ -503,4 +601,791 @@ var Tests []ConformanceTest = []ConformanceTest{
 			},
 		},
 	},
+
+	{
+		Name:     "lifecycleCancelReactivateDelete",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Simple",
+					"planId": "SimplePlan1"
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "2",
+					"eventType": "ENTITLEMENT_CANCELLED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Simple",
+						PlanId:    "SimplePlan1",
+						State:     inmemory.CANCELLED,
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "3",
+					"eventType": "ENTITLEMENT_REACTIVATED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			// A redelivered reactivation is accepted, without changing the entitlement.
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "3",
+					"eventType": "ENTITLEMENT_REACTIVATED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Simple",
+						PlanId:    "SimplePlan1",
+						State:     inmemory.ACTIVE,
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "4",
+					"eventType": "ENTITLEMENT_DELETED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Simple",
+						PlanId:    "SimplePlan1",
+						State:     inmemory.DELETED,
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:     "lifecycleUnknownEntitlement",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CANCELLED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 422,
+				ExpectedResponse: &model.EntitlementEventResponse{
+					EventId: "1",
+					Reason: &model.RejectionReason{
+						Code:    model.REJECTIONREASON_ENTITLEMENTNOTFOUND,
+						Message: "The entitlement does not exist.",
+					},
+				},
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{},
+			},
+		},
+	},
+
+	{
+		Name:     "lifecycleIllegalTransitions",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Simple",
+					"planId": "SimplePlan1"
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "2",
+					"eventType": "ENTITLEMENT_REACTIVATED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 422,
+				ExpectedResponse: &model.EntitlementEventResponse{
+					EventId: "2",
+					Reason: &model.RejectionReason{
+						Code:    model.REJECTIONREASON_ILLEGALTRANSITION,
+						Message: "The entitlement cannot be reactivated while it is ACTIVE.",
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "3",
+					"eventType": "ENTITLEMENT_DELETED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "5",
+					"eventType": "ENTITLEMENT_DELETED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 422,
+				ExpectedResponse: &model.EntitlementEventResponse{
+					EventId: "5",
+					Reason: &model.RejectionReason{
+						Code:    model.REJECTIONREASON_ILLEGALTRANSITION,
+						Message: "The entitlement cannot be deleted while it is DELETED.",
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "4",
+					"eventType": "ENTITLEMENT_UPDATED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 422,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Simple",
+						PlanId:    "SimplePlan1",
+						State:     inmemory.DELETED,
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:     "parameterizedUpdate",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Parameterized",
+					"planId": "ParameterizedPlan1",
+					"parameters": {
+						"parameter2": 42
+					}
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "2",
+					"eventType": "ENTITLEMENT_UPDATED",
+					"entitlementId": "E1",
+					"parameters": {
+						"parameter2": -1
+					}
+				}
+				`,
+				ExpectedCode: 400,
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "3",
+					"eventType": "ENTITLEMENT_UPDATED",
+					"entitlementId": "E1",
+					"parameters": {
+						"parameter2": 43
+					}
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Parameterized",
+						PlanId:    "ParameterizedPlan1",
+						State:     inmemory.ACTIVE,
+						Parameters: map[string]interface{}{
+							"parameter2": 43.,
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:     "tieredPlanChange",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Tiered",
+					"planId": "Basic"
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "2",
+					"eventType": "ENTITLEMENT_UPDATED",
+					"entitlementId": "E1",
+					"planId": "Enterprise"
+				}
+				`,
+				ExpectedCode: 422,
+				ExpectedResponse: &model.EntitlementEventResponse{
+					EventId: "2",
+					Reason: &model.RejectionReason{
+						Code:    model.REJECTIONREASON_PLANCHANGENOTALLOWED,
+						Message: "The entitlement cannot be changed from plan 'Basic' to plan 'Enterprise'.",
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "3",
+					"eventType": "ENTITLEMENT_UPDATED",
+					"entitlementId": "E1",
+					"planId": "Premium"
+				}
+				`,
+				ExpectedCode: 400,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Tiered",
+						PlanId:    "Basic",
+						State:     inmemory.ACTIVE,
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "4",
+					"eventType": "ENTITLEMENT_UPDATED",
+					"entitlementId": "E1",
+					"planId": "Premium",
+					"parameters": {
+						"seats": 10
+					}
+				}
+				`,
+				ExpectedCode: 200,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Tiered",
+						PlanId:    "Premium",
+						State:     inmemory.ACTIVE,
+						Parameters: map[string]interface{}{
+							"seats": 10.,
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:     "asyncAccepted",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Async",
+					"planId": "AsyncPlan1"
+				}
+				`,
+				ExpectedCode: 202,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Async",
+						PlanId:    "AsyncPlan1",
+						State:     inmemory.PENDING,
+					},
+				},
+			},
+			CompletePendingEvent{
+				EventId:      "1",
+				Status:       "ASYNC",
+				ExpectedCode: 400,
+			},
+			CompletePendingEvent{
+				EventId:      "1",
+				Status:       "ACCEPTED",
+				ExpectedCode: 200,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Async",
+						PlanId:    "AsyncPlan1",
+						State:     inmemory.ACTIVE,
+					},
+				},
+			},
+			ExpectNotifications{
+				Notifications: []async.Notification{
+					{
+						EntitlementEventResponse: model.EntitlementEventResponse{
+							EventId: "1",
+						},
+						EntitlementId: "E1",
+						Status:        "ACCEPTED",
+					},
+				},
+			},
+			CompletePendingEvent{
+				EventId:      "1",
+				Status:       "ACCEPTED",
+				ExpectedCode: 404,
+			},
+		},
+	},
+
+	{
+		Name:     "asyncRejected",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Async",
+					"planId": "AsyncPlan1"
+				}
+				`,
+				ExpectedCode: 202,
+			},
+			CompletePendingEvent{
+				EventId:      "1",
+				Status:       "REJECTED",
+				ExpectedCode: 200,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Async",
+						PlanId:    "AsyncPlan1",
+						State:     inmemory.DELETED,
+					},
+				},
+			},
+			ExpectNotifications{
+				Notifications: []async.Notification{
+					{
+						EntitlementEventResponse: model.EntitlementEventResponse{
+							EventId: "1",
+							Reason: &model.RejectionReason{
+								Code:    model.REJECTIONREASON_PROVISIONINGFAILED,
+								Message: "The entitlement could not be provisioned.",
+							},
+						},
+						EntitlementId: "E1",
+						Status:        "REJECTED",
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "2",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E2",
+					"serviceId": "Async",
+					"planId": "AsyncPlan1"
+				}
+				`,
+				ExpectedCode: 202,
+			},
+			CompletePendingEvent{
+				EventId: "2",
+				Status:  "REJECTED",
+				Reason: &model.RejectionReason{
+					Code:    "OUT_OF_CAPACITY",
+					Message: "The region is out of capacity.",
+				},
+				ExpectedCode: 200,
+			},
+			ExpectNotifications{
+				Notifications: []async.Notification{
+					{
+						EntitlementEventResponse: model.EntitlementEventResponse{
+							EventId: "1",
+							Reason: &model.RejectionReason{
+								Code:    model.REJECTIONREASON_PROVISIONINGFAILED,
+								Message: "The entitlement could not be provisioned.",
+							},
+						},
+						EntitlementId: "E1",
+						Status:        "REJECTED",
+					},
+					{
+						EntitlementEventResponse: model.EntitlementEventResponse{
+							EventId: "2",
+							Reason: &model.RejectionReason{
+								Code:    "OUT_OF_CAPACITY",
+								Message: "The region is out of capacity.",
+							},
+						},
+						EntitlementId: "E2",
+						Status:        "REJECTED",
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:     "idempotentReplay",
+		Metadata: metadata,
+		Actions: []Action{
+			// The redelivered creation is answered with the original response, byte for byte, even though the
+			// entitlement has been deleted since.
+			ReplayEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Simple",
+					"planId": "SimplePlan1"
+				}
+				`,
+				Redelivery: `
+				{
+					"eventType": "ENTITLEMENT_CREATED",
+					"eventId": "1",
+					"serviceId": "Simple",
+					"planId": "SimplePlan1",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 200,
+				Between: []Action{
+					PostEntitlementEvent{
+						Request: `
+						{
+							"eventId": "2",
+							"eventType": "ENTITLEMENT_DELETED",
+							"entitlementId": "E1"
+						}
+						`,
+						ExpectedCode: 200,
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E2",
+					"serviceId": "Simple",
+					"planId": "SimplePlan1"
+				}
+				`,
+				ExpectedCode: 409,
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Simple",
+						PlanId:    "SimplePlan1",
+						State:     inmemory.DELETED,
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:     "labeledSuccess",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Labeled",
+					"planId": "LabeledPlan1",
+					"parameters": {
+						"region": "us-east1"
+					}
+				}
+				`,
+				ExpectedCode: 200,
+				ExpectedResponse: &model.EntitlementEventResponse{
+					EventId: "1",
+					Labels: map[string]string{
+						"tier":   "gold",
+						"origin": "Labeled/LabeledPlan1",
+						"region": "us-east1",
+					},
+				},
+			},
+			ExpectEntitlements{
+				Entitlements: []inmemory.EntitlementInfo{
+					{
+						Id:        "E1",
+						ServiceId: "Labeled",
+						PlanId:    "LabeledPlan1",
+						State:     inmemory.ACTIVE,
+						Parameters: map[string]interface{}{
+							"region": "us-east1",
+						},
+						Labels: map[string]string{
+							"tier":   "gold",
+							"origin": "Labeled/LabeledPlan1",
+							"region": "us-east1",
+						},
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "2",
+					"eventType": "ENTITLEMENT_UPDATED",
+					"entitlementId": "E1",
+					"parameters": {
+						"region": "europe-west1"
+					}
+				}
+				`,
+				ExpectedCode: 200,
+				ExpectedResponse: &model.EntitlementEventResponse{
+					EventId: "2",
+					Labels: map[string]string{
+						"tier":   "gold",
+						"origin": "Labeled/LabeledPlan1",
+						"region": "europe-west1",
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:     "dashboardUrl",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"accountId": "A1",
+					"serviceId": "Dashboard",
+					"planId": "DashboardPlan1"
+				}
+				`,
+				ExpectedCode: 200,
+				ExpectedResponse: &model.EntitlementEventResponse{
+					EventId:                 "1",
+					EntitlementDashboardUrl: "https://dashboard.example.com/Dashboard/E1?account=A1",
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "2",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E 2",
+					"accountId": "A1",
+					"serviceId": "Dashboard",
+					"planId": "DashboardPlan2",
+					"parameters": {
+						"host": "console"
+					}
+				}
+				`,
+				ExpectedCode: 200,
+				ExpectedResponse: &model.EntitlementEventResponse{
+					EventId:                 "2",
+					EntitlementDashboardUrl: "https://console.example.com/DashboardPlan2/E+2",
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "3",
+					"eventType": "ENTITLEMENT_CANCELLED",
+					"entitlementId": "E1"
+				}
+				`,
+				ExpectedCode: 200,
+				ExpectedResponse: &model.EntitlementEventResponse{
+					EventId:                 "3",
+					EntitlementDashboardUrl: "https://dashboard.example.com/Dashboard/E1?account=A1",
+				},
+			},
+		},
+	},
+
+	{
+		Name:     "emptyRequestFieldErrors",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+				}`,
+				ExpectedCode: 400,
+				ExpectedError: &model.ErrorDetail{
+					Code:    model.ERRORCODE_INVALIDREQUEST,
+					Message: "The entitlement event is not valid.",
+					FieldErrors: []model.FieldError{
+						{
+							Field:   "/eventId",
+							Message: "Field 'eventId' does not have a valid value: ''.",
+						},
+						{
+							Field:   "/entitlementId",
+							Message: "Field 'entitlementId' does not have a valid value: ''.",
+						},
+						{
+							Field:   "/eventType",
+							Message: "Field 'eventType' does not have a valid value: ''.",
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:     "parameterizedFieldErrors",
+		Metadata: metadata,
+		Actions: []Action{
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "1",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Parameterized",
+					"planId": "ParameterizedPlan1",
+					"parameters": {
+						"parameter1": 42
+					}
+				}
+				`,
+				ExpectedCode: 400,
+				ExpectedError: &model.ErrorDetail{
+					Code:    model.ERRORCODE_INVALIDREQUEST,
+					Message: "Parameters are not valid.",
+					FieldErrors: []model.FieldError{
+						{
+							Field:   "/parameters/parameter2",
+							Message: "parameter2 is required",
+						},
+						{
+							Field:   "/parameters/parameter1",
+							Message: "Invalid type. Expected: string, given: integer",
+						},
+					},
+				},
+			},
+			PostEntitlementEvent{
+				Request: `
+				{
+					"eventId": "2",
+					"eventType": "ENTITLEMENT_CREATED",
+					"entitlementId": "E1",
+					"serviceId": "Simple",
+					"planId": "WorldDomination"
+				}
+				`,
+				ExpectedCode: 400,
+				ExpectedError: &model.ErrorDetail{
+					Code:    model.ERRORCODE_INVALIDREQUEST,
+					Message: "Plan not found: 'WorldDomination'.",
+					FieldErrors: []model.FieldError{
+						{
+							Field:   "/planId",
+							Message: "Plan not found: 'WorldDomination'.",
+						},
+					},
+				},
+			},
+		},
+	},
 }
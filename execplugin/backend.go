@@ -0,0 +1,319 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package execplugin contains a backend that handles entitlement events by running external commands (e.g. the
+// shell scripts that provision the entitlements).
+//
+// The command receives the event as JSON on its stdin, and the basic fields of the event as environment variables
+// (PROCUREMENT_EVENT_ID, PROCUREMENT_EVENT_TYPE, PROCUREMENT_ENTITLEMENT_ID, PROCUREMENT_SERVICE_ID,
+// PROCUREMENT_PLAN_ID and PROCUREMENT_ACCOUNT_ID). It replies by writing a JSON response to its stdout, e.g.:
+//
+//	{"status": "ACCEPTED", "entitlementDashboardUrl": "https://..."}
+//
+// The status is one of ACCEPTED, ASYNC and REJECTED, and defaults to ACCEPTED. An empty stdout is also accepted.
+// Exiting with EXITCODE_REJECTED rejects the event, with the reason from stdout, if any. Any other non-zero exit
+// code, a timeout, or an unparseable stdout is an internal error. Everything that the command writes to its stderr is
+// logged.
+package execplugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"procurementlistenerservice/model"
+	"procurementlistenerservice/owners"
+	"strings"
+	"time"
+)
+
+const (
+	// DEFAULT_TIMEOUT is the default time that the commands are given to complete.
+	DEFAULT_TIMEOUT time.Duration = 30 * time.Second
+
+	// KILL_WAIT_DELAY is the time that a command that timed out is given to close its output, once it is killed. It
+	// relies on exec.Cmd.WaitDelay, which requires Go 1.20.
+	KILL_WAIT_DELAY time.Duration = 100 * time.Millisecond
+
+	// EXITCODE_REJECTED is the exit code that the commands use to reject an event.
+	EXITCODE_REJECTED int = 3
+)
+
+// Backend is a PartnerBackendService that runs the first matching command of its command table for each event.
+//
+// Only ENTITLEMENT_CREATED events are guaranteed to carry the service and plan ids, so the backend records them once
+// a command has accepted the creation of an entitlement, and matches the subsequent events of the entitlement with
+// them. An accepted plan change updates the recorded plan, and an accepted deletion or a rejected asynchronous creation
+// removes the record.
+type Backend struct {
+	config Config
+	owners owners.Store
+}
+
+// Option is a configuration option for the backend.
+type Option func(*Backend) error
+
+// WithOwnerStore configures the store that records the service and plan of the entitlements. By default, the records
+// are kept in memory only, and are lost on restart.
+func WithOwnerStore(store owners.Store) Option {
+	return func(b *Backend) error {
+		b.owners = store
+		return nil
+	}
+}
+
+type entitlementKey struct {
+	serviceId string
+	planId    string
+}
+
+// commandResponse is the response that the commands write to their stdout.
+type commandResponse struct {
+	model.EntitlementEventResponse
+	Status string `json:"status"`
+}
+
+var _ model.PartnerBackendService = &Backend{}
+var _ model.ContextPartnerBackendService = &Backend{}
+var _ model.AsyncPartnerBackendService = &Backend{}
+var _ owners.Resolver = &Backend{}
+
+// CreateBackend creates a new Backend with the given command table.
+func CreateBackend(config Config, options ...Option) (*Backend, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = Duration(DEFAULT_TIMEOUT)
+	}
+
+	b := &Backend{
+		config: config,
+		owners: owners.CreateMemoryStore(),
+	}
+	for _, option := range options {
+		err := option(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *Backend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return b.OnEntitlementEventContext(context.Background(), e)
+}
+
+func (b *Backend) OnEntitlementEventContext(
+	ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+
+	key, err := b.entitlementKey(e)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+	command, found := b.command(e, key)
+	if !found {
+		log.Printf("No command for entitlement event: eventId='%s' eventType='%s' serviceId='%s' planId='%s'\n",
+			e.EventId, e.EventType, key.serviceId, key.planId)
+		return owners.Unhandled(e, key.serviceId), nil
+	}
+
+	response, err := b.run(ctx, command, e, key)
+	if err != nil || response.Status == model.RESPONSESTATUS_REJECTED {
+		return response, err
+	}
+
+	err = owners.Update(b.owners, e, "", response.Status)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+	return response, nil
+}
+
+// OnEntitlementEventCompleted updates the owner record of the entitlement with the outcome of an event that a command
+// responded to with ASYNC, e.g. it removes the record of an entitlement whose creation was rejected. No command is
+// run.
+func (b *Backend) OnEntitlementEventCompleted(
+	e model.EntitlementEvent, status model.ResponseStatus) (model.EntitlementEventResponse, error) {
+
+	err := owners.Update(b.owners, e, "", status)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+	return model.EntitlementEventResponse{
+		Status:  status,
+		EventId: e.EventId,
+	}, nil
+}
+
+// entitlementKey returns the service and plan ids that the commands are matched with. They are those of the
+// ENTITLEMENT_CREATED events themselves, and the recorded ones for the other events, so that a plan change is
+// handled by the command of the current plan. Events of entitlements without a record use their own ids.
+func (b *Backend) entitlementKey(e model.EntitlementEvent) (entitlementKey, error) {
+	key := entitlementKey{serviceId: e.ServiceId, planId: e.PlanId}
+	if e.EventType == model.ENTITLEMENT_CREATED {
+		return key, nil
+	}
+
+	record, found, err := b.owners.Get(e.EntitlementId)
+	if err != nil {
+		return entitlementKey{}, fmt.Errorf("Unable to read the owner of entitlement '%s': '%v'.", e.EntitlementId, err)
+	}
+	if found {
+		key = entitlementKey{serviceId: record.ServiceId, planId: record.PlanId}
+	}
+	return key, nil
+}
+
+// EntitlementOwner returns the account of the entitlement with the given id, from its owner record.
+func (b *Backend) EntitlementOwner(entitlementId string) (string, bool, error) {
+	record, found, err := b.owners.Get(entitlementId)
+	return record.AccountId, found, err
+}
+
+func (b *Backend) command(e model.EntitlementEvent, key entitlementKey) (Command, bool) {
+	for _, command := range b.config.Commands {
+		if command.matches(e, key.serviceId, key.planId) {
+			return command, true
+		}
+	}
+	return Command{}, false
+}
+
+// run runs the given command for the given event, and maps its outcome to a response.
+func (b *Backend) run(ctx context.Context, command Command, e model.EntitlementEvent, key entitlementKey) (
+	model.EntitlementEventResponse, error) {
+
+	input, err := json.Marshal(e)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	timeout := time.Duration(command.Timeout)
+	if timeout == 0 {
+		timeout = time.Duration(b.config.Timeout)
+	}
+	commandCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(commandCtx, command.Command[0], command.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = b.environment(command, e, key)
+
+	// The children of a killed command (e.g. of a shell script) can keep its output open, so do not wait for them.
+	cmd.WaitDelay = KILL_WAIT_DELAY
+
+	err = cmd.Run()
+	diagnostics := stderr.String()
+	logStderr(command, e, diagnostics)
+
+	if ctx.Err() != nil {
+		return model.EntitlementEventResponse{}, ctx.Err()
+	}
+	if commandCtx.Err() != nil {
+		return model.EntitlementEventResponse{}, fmt.Errorf("Command '%s' timed out after '%v'.",
+			command.Command[0], timeout)
+	}
+
+	rejected := false
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != EXITCODE_REJECTED {
+			return model.EntitlementEventResponse{}, fmt.Errorf("Command '%s' failed: '%v'.", command.Command[0], err)
+		}
+		rejected = true
+	}
+
+	var output commandResponse
+	if len(bytes.TrimSpace(stdout.Bytes())) != 0 {
+		err = json.Unmarshal(stdout.Bytes(), &output)
+		if err != nil {
+			return model.EntitlementEventResponse{}, fmt.Errorf("Unable to parse the output of command '%s': '%v'.",
+				command.Command[0], err)
+		}
+	}
+
+	response := output.EntitlementEventResponse
+	response.EventId = e.EventId
+	switch {
+	case rejected:
+		response.Status = model.RESPONSESTATUS_REJECTED
+	case output.Status == "":
+		response.Status = model.RESPONSESTATUS_ACCEPTED
+	default:
+		response.Status, err = model.ParseResponseStatus(output.Status)
+		if err != nil || response.Status == model.RESPONSESTATUS_INVALIDREQUEST {
+			return model.EntitlementEventResponse{}, fmt.Errorf("Command '%s' replied with an invalid status: '%s'.",
+				command.Command[0], output.Status)
+		}
+	}
+
+	if response.Status == model.RESPONSESTATUS_REJECTED && response.Reason == nil {
+		message := lastLine(diagnostics)
+		if message == "" {
+			message = fmt.Sprintf("The event was rejected by command '%s'.", command.Command[0])
+		}
+		response.Reason = model.NewRejection(model.REJECTIONREASON_UNSPECIFIED, "%s", message)
+	}
+
+	return response, nil
+}
+
+// environment returns the environment of the given command: the environment of this process, followed by the global
+// and per-command variables, and the variables that describe the event. The service and plan ids default to the
+// recorded ones, if the event does not carry them.
+func (b *Backend) environment(command Command, e model.EntitlementEvent, key entitlementKey) []string {
+	if e.ServiceId != "" {
+		key.serviceId = e.ServiceId
+	}
+	if e.PlanId != "" {
+		key.planId = e.PlanId
+	}
+
+	env := os.Environ()
+	for name, value := range b.config.Env {
+		env = append(env, name+"="+value)
+	}
+	for name, value := range command.Env {
+		env = append(env, name+"="+value)
+	}
+	return append(env,
+		"PROCUREMENT_EVENT_ID="+e.EventId,
+		"PROCUREMENT_EVENT_TYPE="+string(e.EventType),
+		"PROCUREMENT_ENTITLEMENT_ID="+e.EntitlementId,
+		"PROCUREMENT_SERVICE_ID="+key.serviceId,
+		"PROCUREMENT_PLAN_ID="+key.planId,
+		"PROCUREMENT_ACCOUNT_ID="+e.AccountId)
+}
+
+func logStderr(command Command, e model.EntitlementEvent, stderr string) {
+	scanner := bufio.NewScanner(strings.NewReader(stderr))
+	for scanner.Scan() {
+		log.Printf("[%s eventId='%s'] %s\n", command.Command[0], e.EventId, scanner.Text())
+	}
+}
+
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,230 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execplugin
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"procurementlistenerservice/model"
+	"procurementlistenerservice/owners"
+	"strings"
+	"testing"
+	"time"
+)
+
+func shell(script string) []string {
+	return []string{"/bin/sh", "-c", script}
+}
+
+func createEvent(eventId string) model.EntitlementEvent {
+	return model.EntitlementEvent{
+		EventId:       eventId,
+		EventType:     model.ENTITLEMENT_CREATED,
+		EntitlementId: "E1",
+		ServiceId:     "storage",
+		PlanId:        "basic",
+		AccountId:     "A1",
+	}
+}
+
+func TestAccepted(t *testing.T) {
+	b, err := CreateBackend(Config{
+		Env: map[string]string{"REGION": "us"},
+		Commands: []Command{
+			{ServiceId: "storage", EventType: model.ENTITLEMENT_CREATED, Env: map[string]string{"TIER": "gold"},
+				Command: shell(`grep -q '"eventId":"1"' || exit 1; ` +
+					`echo "{\"entitlementDashboardUrl\": \"https://$REGION.example.com/$TIER/$PROCUREMENT_ENTITLEMENT_ID\"}"`)},
+			{ServiceId: "storage", Command: shell(`echo '{"status": "ASYNC"}'`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := b.OnEntitlementEvent(createEvent("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != model.RESPONSESTATUS_ACCEPTED || response.EventId != "1" ||
+		response.EntitlementDashboardUrl != "https://us.example.com/gold/E1" {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+
+	// The subsequent events of the entitlement are matched by the service of the entitlement.
+	response, err = b.OnEntitlementEvent(model.EntitlementEvent{
+		EventId: "2", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != model.RESPONSESTATUS_ASYNC {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	b, _ := CreateBackend(Config{Commands: []Command{
+		{ServiceId: "storage", Plan: "basic", Command: shell(`echo "Quota exceeded." >&2; exit 3`)},
+		{ServiceId: "storage", Command: shell(`echo '{"reason": {"code": "ILLEGAL_TRANSITION", "message": "No."}}'; exit 3`)},
+	}})
+
+	response, err := b.OnEntitlementEvent(createEvent("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != model.RESPONSESTATUS_REJECTED || response.Reason == nil ||
+		response.Reason.Code != model.REJECTIONREASON_UNSPECIFIED || response.Reason.Message != "Quota exceeded." {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+
+	e := createEvent("2")
+	e.PlanId = "premium"
+	response, err = b.OnEntitlementEvent(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != model.RESPONSESTATUS_REJECTED || response.Reason == nil ||
+		response.Reason.Code != model.REJECTIONREASON_ILLEGALTRANSITION {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+
+	e.ServiceId = "compute"
+	response, err = b.OnEntitlementEvent(e)
+	if err != nil || response.Status != model.RESPONSESTATUS_REJECTED {
+		t.Errorf("Expected events without a command to be rejected: %+v '%v'", response, err)
+	}
+
+	// A rejection without a reason or diagnostics gets a default message.
+	b, _ = CreateBackend(Config{Commands: []Command{{Command: shell(`exit 3`)}}})
+	response, err = b.OnEntitlementEvent(createEvent("3"))
+	if err != nil || response.Reason == nil || response.Reason.Message != "The event was rejected by command '/bin/sh'." {
+		t.Errorf("Unexpected response: %+v '%v'", response, err)
+	}
+}
+
+func TestOwnerRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "owners.json")
+
+	createBackend := func() *Backend {
+		store, err := owners.OpenFileStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := CreateBackend(Config{Commands: []Command{
+			{ServiceId: "storage", Plan: "basic", Command: shell(`echo "{\"status\": \"ACCEPTED\", ` +
+				`\"entitlementDashboardUrl\": \"$PROCUREMENT_PLAN_ID\"}"`)},
+			{Command: shell(`exit 3`)},
+		}}, WithOwnerStore(store))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	expect := func(b *Backend, e model.EntitlementEvent, status model.ResponseStatus, planId string) {
+		response, err := b.OnEntitlementEvent(e)
+		if err != nil || response.Status != status || response.EntitlementDashboardUrl != planId {
+			t.Errorf("Unexpected response for '%s': %+v '%v'", e.EventId, response, err)
+		}
+	}
+
+	expect(createBackend(), createEvent("1"), model.RESPONSESTATUS_ACCEPTED, "basic")
+
+	// After a restart, the plan change is matched by the recorded plan, and the command sees the new plan. The
+	// account of the entitlement is known as well.
+	b := createBackend()
+	if accountId, found, err := b.EntitlementOwner("E1"); err != nil || !found || accountId != "A1" {
+		t.Errorf("Unexpected owner: accountId='%s' found='%v' err='%v'", accountId, found, err)
+	}
+	expect(b, model.EntitlementEvent{EventId: "2", EventType: model.ENTITLEMENT_UPDATED, EntitlementId: "E1",
+		ServiceId: "storage", PlanId: "premium"}, model.RESPONSESTATUS_ACCEPTED, "premium")
+
+	// Once the plan change is accepted, the commands of the new plan apply.
+	expect(b, model.EntitlementEvent{EventId: "3", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E1"},
+		model.RESPONSESTATUS_REJECTED, "")
+}
+
+func TestRejectedAsyncCreation(t *testing.T) {
+	b, err := CreateBackend(Config{Commands: []Command{
+		{Command: shell(`echo '{"status": "ASYNC"}'`)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := createEvent("1")
+	if response, err := b.OnEntitlementEvent(e); err != nil || response.Status != model.RESPONSESTATUS_ASYNC {
+		t.Fatalf("Unexpected response: %+v '%v'", response, err)
+	}
+	if _, found, _ := b.EntitlementOwner("E1"); !found {
+		t.Error("The pending creation of 'E1' was not recorded.")
+	}
+
+	// Once the creation is rejected, the entitlement no longer exists.
+	response, err := b.OnEntitlementEventCompleted(e, model.RESPONSESTATUS_REJECTED)
+	if err != nil || response.Status != model.RESPONSESTATUS_REJECTED {
+		t.Errorf("Unexpected completion: %+v '%v'", response, err)
+	}
+	if _, found, _ := b.EntitlementOwner("E1"); found {
+		t.Error("The owner record of the rejected creation of 'E1' was not removed.")
+	}
+}
+
+func TestFailures(t *testing.T) {
+	tests := map[string]Command{
+		"exit code":      {Command: shell(`exit 1`)},
+		"invalid output": {Command: shell(`echo 'not json'`)},
+		"invalid status": {Command: shell(`echo '{"status": "MAYBE"}'`)},
+		"timeout":        {Command: shell(`sleep 5`), Timeout: Duration(50 * time.Millisecond)},
+		"missing":        {Command: []string{"/nonexistent/command"}},
+	}
+
+	for name, command := range tests {
+		b, _ := CreateBackend(Config{Commands: []Command{command}})
+		_, err := b.OnEntitlementEvent(createEvent("1"))
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	b, _ := CreateBackend(Config{Commands: []Command{{Command: shell(`sleep 5`)}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := b.OnEntitlementEventContext(ctx, createEvent("1"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	configs := []Config{
+		{Commands: []Command{{}}},
+		{Commands: []Command{{Plan: "[", Command: []string{"true"}}}},
+	}
+	for _, config := range configs {
+		if _, err := CreateBackend(config); err == nil || !strings.Contains(err.Error(), "Command #0") {
+			t.Errorf("Expected an error for %+v, got '%v'", config, err)
+		}
+	}
+}
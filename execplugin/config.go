@@ -0,0 +1,134 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"procurementlistenerservice/model"
+	"time"
+)
+
+// Duration is a time.Duration that is read from JSON as a string (e.g. "30s").
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return fmt.Errorf("Duration must be a string (e.g. \"30s\"): '%s'.", string(data))
+	}
+
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("Invalid duration: '%s'.", text)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Command is a command that handles the events of a service, and optionally of a subset of its plans and event types.
+type Command struct {
+	// ServiceId is the id of the service that the command applies to. An empty value or "*" matches all services.
+	ServiceId string `json:"serviceId"`
+
+	// Plan is a glob pattern (e.g. "enterprise-*") that the plan id needs to match. An empty value matches all plans.
+	Plan string `json:"plan"`
+
+	// EventType is the type of the events that the command applies to. An empty value matches all event types.
+	EventType model.EntitlementEventType `json:"eventType"`
+
+	// Command is the path of the executable, followed by its arguments.
+	Command []string `json:"command"`
+
+	// Env are the environment variables that are set for the command, in addition to the global ones.
+	Env map[string]string `json:"env"`
+
+	// Timeout is the time that the command is given to complete. It defaults to the global timeout.
+	Timeout Duration `json:"timeout"`
+}
+
+// Config is the command table, as read from the commands file.
+type Config struct {
+	// Commands are evaluated in order, and the first matching command handles the event.
+	Commands []Command `json:"commands"`
+
+	// Env are the environment variables that are set for all commands.
+	Env map[string]string `json:"env"`
+
+	// Timeout is the default time that the commands are given to complete.
+	Timeout Duration `json:"timeout"`
+}
+
+// Validate checks that the command table is well formed.
+func (c Config) Validate() error {
+	for i, command := range c.Commands {
+		if len(command.Command) == 0 || command.Command[0] == "" {
+			return fmt.Errorf("Command #%d does not specify an executable.", i)
+		}
+		if _, err := path.Match(command.Plan, ""); err != nil {
+			return fmt.Errorf("Command #%d has an invalid plan pattern: '%s'.", i, command.Plan)
+		}
+		if command.Timeout < 0 {
+			return fmt.Errorf("Command #%d has a negative timeout: '%v'.", i, time.Duration(command.Timeout))
+		}
+	}
+
+	if c.Timeout < 0 {
+		return fmt.Errorf("Timeout must not be negative: '%v'.", time.Duration(c.Timeout))
+	}
+	return nil
+}
+
+// ReadConfigFile opens the file with the given path, reads contents as JSON, and returns the parsed command table.
+func ReadConfigFile(path string) (Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("Unable to read commands file: '%s'.\n", path)
+	}
+
+	var config Config
+	err = json.Unmarshal(contents, &config)
+	if err != nil {
+		return Config{}, fmt.Errorf("Unable to parse commands file: '%v'.\n", err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+func (c Command) matches(e model.EntitlementEvent, serviceId string, planId string) bool {
+	if c.ServiceId != "" && c.ServiceId != "*" && c.ServiceId != serviceId {
+		return false
+	}
+	if c.EventType != "" && c.EventType != e.EventType {
+		return false
+	}
+	if c.Plan == "" {
+		return true
+	}
+	matched, _ := path.Match(c.Plan, planId)
+	return matched
+}
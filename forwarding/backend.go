@@ -0,0 +1,261 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package forwarding contains a backend that forwards entitlement events to an upstream provisioning service over
+// HTTP, so that this service can run as an edge gateway in front of it.
+package forwarding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"procurementlistenerservice/model"
+	"time"
+)
+
+const (
+	// DEFAULT_TIMEOUT is the default timeout of a single call to the upstream.
+	DEFAULT_TIMEOUT time.Duration = 10 * time.Second
+
+	// DEFAULT_MAX_RETRIES is the default number of times a failed call is retried.
+	DEFAULT_MAX_RETRIES int = 3
+
+	// DEFAULT_INITIAL_BACKOFF is the default delay before the first retry. It doubles with every retry.
+	DEFAULT_INITIAL_BACKOFF time.Duration = 100 * time.Millisecond
+
+	// DEFAULT_MAX_BACKOFF is the default upper bound of the delay between retries.
+	DEFAULT_MAX_BACKOFF time.Duration = 5 * time.Second
+
+	// DEFAULT_FAILURE_THRESHOLD is the default number of consecutive failures that opens the circuit breaker.
+	DEFAULT_FAILURE_THRESHOLD int = 5
+
+	// DEFAULT_OPEN_DURATION is the default time that the circuit breaker stays open.
+	DEFAULT_OPEN_DURATION time.Duration = 30 * time.Second
+
+	// MAX_REPLY_SIZE is the maximum size of an upstream reply body, in bytes.
+	MAX_REPLY_SIZE int64 = 1 << 20
+)
+
+// Backend is a PartnerBackendService that POSTs each event, as JSON, to an upstream url and maps the upstream's reply
+// back into an EntitlementEventResponse:
+//
+//   - 200 is accepted, and 202 is async. The body is the EntitlementEventResponse.
+//   - 422 is rejected. The body is the EntitlementEventResponse, with the rejection reason.
+//   - 400 is an invalid event. The body is a model.ErrorResponse, whose field errors are passed on.
+//   - 429 and 5xx are retried with exponential backoff. Other codes are errors.
+type Backend struct {
+	url            string
+	client         *http.Client
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	breaker        *circuitBreaker
+}
+
+var _ model.PartnerBackendService = &Backend{}
+var _ model.ContextPartnerBackendService = &Backend{}
+
+// Option is a configuration option for the Backend.
+type Option func(*Backend) error
+
+// WithTimeout configures the timeout of a single call to the upstream.
+func WithTimeout(timeout time.Duration) Option {
+	return func(b *Backend) error {
+		b.client.Timeout = timeout
+		return nil
+	}
+}
+
+// WithRetries configures the number of retries of a failed call, and the backoff between them.
+func WithRetries(maxRetries int, initialBackoff time.Duration, maxBackoff time.Duration) Option {
+	return func(b *Backend) error {
+		if maxRetries < 0 || initialBackoff < 0 || maxBackoff < initialBackoff {
+			return fmt.Errorf("Invalid retry configuration: maxRetries='%d' initialBackoff='%v' maxBackoff='%v'.",
+				maxRetries, initialBackoff, maxBackoff)
+		}
+		b.maxRetries = maxRetries
+		b.initialBackoff = initialBackoff
+		b.maxBackoff = maxBackoff
+		return nil
+	}
+}
+
+// WithCircuitBreaker configures the number of consecutive failures that stop the calls to the upstream, and the time
+// for which they are stopped. A zero threshold disables the circuit breaker.
+func WithCircuitBreaker(threshold int, openDuration time.Duration) Option {
+	return func(b *Backend) error {
+		b.breaker.threshold = threshold
+		b.breaker.openDuration = openDuration
+		return nil
+	}
+}
+
+// CreateBackend creates a new Backend that forwards events to the given upstream url.
+func CreateBackend(upstreamUrl string, options ...Option) (*Backend, error) {
+	u, err := url.Parse(upstreamUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid upstream url: '%s'.", upstreamUrl)
+	}
+
+	b := &Backend{
+		url:            upstreamUrl,
+		client:         &http.Client{Timeout: DEFAULT_TIMEOUT},
+		maxRetries:     DEFAULT_MAX_RETRIES,
+		initialBackoff: DEFAULT_INITIAL_BACKOFF,
+		maxBackoff:     DEFAULT_MAX_BACKOFF,
+		breaker: &circuitBreaker{
+			threshold:    DEFAULT_FAILURE_THRESHOLD,
+			openDuration: DEFAULT_OPEN_DURATION,
+		},
+	}
+
+	for _, option := range options {
+		err := option(b)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to configure forwarding backend: '%v'.", err)
+		}
+	}
+
+	return b, nil
+}
+
+func (b *Backend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return b.OnEntitlementEventContext(context.Background(), e)
+}
+
+func (b *Backend) OnEntitlementEventContext(
+	ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	backoff := b.initialBackoff
+	for attempt := 0; ; attempt++ {
+		if !b.breaker.allow() {
+			return model.EntitlementEventResponse{}, ErrCircuitOpen
+		}
+
+		response, retryable, err := b.forward(ctx, body)
+		b.breaker.record(outcome(ctx, err))
+		if !retryable || attempt >= b.maxRetries {
+			return response, err
+		}
+
+		log.Printf("Forwarding event '%s' failed, retrying in '%v': '%v'\n", e.EventId, backoff, err)
+		select {
+		case <-ctx.Done():
+			return model.EntitlementEventResponse{}, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > b.maxBackoff {
+			backoff = b.maxBackoff
+		}
+	}
+}
+
+// forward makes a single call to the upstream, and maps its reply. It also reports whether a failure is transient,
+// and the call can be retried.
+func (b *Backend) forward(ctx context.Context, body []byte) (model.EntitlementEventResponse, bool, error) {
+	request, err := http.NewRequest("POST", b.url, bytes.NewReader(body))
+	if err != nil {
+		return model.EntitlementEventResponse{}, false, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+
+	reply, err := b.client.Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return model.EntitlementEventResponse{}, false, ctx.Err()
+		}
+		return model.EntitlementEventResponse{}, true, unavailable("Unable to reach upstream: '%v'.", err)
+	}
+	defer reply.Body.Close()
+
+	replyBody, err := ioutil.ReadAll(io.LimitReader(reply.Body, MAX_REPLY_SIZE+1))
+	if err != nil {
+		return model.EntitlementEventResponse{}, true, unavailable("Unable to read upstream reply: '%v'.", err)
+	}
+	if int64(len(replyBody)) > MAX_REPLY_SIZE {
+		return model.EntitlementEventResponse{}, false, fmt.Errorf("Upstream reply exceeds '%d' bytes.",
+			MAX_REPLY_SIZE)
+	}
+
+	switch {
+	case reply.StatusCode == http.StatusOK:
+		return parseResponse(model.RESPONSESTATUS_ACCEPTED, replyBody)
+	case reply.StatusCode == http.StatusAccepted:
+		return parseResponse(model.RESPONSESTATUS_ASYNC, replyBody)
+	case reply.StatusCode == http.StatusUnprocessableEntity:
+		return parseResponse(model.RESPONSESTATUS_REJECTED, replyBody)
+	case reply.StatusCode == http.StatusBadRequest:
+		return model.EntitlementEventResponse{}, false, parseValidationError(replyBody)
+	case reply.StatusCode == http.StatusTooManyRequests || reply.StatusCode >= 500:
+		return model.EntitlementEventResponse{}, true, unavailable("Upstream failed: code='%d'.", reply.StatusCode)
+	}
+
+	return model.EntitlementEventResponse{}, false, fmt.Errorf("Unexpected upstream reply: code='%d'.", reply.StatusCode)
+}
+
+// unavailable returns a model.UnavailableError with the given message, for the transient failures of the upstream, so
+// that the marketplace retries the event later once the retries are exhausted.
+func unavailable(format string, args ...interface{}) error {
+	return &model.UnavailableError{Message: fmt.Sprintf(format, args...)}
+}
+
+// outcome classifies the result of a call for the circuit breaker. Only the calls that the upstream handled count as
+// successes, including those where it refused the event as invalid. Calls that the caller cancelled are abandoned.
+func outcome(ctx context.Context, err error) callOutcome {
+	if _, ok := err.(*model.ValidationError); ok || err == nil {
+		return callSucceeded
+	}
+	if ctx.Err() != nil {
+		return callAbandoned
+	}
+	return callFailed
+}
+
+func parseResponse(status model.ResponseStatus, body []byte) (model.EntitlementEventResponse, bool, error) {
+	var response model.EntitlementEventResponse
+	if len(body) != 0 {
+		err := json.Unmarshal(body, &response)
+		if err != nil {
+			return model.EntitlementEventResponse{}, false, fmt.Errorf("Unable to parse upstream reply: '%v'.", err)
+		}
+	}
+	response.Status = status
+	return response, false, nil
+}
+
+func parseValidationError(body []byte) error {
+	var reply model.ErrorResponse
+	err := json.Unmarshal(body, &reply)
+	if err != nil || reply.Error.Message == "" {
+		return &model.ValidationError{Message: "The upstream refused the event as invalid."}
+	}
+	return &model.ValidationError{
+		Message:     reply.Error.Message,
+		FieldErrors: reply.Error.FieldErrors,
+	}
+}
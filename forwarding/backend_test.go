@@ -0,0 +1,258 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarding
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"procurementlistenerservice/model"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testEvent = model.EntitlementEvent{
+	EventId:       "event1",
+	EventType:     model.ENTITLEMENT_CREATED,
+	EntitlementId: "entitlement1",
+	ServiceId:     "service1",
+	PlanId:        "plan1",
+	AccountId:     "account1",
+	RequestorId:   "requestor1",
+}
+
+func upstream(t *testing.T, handler func(calls int32, w http.ResponseWriter, e model.EntitlementEvent)) (
+	*httptest.Server, *int32) {
+
+	var calls int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e model.EntitlementEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("Unable to decode forwarded event: '%v'", err)
+		}
+		handler(atomic.AddInt32(&calls, 1), w, e)
+	})), &calls
+}
+
+func reply(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func TestReplyMapping(t *testing.T) {
+	rejection := model.NewRejection(model.REJECTIONREASON_ILLEGALTRANSITION, "Not allowed.")
+
+	tests := []struct {
+		name     string
+		code     int
+		body     interface{}
+		expected model.EntitlementEventResponse
+	}{
+		{"accepted", http.StatusOK, model.EntitlementEventResponse{EventId: "event1", EntitlementDashboardUrl: "x"},
+			model.EntitlementEventResponse{Status: model.RESPONSESTATUS_ACCEPTED, EventId: "event1",
+				EntitlementDashboardUrl: "x"}},
+		{"async", http.StatusAccepted, model.EntitlementEventResponse{EventId: "event1"},
+			model.EntitlementEventResponse{Status: model.RESPONSESTATUS_ASYNC, EventId: "event1"}},
+		{"rejected", http.StatusUnprocessableEntity, model.EntitlementEventResponse{EventId: "event1", Reason: rejection},
+			model.EntitlementEventResponse{Status: model.RESPONSESTATUS_REJECTED, EventId: "event1", Reason: rejection}},
+	}
+
+	for _, test := range tests {
+		s, _ := upstream(t, func(calls int32, w http.ResponseWriter, e model.EntitlementEvent) {
+			if e.EventId != testEvent.EventId {
+				t.Errorf("%s: unexpected forwarded event: %+v", test.name, e)
+			}
+			reply(w, test.code, test.body)
+		})
+
+		b, err := CreateBackend(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := b.OnEntitlementEvent(testEvent)
+		s.Close()
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: '%v'", test.name, err)
+		} else if !reflect.DeepEqual(response, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, response)
+		}
+	}
+}
+
+func TestValidationErrorMapping(t *testing.T) {
+	fieldErrors := []model.FieldError{{Field: "/parameters/size", Message: "Required."}}
+	s, _ := upstream(t, func(calls int32, w http.ResponseWriter, e model.EntitlementEvent) {
+		reply(w, http.StatusBadRequest, model.ErrorResponse{Error: model.ErrorDetail{
+			Code: model.ERRORCODE_INVALIDREQUEST, Message: "Invalid.", FieldErrors: fieldErrors}})
+	})
+	defer s.Close()
+
+	b, _ := CreateBackend(s.URL)
+	_, err := b.OnEntitlementEvent(testEvent)
+
+	validationError, ok := err.(*model.ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got '%v'", err)
+	}
+	if !reflect.DeepEqual(validationError.FieldErrors, fieldErrors) {
+		t.Errorf("Expected field errors %+v, got %+v", fieldErrors, validationError.FieldErrors)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	missing := int32(0)
+	failing := int32(0)
+	s, calls := upstream(t, func(calls int32, w http.ResponseWriter, e model.EntitlementEvent) {
+		if atomic.LoadInt32(&missing) != 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if calls < 3 || atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		reply(w, http.StatusOK, model.EntitlementEventResponse{EventId: e.EventId})
+	})
+	defer s.Close()
+
+	b, _ := CreateBackend(s.URL, WithRetries(2, time.Millisecond, time.Millisecond))
+	response, err := b.OnEntitlementEvent(testEvent)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%v'", err)
+	}
+	if response.Status != model.RESPONSESTATUS_ACCEPTED {
+		t.Errorf("Expected ACCEPTED, got %v", response.Status)
+	}
+	if *calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", *calls)
+	}
+
+	// Once the retries are exhausted, the event is failed as retryable.
+	atomic.StoreInt32(&failing, 1)
+	if _, err := b.OnEntitlementEvent(testEvent); err == nil {
+		t.Error("Expected an error for exhausted retries")
+	} else if _, ok := err.(*model.UnavailableError); !ok {
+		t.Errorf("Expected an UnavailableError for exhausted retries, got '%v'", err)
+	}
+
+	// Client errors are not retried.
+	atomic.StoreInt32(&failing, 0)
+	atomic.StoreInt32(&missing, 1)
+	atomic.StoreInt32(calls, 0)
+	if _, err := b.OnEntitlementEvent(testEvent); err == nil {
+		t.Errorf("Expected an error for an unexpected reply")
+	}
+	if *calls != 1 {
+		t.Errorf("Expected 1 call, got %d", *calls)
+	}
+}
+
+func TestOversizedReply(t *testing.T) {
+	s, _ := upstream(t, func(calls int32, w http.ResponseWriter, e model.EntitlementEvent) {
+		reply(w, http.StatusOK, model.EntitlementEventResponse{
+			EventId: e.EventId, EntitlementDashboardUrl: strings.Repeat("x", int(MAX_REPLY_SIZE))})
+	})
+	defer s.Close()
+
+	b, _ := CreateBackend(s.URL)
+	if _, err := b.OnEntitlementEvent(testEvent); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("Expected an error for an oversized reply, got '%v'", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	healthy := int32(0)
+	s, calls := upstream(t, func(calls int32, w http.ResponseWriter, e model.EntitlementEvent) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		reply(w, http.StatusOK, model.EntitlementEventResponse{EventId: e.EventId})
+	})
+	defer s.Close()
+
+	b, _ := CreateBackend(s.URL,
+		WithRetries(0, 0, 0),
+		WithCircuitBreaker(2, 50*time.Millisecond))
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.OnEntitlementEvent(testEvent); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Expected an upstream error, got '%v'", err)
+		}
+	}
+
+	if _, err := b.OnEntitlementEvent(testEvent); err != ErrCircuitOpen {
+		t.Fatalf("Expected the circuit to be open, got '%v'", err)
+	}
+	if *calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", *calls)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(60 * time.Millisecond)
+
+	response, err := b.OnEntitlementEventContext(context.Background(), testEvent)
+	if err != nil || response.Status != model.RESPONSESTATUS_ACCEPTED {
+		t.Fatalf("Expected the trial call to succeed, got %+v '%v'", response, err)
+	}
+	if _, err := b.OnEntitlementEvent(testEvent); err != nil {
+		t.Errorf("Expected the circuit to be closed, got '%v'", err)
+	}
+}
+
+func TestCircuitBreakerOutcomes(t *testing.T) {
+	code := int32(http.StatusNotFound)
+	s, calls := upstream(t, func(calls int32, w http.ResponseWriter, e model.EntitlementEvent) {
+		if atomic.LoadInt32(&code) == http.StatusOK {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&code)))
+	})
+	defer s.Close()
+
+	b, _ := CreateBackend(s.URL,
+		WithRetries(0, 0, 0),
+		WithCircuitBreaker(2, time.Minute))
+
+	// Cancelled calls are neither successes nor failures.
+	atomic.StoreInt32(&code, http.StatusOK)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.OnEntitlementEventContext(ctx, testEvent); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the call to be cancelled, got '%v'", err)
+	}
+
+	// Non-retryable failures count towards opening the circuit.
+	atomic.StoreInt32(&code, http.StatusNotFound)
+	for i := 0; i < 2; i++ {
+		if _, err := b.OnEntitlementEvent(testEvent); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Expected an upstream error, got '%v'", err)
+		}
+	}
+
+	_, err := b.OnEntitlementEvent(testEvent)
+	if _, ok := err.(*model.UnavailableError); !ok || err != ErrCircuitOpen {
+		t.Fatalf("Expected the circuit to be open, got '%v'", err)
+	}
+	if *calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", *calls)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forwarding
+
+import (
+	"procurementlistenerservice/model"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when the upstream has been failing, and calls are not attempted until it cools down. It
+// is a model.UnavailableError, so that the marketplace retries the event later.
+var ErrCircuitOpen error = &model.UnavailableError{Message: "Circuit breaker is open, upstream is unavailable."}
+
+// callOutcome is the outcome of a call to the upstream, as far as the circuit breaker is concerned.
+type callOutcome int
+
+const (
+	// callSucceeded is a call that the upstream handled.
+	callSucceeded callOutcome = iota
+
+	// callFailed is a call that failed because of the upstream, e.g. with a 5xx reply or an unparseable body.
+	callFailed
+
+	// callAbandoned is a call that says nothing about the health of the upstream, e.g. because the caller cancelled
+	// it.
+	callAbandoned
+)
+
+// circuitBreaker stops calls to the upstream after a number of consecutive failures. Once the open duration passes,
+// a single trial call is let through: if it succeeds the breaker closes, otherwise it opens again.
+type circuitBreaker struct {
+	mu           sync.Mutex
+	threshold    int
+	openDuration time.Duration
+	failures     int
+	openUntil    time.Time
+	trial        bool
+}
+
+// allow reports whether a call can be made now.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+
+	// Half-open: let a single trial call through.
+	b.trial = true
+	return true
+}
+
+// record records the outcome of a call. An abandoned call ends a trial without closing or reopening the breaker.
+func (b *circuitBreaker) record(outcome callOutcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	switch outcome {
+	case callSucceeded:
+		b.failures = 0
+		return
+	case callAbandoned:
+		return
+	}
+
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.openDuration)
+	}
+}
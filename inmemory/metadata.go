@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 )
 
 // Metadata is the top-level container of metadata.
@@ -30,6 +31,10 @@ type ServiceDefinition struct {
 	// ServiceId is the id of the service.
 	ServiceId string `json:"serviceId"`
 
+	// DashboardUrl is the template of the url that entitlement owners can use to manage their entitlements. It can
+	// be overridden by individual plans. See template.go for the available placeholders.
+	DashboardUrl string `json:"dashboardUrl"`
+
 	Plans []PlanDefinition `json:"plans"`
 }
 
@@ -38,6 +43,21 @@ type PlanDefinition struct {
 	// PlanId is the id of the plan.
 	PlanId               string                 `json:"planId"`
 	InputParameterSchema map[string]interface{} `json:"inputParameterSchema"`
+
+	// AllowedPlanChanges are the ids of the plans, within the same service, that an entitlement on this plan may be
+	// upgraded or downgraded to through an ENTITLEMENT_UPDATED event.
+	AllowedPlanChanges []string `json:"allowedPlanChanges"`
+
+	// AsyncProvisioning indicates that entitlements on this plan are provisioned asynchronously. They remain PENDING
+	// until the creation event is completed.
+	AsyncProvisioning bool `json:"asyncProvisioning"`
+
+	// Labels are attached to every entitlement on this plan. The values can either be static, or templates that are
+	// rendered against the entitlement (e.g. "{{.planId}}-{{.parameters.region}}").
+	Labels map[string]string `json:"labels"`
+
+	// DashboardUrl, if set, overrides the dashboard url template of the service for this plan.
+	DashboardUrl string `json:"dashboardUrl"`
 }
 
 func (m *Metadata) getService(id string) (ServiceDefinition, error) {
@@ -58,6 +78,93 @@ func (s *ServiceDefinition) getPlan(id string) (PlanDefinition, error) {
 	return PlanDefinition{}, fmt.Errorf("PlanDefinition not found: id='%s'.", id)
 }
 
+func (m *Metadata) getPlan(serviceId string, planId string) (PlanDefinition, error) {
+	serviceDef, err := m.getService(serviceId)
+	if err != nil {
+		return PlanDefinition{}, err
+	}
+	return serviceDef.getPlan(planId)
+}
+
+// renderLabels renders the label templates of the plan for the given entitlement.
+func (p *PlanDefinition) renderLabels(info EntitlementInfo) (map[string]string, error) {
+	if len(p.Labels) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string, len(p.Labels))
+	for key, text := range p.Labels {
+		value, err := renderTemplate(key, text, info, p.InputParameterSchema)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to render label '%s': '%v'.", key, err)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// dashboardUrl returns the dashboard url template that applies to entitlements on the given plan.
+func (s *ServiceDefinition) dashboardUrl(p PlanDefinition) string {
+	if p.DashboardUrl != "" {
+		return p.DashboardUrl
+	}
+	return s.DashboardUrl
+}
+
+func validateDashboardUrl(text string) error {
+	if text == "" {
+		return nil
+	}
+	if !strings.HasPrefix(text, "https://") && !strings.HasPrefix(text, "http://") {
+		return fmt.Errorf("Dashboard url must be an absolute http(s) url: '%s'.", text)
+	}
+	_, err := parseTemplate("dashboardUrl", text)
+	return err
+}
+
+func (p *PlanDefinition) allowsPlanChangeTo(id string) bool {
+	for _, allowed := range p.AllowedPlanChanges {
+		if allowed == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the metadata for internal consistency.
+func (m *Metadata) Validate() error {
+	for _, serviceDef := range m.Services {
+		if err := validateDashboardUrl(serviceDef.DashboardUrl); err != nil {
+			return fmt.Errorf("Service '%s' has an invalid dashboard url: '%v'.", serviceDef.ServiceId, err)
+		}
+		for _, planDef := range serviceDef.Plans {
+			if err := validateDashboardUrl(planDef.DashboardUrl); err != nil {
+				return fmt.Errorf("Plan '%s/%s' has an invalid dashboard url: '%v'.",
+					serviceDef.ServiceId, planDef.PlanId, err)
+			}
+			if text := serviceDef.dashboardUrl(planDef); text != "" {
+				if err := trialRenderTemplate("dashboardUrl", text, serviceDef.ServiceId, planDef); err != nil {
+					return fmt.Errorf("Plan '%s/%s' has a dashboard url that cannot be rendered: '%v'.",
+						serviceDef.ServiceId, planDef.PlanId, err)
+				}
+			}
+			for key, text := range planDef.Labels {
+				if err := trialRenderTemplate(key, text, serviceDef.ServiceId, planDef); err != nil {
+					return fmt.Errorf("Plan '%s/%s' has an invalid label template '%s': '%v'.",
+						serviceDef.ServiceId, planDef.PlanId, key, err)
+				}
+			}
+			for _, target := range planDef.AllowedPlanChanges {
+				if _, err := serviceDef.getPlan(target); err != nil {
+					return fmt.Errorf("Plan '%s/%s' allows a change to an unknown plan: '%s'.",
+						serviceDef.ServiceId, planDef.PlanId, target)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // ReadMetadataFile opens the file with the given path, reads contents as JSON, and returns the parsed Metadata struct.
 func ReadMetadataFile(path string) (Metadata, error) {
 	contents, err := ioutil.ReadFile(path)
@@ -71,5 +178,10 @@ func ReadMetadataFile(path string) (Metadata, error) {
 		return Metadata{}, fmt.Errorf("Unable to parse metadata file: '%v'.\n", err)
 	}
 
+	err = metadata.Validate()
+	if err != nil {
+		return Metadata{}, fmt.Errorf("Invalid metadata file: '%v'.\n", err)
+	}
+
 	return metadata, nil
 }
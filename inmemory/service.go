@@ -19,80 +19,277 @@ import (
 	"fmt"
 	"github.com/xeipuuv/gojsonschema"
 	"log"
+	"procurementlistenerservice/internal/keylock"
 	"procurementlistenerservice/model"
 	"reflect"
+	"strings"
+	"sync"
 )
 
+// EntitlementState is the lifecycle state of an entitlement, as tracked by this service.
 type EntitlementState int
 
 const (
+	// ACTIVE indicates that the entitlement is provisioned and in use.
 	ACTIVE EntitlementState = iota
+
+	// PENDING indicates that the entitlement has been created, but provisioning has not completed yet.
+	PENDING EntitlementState = iota
+
+	// CANCELLED indicates that the entitlement has been cancelled by the owner, and can be reactivated.
+	CANCELLED EntitlementState = iota
+
+	// DELETED indicates that the entitlement has been deleted. This is a terminal state.
+	DELETED EntitlementState = iota
 )
 
+func (s EntitlementState) String() string {
+	switch s {
+	case ACTIVE:
+		return "ACTIVE"
+	case PENDING:
+		return "PENDING"
+	case CANCELLED:
+		return "CANCELLED"
+	case DELETED:
+		return "DELETED"
+	}
+	return fmt.Sprintf("EntitlementState(%d)", int(s))
+}
+
+// ParseEntitlementState returns the EntitlementState with the given name (e.g. "ACTIVE").
+func ParseEntitlementState(name string) (EntitlementState, error) {
+	for _, state := range []EntitlementState{ACTIVE, PENDING, CANCELLED, DELETED} {
+		if state.String() == name {
+			return state, nil
+		}
+	}
+	return ACTIVE, fmt.Errorf("Unknown entitlement state: '%s'.", name)
+}
+
+// transitions is the table of legal state transitions for an existing entitlement. Any event that is not listed for
+// the current state of the entitlement is rejected. Redelivered events are recognized by their event id, and are
+// accepted without being applied again.
+var transitions = map[EntitlementState]map[model.EntitlementEventType]EntitlementState{
+	ACTIVE: {
+		model.ENTITLEMENT_UPDATED:   ACTIVE,
+		model.ENTITLEMENT_CANCELLED: CANCELLED,
+		model.ENTITLEMENT_DELETED:   DELETED,
+	},
+	PENDING: {
+		model.ENTITLEMENT_CANCELLED: CANCELLED,
+		model.ENTITLEMENT_DELETED:   DELETED,
+	},
+	CANCELLED: {
+		model.ENTITLEMENT_REACTIVATED: ACTIVE,
+		model.ENTITLEMENT_DELETED:     DELETED,
+	},
+	DELETED: {},
+}
+
+// transitionVerbs describe the effect of each event type, for use in human readable messages.
+var transitionVerbs = map[model.EntitlementEventType]string{
+	model.ENTITLEMENT_CREATED:     "created",
+	model.ENTITLEMENT_UPDATED:     "updated",
+	model.ENTITLEMENT_CANCELLED:   "cancelled",
+	model.ENTITLEMENT_REACTIVATED: "reactivated",
+	model.ENTITLEMENT_DELETED:     "deleted",
+}
+
+// nextState returns the state that an entitlement in the given state moves to, when it receives an event of the
+// given type.
+func nextState(current EntitlementState, eventType model.EntitlementEventType) (EntitlementState, error) {
+	next, ok := transitions[current][eventType]
+	if !ok {
+		return current, fmt.Errorf("Illegal transition: state='%v', event='%s'.", current, eventType)
+	}
+	return next, nil
+}
+
 // EntitlementInfo is the internal state that this service holds about an entitlement.
 type EntitlementInfo struct {
-	Id        string
-	State     EntitlementState
-	ServiceId string
-	PlanId    string
+	Id        string           `json:"id"`
+	State     EntitlementState `json:"state"`
+	ServiceId string           `json:"serviceId"`
+	PlanId    string           `json:"planId"`
+
+	AccountId   string                 `json:"accountId"`
+	RequestorId string                 `json:"requestorId"`
+	Parameters  map[string]interface{} `json:"parameters"`
 
-	AccountId   string
-	RequestorId string
-	Parameters  map[string]interface{}
+	// Labels are the custom labels attached to the entitlement, which are returned to the marketplace.
+	Labels map[string]string `json:"labels"`
 }
 
+// InMemoryService is a PartnerBackendService that validates the events against the service definitions in its
+// metadata, and tracks the lifecycle of the entitlements in an EntitlementStore.
+//
+// The service is safe for concurrent use. The events of each entitlement are handled one at a time, so they never
+// interleave, while the events of different entitlements are handled in parallel. Reset, snapshots and restores wait
+// for the events that are being handled.
 type InMemoryService struct {
-	Metadata     Metadata
-	Entitlements map[string]EntitlementInfo
+	Metadata Metadata
+	store    EntitlementStore
+
+	// mu is held for reading while an event is handled, and for writing while the service is reset.
+	mu    sync.RWMutex
+	locks *keylock.Locks
 }
 
-var _ model.PartnerBackendService = &InMemoryService{}
+var _ model.AsyncPartnerBackendService = &InMemoryService{}
+
+// MAX_STORE_ATTEMPTS is the number of times an event is retried, when the entitlement that it changes is modified
+// concurrently in the store.
+const MAX_STORE_ATTEMPTS int = 10
 
-// CreateService creates a new InMemoryService and returns.
+// errStoreConflict is returned by the event handlers when the entitlement was modified concurrently, and the event
+// needs to be handled again.
+var errStoreConflict = errors.New("Entitlement was modified concurrently.")
+
+// CreateService creates a new InMemoryService that keeps the entitlements in memory, and returns.
 func CreateService(metadata Metadata) *InMemoryService {
+	return CreateServiceWithStore(metadata, CreateMapStore())
+}
+
+// CreateServiceWithStore creates a new InMemoryService that keeps the entitlements in the given store, and returns.
+func CreateServiceWithStore(metadata Metadata, store EntitlementStore) *InMemoryService {
 	return &InMemoryService{
-		Metadata:     metadata,
-		Entitlements: make(map[string]EntitlementInfo),
+		Metadata: metadata,
+		store:    store,
+		locks:    keylock.CreateLocks(),
 	}
 }
 
-// Reset clears the in-memory state.
-func (s *InMemoryService) Reset() {
-	s.Entitlements = make(map[string]EntitlementInfo)
+// Store returns the store that holds the entitlements.
+func (s *InMemoryService) Store() EntitlementStore {
+	return s.store
+}
+
+// ListEntitlements returns all entitlements, ordered by id.
+func (s *InMemoryService) ListEntitlements() ([]EntitlementInfo, error) {
+	return s.store.List()
+}
+
+// EntitlementOwner returns the account id of the entitlement with the given id, and reports whether the entitlement
+// exists.
+func (s *InMemoryService) EntitlementOwner(entitlementId string) (string, bool, error) {
+	info, found, err := s.getEntitlement(entitlementId)
+	return info.AccountId, found, err
+}
+
+// Reset removes all entitlements from the store.
+func (s *InMemoryService) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entitlements, err := s.store.List()
+	if err != nil {
+		return err
+	}
+	for _, info := range entitlements {
+		err = s.store.Delete(info.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *InMemoryService) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	var handler func(model.EntitlementEvent) (model.EntitlementEventResponse, error)
 	switch e.EventType {
 	case model.ENTITLEMENT_CREATED:
-		return s.onEntitlementCreated(e)
+		handler = s.onEntitlementCreated
+	case model.ENTITLEMENT_UPDATED,
+		model.ENTITLEMENT_CANCELLED,
+		model.ENTITLEMENT_REACTIVATED,
+		model.ENTITLEMENT_DELETED:
+		handler = s.onEntitlementTransition
+	default:
+		return model.EntitlementEventResponse{}, fmt.Errorf("Unrecognized entitlement event: '%+v'", e)
+	}
+
+	defer s.lock(e.EntitlementId)()
+	return retryOnConflict(e, handler)
+}
+
+// lock serializes the handling of the events of the given entitlement, and returns the function that ends it.
+func (s *InMemoryService) lock(entitlementId string) func() {
+	s.mu.RLock()
+	unlock := s.locks.Lock(entitlementId)
+	return func() {
+		unlock()
+		s.mu.RUnlock()
+	}
+}
+
+// retryOnConflict calls the given handler until it does not report a conflicting modification of the entitlement, or
+// until MAX_STORE_ATTEMPTS is reached.
+func retryOnConflict(e model.EntitlementEvent,
+	handler func(model.EntitlementEvent) (model.EntitlementEventResponse, error)) (model.EntitlementEventResponse, error) {
+
+	for attempt := 0; attempt < MAX_STORE_ATTEMPTS; attempt++ {
+		response, err := handler(e)
+		if err != errStoreConflict {
+			return response, err
+		}
+		log.Printf("Entitlement '%s' was modified concurrently, retrying event '%s'.\n", e.EntitlementId, e.EventId)
 	}
+	return model.EntitlementEventResponse{}, fmt.Errorf("Entitlement '%s' is modified concurrently: '%v'.",
+		e.EntitlementId, errStoreConflict)
+}
 
-	return model.EntitlementEventResponse{}, fmt.Errorf("Unrecognized entitlement event: '%+v'", e)
+// getEntitlement returns the entitlement with the given id from the store. It reports whether the entitlement exists,
+// and returns an error only if the store fails.
+func (s *InMemoryService) getEntitlement(id string) (EntitlementInfo, bool, error) {
+	info, err := s.store.Get(id)
+	if err == ErrEntitlementNotFound {
+		return EntitlementInfo{}, false, nil
+	}
+	if err != nil {
+		return EntitlementInfo{}, false, fmt.Errorf("Unable to read entitlement '%s': '%v'.", id, err)
+	}
+	return info, true, nil
+}
+
+// swapEntitlement replaces old with info in the store, and returns errStoreConflict if old is no longer current. If
+// the store records processed events, the given event is recorded along with the change.
+func (s *InMemoryService) swapEntitlement(e model.EntitlementEvent, old *EntitlementInfo, info EntitlementInfo) error {
+	var swapped bool
+	var err error
+	if store, ok := s.store.(ProcessedEventStore); ok {
+		swapped, err = store.CompareAndSwapEvent(e.EventId, old, info)
+	} else {
+		swapped, err = s.store.CompareAndSwap(old, info)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to store entitlement '%s': '%v'.", info.Id, err)
+	}
+	if !swapped {
+		return errStoreConflict
+	}
+	return nil
 }
 
 func (s *InMemoryService) onEntitlementCreated(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
 	serviceDef, err := s.Metadata.getService(e.ServiceId)
 	if err != nil {
 		log.Printf("Service not found: '%s'.", e.ServiceId)
-		return model.EntitlementEventResponse{
-			Status: model.RESPONSESTATUS_INVALIDREQUEST,
-		}, nil
+		return model.EntitlementEventResponse{}, model.NewFieldValidationError(
+			model.JsonPointer("serviceId"), "Service not found: '%s'.", e.ServiceId)
 	}
 
 	planDef, err := serviceDef.getPlan(e.PlanId)
 	if err != nil {
 		log.Printf("Plan not found: '%s'.", e.PlanId)
-		return model.EntitlementEventResponse{
-			Status: model.RESPONSESTATUS_INVALIDREQUEST,
-		}, nil
+		return model.EntitlementEventResponse{}, model.NewFieldValidationError(
+			model.JsonPointer("planId"), "Plan not found: '%s'.", e.PlanId)
 	}
 
 	err = validateParameters(e.Parameters, planDef.InputParameterSchema)
 	if err != nil {
 		log.Printf("Parameters are not valid: '%+v'", err)
-		return model.EntitlementEventResponse{
-			Status: model.RESPONSESTATUS_INVALIDREQUEST,
-		}, nil
+		return model.EntitlementEventResponse{}, err
 	}
 
 	state := EntitlementInfo{
@@ -104,32 +301,288 @@ func (s *InMemoryService) onEntitlementCreated(e model.EntitlementEvent) (model.
 		RequestorId: e.RequestorId,
 		Parameters:  e.Parameters,
 	}
+	if planDef.AsyncProvisioning {
+		state.State = PENDING
+	}
 
-	existing, exists := s.Entitlements[e.EntitlementId]
+	state.Labels, err = planDef.renderLabels(state)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	existing, exists, err := s.getEntitlement(e.EntitlementId)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
 	if exists {
+		// The state of the existing entitlement might have moved on since it was created.
+		state.State = existing.State
 		if !reflect.DeepEqual(existing, state) {
 			log.Printf("Entitlement already exists: '%s'.", e.EntitlementId)
-			return model.EntitlementEventResponse{
-				Status: model.RESPONSESTATUS_INVALIDREQUEST,
-			}, nil
+			return model.EntitlementEventResponse{}, model.NewFieldValidationError(
+				model.JsonPointer("entitlementId"), "Entitlement already exists: '%s'.", e.EntitlementId)
+		}
+		if existing.State != ACTIVE && existing.State != PENDING {
+			log.Printf("Entitlement is no longer active: '%s' '%v'.", e.EntitlementId, existing.State)
+			return rejectedResponse(e, model.NewRejection(model.REJECTIONREASON_ILLEGALTRANSITION,
+				"The entitlement is no longer active.")), nil
 		}
+	}
+
+	status := model.RESPONSESTATUS_ACCEPTED
+	if state.State == PENDING {
+		status = model.RESPONSESTATUS_ASYNC
+	}
+
+	// The response is created before the entitlement is stored, so that nothing is stored if it cannot be created.
+	response, err := s.entitlementResponse(status, e, state)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	if !exists {
+		err = s.swapEntitlement(e, nil, state)
+		if err != nil {
+			return model.EntitlementEventResponse{}, err
+		}
+	}
+
+	if state.State == PENDING {
+		log.Printf("Entitlement pending: '%+v'\n", state)
 	} else {
-		s.Entitlements[e.EntitlementId] = state
+		log.Printf("Entitlement created: '%+v'\n", state)
 	}
+	return response, nil
+}
+
+// OnEntitlementEventCompleted finishes the provisioning of a PENDING entitlement. An accepted entitlement becomes
+// ACTIVE, and a rejected one is DELETED.
+func (s *InMemoryService) OnEntitlementEventCompleted(
+	e model.EntitlementEvent, status model.ResponseStatus) (model.EntitlementEventResponse, error) {
+
+	defer s.lock(e.EntitlementId)()
+	return retryOnConflict(e, func(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+		return s.onEntitlementEventCompleted(e, status)
+	})
+}
 
-	log.Printf("Entitlement created: '%+v'\n", state)
+func (s *InMemoryService) onEntitlementEventCompleted(
+	e model.EntitlementEvent, status model.ResponseStatus) (model.EntitlementEventResponse, error) {
 
+	existing, exists, err := s.getEntitlement(e.EntitlementId)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+	if !exists {
+		return model.EntitlementEventResponse{}, fmt.Errorf("Entitlement not found: '%s'.", e.EntitlementId)
+	}
+
+	if e.EventType != model.ENTITLEMENT_CREATED {
+		return model.EntitlementEventResponse{}, fmt.Errorf("Unexpected completion: event='%s'.", e.EventType)
+	}
+
+	// The entitlement may have been cancelled or deleted while it was pending. The completion is then rejected, so
+	// that the pending event is concluded.
+	if existing.State != PENDING {
+		log.Printf("Rejecting completion for entitlement '%s', which is no longer pending: '%v'", e.EntitlementId,
+			existing.State)
+		return rejectedResponse(e, model.NewRejection(model.REJECTIONREASON_ILLEGALTRANSITION,
+			"The entitlement cannot be provisioned while it is %s.", existing.State)), nil
+	}
+
+	state := existing
+	switch status {
+	case model.RESPONSESTATUS_ACCEPTED:
+		state.State = ACTIVE
+	case model.RESPONSESTATUS_REJECTED:
+		state.State = DELETED
+	default:
+		return model.EntitlementEventResponse{}, fmt.Errorf("Invalid completion status: '%v'.", status)
+	}
+
+	response := rejectedResponse(e, model.NewRejection(model.REJECTIONREASON_PROVISIONINGFAILED,
+		"The entitlement could not be provisioned."))
+	if status == model.RESPONSESTATUS_ACCEPTED {
+		response, err = s.entitlementResponse(status, e, state)
+		if err != nil {
+			return model.EntitlementEventResponse{}, err
+		}
+	}
+
+	err = s.swapEntitlement(e, &existing, state)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	log.Printf("Entitlement provisioning completed: '%+v'\n", state)
+	return response, nil
+}
+
+func (s *InMemoryService) onEntitlementTransition(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	existing, exists, err := s.getEntitlement(e.EntitlementId)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+	if !exists {
+		log.Printf("Entitlement not found: '%s'.", e.EntitlementId)
+		return rejectedResponse(e, model.NewRejection(model.REJECTIONREASON_ENTITLEMENTNOTFOUND,
+			"The entitlement does not exist.")), nil
+	}
+
+	if store, ok := s.store.(ProcessedEventStore); ok {
+		processed, err := store.IsProcessed(e.EventId)
+		if err != nil {
+			return model.EntitlementEventResponse{}, fmt.Errorf("Unable to read processed events: '%v'.", err)
+		}
+		if processed {
+			log.Printf("Event was already applied to entitlement '%s': '%s'.\n", e.EntitlementId, e.EventId)
+			return s.entitlementResponse(model.RESPONSESTATUS_ACCEPTED, e, existing)
+		}
+	}
+
+	next, err := nextState(existing.State, e.EventType)
+	if err != nil {
+		log.Printf("Rejecting event for entitlement '%s': '%v'", e.EntitlementId, err)
+		return rejectedResponse(e, model.NewRejection(model.REJECTIONREASON_ILLEGALTRANSITION,
+			"The entitlement cannot be %s while it is %s.", transitionVerbs[e.EventType], existing.State)), nil
+	}
+
+	state := existing
+	state.State = next
+
+	if e.EventType == model.ENTITLEMENT_UPDATED {
+		var reason *model.RejectionReason
+		state, reason, err = s.applyUpdate(e, state)
+		if err != nil {
+			return model.EntitlementEventResponse{}, err
+		}
+		if reason != nil {
+			return rejectedResponse(e, reason), nil
+		}
+	}
+
+	response, err := s.entitlementResponse(model.RESPONSESTATUS_ACCEPTED, e, state)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	err = s.swapEntitlement(e, &existing, state)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	log.Printf("Entitlement transitioned: '%v' -> '%v' '%+v'\n", existing.State, state.State, state)
+	return response, nil
+}
+
+// rejectedResponse creates a response that rejects the given event for the given reason.
+func rejectedResponse(e model.EntitlementEvent, reason *model.RejectionReason) model.EntitlementEventResponse {
 	return model.EntitlementEventResponse{
-		Status:  model.RESPONSESTATUS_ACCEPTED,
+		Status:  model.RESPONSESTATUS_REJECTED,
 		EventId: e.EventId,
-	}, nil
+		Reason:  reason,
+	}
 }
 
+// entitlementResponse creates a response to the given event, that carries the details of the entitlement. Accepted
+// responses also carry the rendered dashboard url of the entitlement. It is called before the entitlement is stored,
+// so that an event whose response cannot be rendered does not change the entitlement.
+func (s *InMemoryService) entitlementResponse(
+	status model.ResponseStatus, e model.EntitlementEvent, info EntitlementInfo) (model.EntitlementEventResponse, error) {
+
+	response := model.EntitlementEventResponse{
+		Status:  status,
+		EventId: e.EventId,
+		Labels:  info.Labels,
+	}
+
+	if status == model.RESPONSESTATUS_ACCEPTED {
+		serviceDef, err := s.Metadata.getService(info.ServiceId)
+		if err != nil {
+			return model.EntitlementEventResponse{}, err
+		}
+		planDef, err := serviceDef.getPlan(info.PlanId)
+		if err != nil {
+			return model.EntitlementEventResponse{}, err
+		}
+
+		if text := serviceDef.dashboardUrl(planDef); text != "" {
+			response.EntitlementDashboardUrl, err = renderTemplate("dashboardUrl", text, info, planDef.InputParameterSchema)
+			if err != nil {
+				return model.EntitlementEventResponse{}, fmt.Errorf("Unable to render dashboard url: '%v'.", err)
+			}
+		}
+	}
+
+	return response, nil
+}
+
+// applyUpdate applies the plan and parameter changes in an ENTITLEMENT_UPDATED event to the given entitlement state.
+// Invalid updates are reported as a *model.ValidationError, and updates that are not allowed are rejected with the
+// returned reason.
+func (s *InMemoryService) applyUpdate(
+	e model.EntitlementEvent, state EntitlementInfo) (EntitlementInfo, *model.RejectionReason, error) {
+
+	if e.ServiceId != "" && e.ServiceId != state.ServiceId {
+		log.Printf("Service change is not allowed: '%s' -> '%s'.", state.ServiceId, e.ServiceId)
+		return state, model.NewRejection(model.REJECTIONREASON_PLANCHANGENOTALLOWED,
+			"The entitlement cannot be moved to a different service."), nil
+	}
+
+	serviceDef, err := s.Metadata.getService(state.ServiceId)
+	if err != nil {
+		return state, nil, err
+	}
+
+	currentPlan, err := serviceDef.getPlan(state.PlanId)
+	if err != nil {
+		return state, nil, err
+	}
+
+	targetPlan := currentPlan
+	if e.PlanId != "" && e.PlanId != state.PlanId {
+		if !currentPlan.allowsPlanChangeTo(e.PlanId) {
+			log.Printf("Plan change is not allowed: '%s' -> '%s'.", state.PlanId, e.PlanId)
+			return state, model.NewRejection(model.REJECTIONREASON_PLANCHANGENOTALLOWED,
+				"The entitlement cannot be changed from plan '%s' to plan '%s'.", state.PlanId, e.PlanId), nil
+		}
+
+		targetPlan, err = serviceDef.getPlan(e.PlanId)
+		if err != nil {
+			log.Printf("Plan not found: '%s'.", e.PlanId)
+			return state, nil, model.NewFieldValidationError(
+				model.JsonPointer("planId"), "Plan not found: '%s'.", e.PlanId)
+		}
+	}
+
+	parameters := state.Parameters
+	if e.Parameters != nil {
+		parameters = e.Parameters
+	}
+
+	// Parameters are always re-validated, as the target plan may expect a different set of parameters.
+	err = validateParameters(parameters, targetPlan.InputParameterSchema)
+	if err != nil {
+		log.Printf("Parameters are not valid: '%+v'", err)
+		return state, nil, err
+	}
+
+	state.PlanId = targetPlan.PlanId
+	state.Parameters = parameters
+	state.Labels, err = targetPlan.renderLabels(state)
+	if err != nil {
+		return state, nil, err
+	}
+	return state, nil, nil
+}
+
+// validateParameters validates the parameters against the given JSON schema. Problems with the parameters are
+// reported as a *model.ValidationError, with JSON pointers to the offending parameters.
 func validateParameters(parameters map[string]interface{}, schema map[string]interface{}) error {
 	if len(schema) == 0 {
 		// No schema was defined
 		if len(parameters) != 0 {
-			return errors.New("No parameters were expected.")
+			return model.NewFieldValidationError(model.JsonPointer("parameters"), "No parameters were expected.")
 		}
 		return nil
 	}
@@ -143,8 +596,38 @@ func validateParameters(parameters map[string]interface{}, schema map[string]int
 	}
 
 	if !result.Valid() {
-		return fmt.Errorf("The document is not valid: {%v}.", result.Errors())
+		fieldErrors := make([]model.FieldError, 0, len(result.Errors()))
+		for _, resultError := range result.Errors() {
+			fieldErrors = append(fieldErrors, model.FieldError{
+				Field:   parameterPointer(resultError),
+				Message: resultError.Description(),
+			})
+		}
+		return &model.ValidationError{
+			Message:     "Parameters are not valid.",
+			FieldErrors: fieldErrors,
+		}
 	}
 
 	return nil
 }
+
+// parameterPointer returns the JSON pointer, within the event, to the parameter that the given schema error is about.
+func parameterPointer(resultError gojsonschema.ResultError) string {
+	// The context is a path that starts with "(root)". Use a delimiter that cannot be part of a property name, to be
+	// able to split it into its components.
+	const delimiter = "\x00"
+	components := []string{"parameters"}
+	for _, c := range strings.Split(resultError.Context().String(delimiter), delimiter)[1:] {
+		components = append(components, c)
+	}
+
+	// Errors about missing properties are reported on the parent object.
+	if resultError.Type() == "required" {
+		if property, ok := resultError.Details()["property"].(string); ok {
+			components = append(components, property)
+		}
+	}
+
+	return model.JsonPointer(components...)
+}
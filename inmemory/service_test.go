@@ -0,0 +1,258 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmemory
+
+import (
+	"fmt"
+	"procurementlistenerservice/model"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var stressMetadata = Metadata{
+	Services: []ServiceDefinition{
+		{ServiceId: "S1", Plans: []PlanDefinition{
+			{PlanId: "P1", AllowedPlanChanges: []string{"P2"}},
+			{PlanId: "P2", AllowedPlanChanges: []string{"P1"}},
+			{PlanId: "Async", AsyncProvisioning: true},
+		}},
+	},
+}
+
+// interleavingStore is a MapStore that fails the test if the store operations of different events for the same
+// entitlement overlap. Each operation is slowed down, to give unserialized events a chance to overlap.
+type interleavingStore struct {
+	*MapStore
+	t      *testing.T
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func (s *interleavingStore) enter(id string) func() {
+	s.mu.Lock()
+	s.active[id]++
+	if s.active[id] > 1 {
+		s.t.Errorf("Events for entitlement '%s' interleave", id)
+	}
+	s.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	return func() {
+		s.mu.Lock()
+		s.active[id]--
+		s.mu.Unlock()
+	}
+}
+
+func (s *interleavingStore) Get(id string) (EntitlementInfo, error) {
+	defer s.enter(id)()
+	return s.MapStore.Get(id)
+}
+
+func (s *interleavingStore) CompareAndSwap(old *EntitlementInfo, info EntitlementInfo) (bool, error) {
+	defer s.enter(info.Id)()
+	return s.MapStore.CompareAndSwap(old, info)
+}
+
+func (s *interleavingStore) CompareAndSwapEvent(
+	eventId string, old *EntitlementInfo, info EntitlementInfo) (bool, error) {
+
+	defer s.enter(info.Id)()
+	return s.MapStore.CompareAndSwapEvent(eventId, old, info)
+}
+
+func createEvent(eventId string, entitlementId string, planId string) model.EntitlementEvent {
+	return model.EntitlementEvent{
+		EventId:       eventId,
+		EventType:     model.ENTITLEMENT_CREATED,
+		EntitlementId: entitlementId,
+		ServiceId:     "S1",
+		PlanId:        planId,
+		AccountId:     "A1",
+	}
+}
+
+// parallel calls fn from the given number of goroutines, and waits for them to return.
+func parallel(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestParallelDuplicateCreates(t *testing.T) {
+	service := CreateService(stressMetadata)
+
+	var accepted int32
+	parallel(50, func(i int) {
+		response, err := service.OnEntitlementEvent(createEvent("1", "E1", "P1"))
+		if err == nil && response.Status == model.RESPONSESTATUS_ACCEPTED {
+			atomic.AddInt32(&accepted, 1)
+		}
+	})
+
+	if accepted != 50 {
+		t.Errorf("Expected all duplicates to be accepted, got '%d'", accepted)
+	}
+	if entitlements, _ := service.ListEntitlements(); len(entitlements) != 1 {
+		t.Errorf("Expected a single entitlement, got '%+v'", entitlements)
+	}
+}
+
+func TestParallelConflictingCreates(t *testing.T) {
+	service := CreateService(stressMetadata)
+
+	var accepted, refused int32
+	parallel(50, func(i int) {
+		e := createEvent(fmt.Sprintf("event%d", i), "E1", []string{"P1", "P2"}[i%2])
+		e.AccountId = fmt.Sprintf("A%d", i)
+		_, err := service.OnEntitlementEvent(e)
+		if _, ok := err.(*model.ValidationError); ok {
+			atomic.AddInt32(&refused, 1)
+		} else if err == nil {
+			atomic.AddInt32(&accepted, 1)
+		}
+	})
+
+	if accepted != 1 || refused != 49 {
+		t.Errorf("Expected a single create to win: accepted='%d' refused='%d'", accepted, refused)
+	}
+}
+
+func TestEventsOfAnEntitlementDoNotInterleave(t *testing.T) {
+	store := &interleavingStore{MapStore: CreateMapStore(), t: t, active: make(map[string]int)}
+	service := CreateServiceWithStore(stressMetadata, store)
+
+	entitlementIds := []string{"E1", "E2", "E3"}
+	for _, id := range entitlementIds {
+		if _, err := service.OnEntitlementEvent(createEvent("create-"+id, id, "P1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eventTypes := []model.EntitlementEventType{
+		model.ENTITLEMENT_CANCELLED, model.ENTITLEMENT_REACTIVATED, model.ENTITLEMENT_UPDATED,
+	}
+	parallel(60, func(i int) {
+		e := model.EntitlementEvent{
+			EventId:       fmt.Sprintf("event%d", i),
+			EventType:     eventTypes[i%len(eventTypes)],
+			EntitlementId: entitlementIds[i%len(entitlementIds)],
+		}
+		if e.EventType == model.ENTITLEMENT_UPDATED {
+			e.PlanId = []string{"P1", "P2"}[i%2]
+		}
+		if _, err := service.OnEntitlementEvent(e); err != nil {
+			t.Errorf("Unexpected error for '%+v': '%v'", e, err)
+		}
+	})
+
+	entitlements, _ := service.ListEntitlements()
+	for _, info := range entitlements {
+		if info.State != ACTIVE && info.State != CANCELLED {
+			t.Errorf("Unexpected state: '%+v'", info)
+		}
+	}
+}
+
+func TestResetWhileHandlingEvents(t *testing.T) {
+	service := CreateService(stressMetadata)
+
+	parallel(40, func(i int) {
+		if i%10 == 0 {
+			if err := service.Reset(); err != nil {
+				t.Error(err)
+			}
+			return
+		}
+		id := fmt.Sprintf("E%d", i)
+		if _, err := service.OnEntitlementEvent(createEvent("create-"+id, id, "P1")); err != nil {
+			t.Error(err)
+		}
+		service.OnEntitlementEvent(model.EntitlementEvent{
+			EventId: "cancel-" + id, EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: id})
+	})
+
+	if err := service.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if entitlements, _ := service.ListEntitlements(); len(entitlements) != 0 {
+		t.Errorf("Expected no entitlements after reset, got '%+v'", entitlements)
+	}
+}
+
+func TestRedeliveredEventsAreNotAppliedTwice(t *testing.T) {
+	store := CreateMapStore()
+	service := CreateServiceWithStore(stressMetadata, store)
+	if _, err := service.OnEntitlementEvent(createEvent("create", "E1", "P1")); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel := model.EntitlementEvent{EventId: "cancel", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E1"}
+	deleted := model.EntitlementEvent{EventId: "delete", EventType: model.ENTITLEMENT_DELETED, EntitlementId: "E1"}
+	for _, test := range []struct {
+		event    model.EntitlementEvent
+		expected model.ResponseStatus
+	}{
+		{cancel, model.RESPONSESTATUS_ACCEPTED},
+		{cancel, model.RESPONSESTATUS_ACCEPTED},
+		{model.EntitlementEvent{EventId: "cancel2", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E1"},
+			model.RESPONSESTATUS_REJECTED},
+		{deleted, model.RESPONSESTATUS_ACCEPTED},
+		{deleted, model.RESPONSESTATUS_ACCEPTED},
+	} {
+		response, err := service.OnEntitlementEvent(test.event)
+		if err != nil || response.Status != test.expected {
+			t.Errorf("Unexpected response to '%s': actual='%+v', expected='%v', err='%v'",
+				test.event.EventId, response, test.expected, err)
+		}
+	}
+
+	// Only the event that deleted the entitlement is remembered.
+	for eventId, expected := range map[string]bool{"create": false, "cancel": false, "delete": true} {
+		if processed, _ := store.IsProcessed(eventId); processed != expected {
+			t.Errorf("Unexpected processed state of '%s': actual='%v', expected='%v'", eventId, processed, expected)
+		}
+	}
+}
+
+func TestCompletionOfCancelledEntitlementIsRejected(t *testing.T) {
+	service := CreateService(stressMetadata)
+	create := createEvent("create", "E1", "Async")
+	if _, err := service.OnEntitlementEvent(create); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.OnEntitlementEvent(model.EntitlementEvent{
+		EventId: "cancel", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := service.OnEntitlementEventCompleted(create, model.RESPONSESTATUS_ACCEPTED)
+	if err != nil || response.Status != model.RESPONSESTATUS_REJECTED || response.Reason == nil ||
+		response.Reason.Code != model.REJECTIONREASON_ILLEGALTRANSITION {
+		t.Errorf("Unexpected completion: '%+v' '%v'", response, err)
+	}
+	if entitlements, _ := service.ListEntitlements(); len(entitlements) != 1 || entitlements[0].State != CANCELLED {
+		t.Errorf("Unexpected entitlements: '%+v'", entitlements)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmemory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"procurementlistenerservice/internal/fileutil"
+	"strings"
+	"time"
+)
+
+// SNAPSHOT_VERSION is the version of the snapshot format. It is incremented whenever the format changes in a way
+// that older versions of the service cannot read.
+const SNAPSHOT_VERSION int = 1
+
+// Snapshot is the state of the entitlements of an InMemoryService at a point in time, as written to disk.
+type Snapshot struct {
+	// Version is the version of the snapshot format (SNAPSHOT_VERSION).
+	Version int `json:"version"`
+
+	// Time is the time at which the snapshot was taken.
+	Time time.Time `json:"time"`
+
+	// Entitlements are the entitlements, ordered by id.
+	Entitlements []EntitlementInfo `json:"entitlements"`
+}
+
+// MarshalText encodes the state by name (e.g. "ACTIVE").
+func (s EntitlementState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalJSON decodes the state from its name, or from its number, which is how the state was encoded before it was
+// encoded by name.
+func (s *EntitlementState) UnmarshalJSON(data []byte) error {
+	var number int
+	if json.Unmarshal(data, &number) == nil {
+		state := EntitlementState(number)
+		if state < ACTIVE || state > DELETED {
+			return fmt.Errorf("Unknown entitlement state: '%d'.", number)
+		}
+		*s = state
+		return nil
+	}
+
+	var name string
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return fmt.Errorf("Invalid entitlement state: '%s'.", data)
+	}
+	state, err := ParseEntitlementState(name)
+	if err != nil {
+		return err
+	}
+	*s = state
+	return nil
+}
+
+// TakeSnapshot returns the current state of the entitlements.
+func (s *InMemoryService) TakeSnapshot() (Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entitlements, err := s.store.List()
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("Unable to list entitlements: '%v'.", err)
+	}
+
+	return Snapshot{
+		Version:      SNAPSHOT_VERSION,
+		Time:         time.Now().UTC(),
+		Entitlements: entitlements,
+	}, nil
+}
+
+// WriteSnapshot writes the current state of the entitlements to the given path. The snapshot is written to a
+// temporary file, which is atomically renamed over the given path, so that a crash never leaves a partially written
+// snapshot behind.
+func (s *InMemoryService) WriteSnapshot(path string) error {
+	snapshot, err := s.TakeSnapshot()
+	if err != nil {
+		return err
+	}
+
+	contents, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = fileutil.WriteAtomically(path, contents)
+	if err != nil {
+		return fmt.Errorf("Unable to write snapshot: '%v'.", err)
+	}
+	return nil
+}
+
+// ReadSnapshotFile reads the snapshot at the given path. Snapshots of an unsupported format version are reported as
+// errors. If the snapshot does not exist, the returned error satisfies os.IsNotExist.
+func ReadSnapshotFile(path string) (Snapshot, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	var header struct {
+		Version int `json:"version"`
+	}
+	err = json.Unmarshal(contents, &header)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("Unable to parse snapshot file '%s': '%v'.", path, err)
+	}
+	if header.Version != SNAPSHOT_VERSION {
+		return Snapshot{}, fmt.Errorf("Snapshot file '%s' has format version '%d', but this service reads version "+
+			"'%d'. Restore it with a matching version of the service, or remove it to start empty.",
+			path, header.Version, SNAPSHOT_VERSION)
+	}
+
+	var snapshot Snapshot
+	err = json.Unmarshal(contents, &snapshot)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("Unable to parse snapshot file '%s': '%v'.", path, err)
+	}
+	return snapshot, nil
+}
+
+// RestoreEntitlements puts the given entitlements, e.g. from a snapshot, into the store, which is expected to be
+// empty. Entitlements that refer to services or plans that are not in the metadata are reported together, and none
+// of the entitlements are restored in that case.
+func (s *InMemoryService) RestoreEntitlements(entitlements []EntitlementInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var mismatches []string
+	for _, info := range entitlements {
+		if _, err := s.Metadata.getPlan(info.ServiceId, info.PlanId); err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("entitlement '%s' is on plan '%s/%s'",
+				info.Id, info.ServiceId, info.PlanId))
+		}
+	}
+	if len(mismatches) != 0 {
+		return fmt.Errorf("The entitlements do not match the metadata, which does not define the plans that they "+
+			"are on: %s.", strings.Join(mismatches, "; "))
+	}
+
+	for _, info := range entitlements {
+		err := s.store.Put(info)
+		if err != nil {
+			return fmt.Errorf("Unable to restore entitlement '%s': '%v'.", info.Id, err)
+		}
+	}
+	return nil
+}
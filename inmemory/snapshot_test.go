@@ -0,0 +1,102 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmemory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"procurementlistenerservice/model"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var snapshotMetadata = Metadata{
+	Services: []ServiceDefinition{
+		{ServiceId: "S1", Plans: []PlanDefinition{{PlanId: "P1"}, {PlanId: "P2"}}},
+	},
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	service := CreateService(snapshotMetadata)
+	for _, e := range []model.EntitlementEvent{
+		{EventId: "1", EventType: model.ENTITLEMENT_CREATED, EntitlementId: "E1", ServiceId: "S1", PlanId: "P1"},
+		{EventId: "2", EventType: model.ENTITLEMENT_CREATED, EntitlementId: "E2", ServiceId: "S1", PlanId: "P2"},
+		{EventId: "3", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E2"},
+	} {
+		if _, err := service.OnEntitlementEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := service.WriteSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(contents), `"state": "CANCELLED"`) {
+		t.Errorf("Expected states to be written by name: '%s'", contents)
+	}
+
+	snapshot, err := ReadSnapshotFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := CreateService(snapshotMetadata)
+	if err := restored.RestoreEntitlements(snapshot.Entitlements); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _ := service.ListEntitlements()
+	actual, _ := restored.ListEntitlements()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected entitlements: actual='%+v' expected='%+v'", actual, expected)
+	}
+}
+
+func TestSnapshotMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	ioutil.WriteFile(path, []byte(`{"version": 99, "entitlements": []}`), 0600)
+	if _, err := ReadSnapshotFile(path); err == nil || !strings.Contains(err.Error(), "format version '99'") {
+		t.Errorf("Expected a format version error, got '%v'", err)
+	}
+
+	service := CreateService(snapshotMetadata)
+	err = service.RestoreEntitlements([]EntitlementInfo{
+		{Id: "E1", ServiceId: "S1", PlanId: "P1"},
+		{Id: "E2", ServiceId: "S1", PlanId: "Removed"},
+		{Id: "E3", ServiceId: "Removed", PlanId: "P1"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "'E2' is on plan 'S1/Removed'") ||
+		!strings.Contains(err.Error(), "'E3' is on plan 'Removed/P1'") {
+		t.Errorf("Expected a metadata mismatch error, got '%v'", err)
+	}
+	if entitlements, _ := service.ListEntitlements(); len(entitlements) != 0 {
+		t.Errorf("Expected nothing to be restored, got '%+v'", entitlements)
+	}
+}
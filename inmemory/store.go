@@ -0,0 +1,170 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmemory
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ErrEntitlementNotFound is returned by the EntitlementStore when the requested entitlement does not exist.
+var ErrEntitlementNotFound = errors.New("Entitlement not found.")
+
+// EntitlementStore holds the state of the entitlements. The service logic is written against this interface only,
+// so that the entitlements can be kept in different (e.g. persistent) stores.
+//
+// Implementations must be safe for concurrent use.
+type EntitlementStore interface {
+	// Get returns the entitlement with the given id, or ErrEntitlementNotFound if it does not exist.
+	Get(id string) (EntitlementInfo, error)
+
+	// Put stores the given entitlement, replacing the existing entitlement with the same id, if any.
+	Put(info EntitlementInfo) error
+
+	// CompareAndSwap stores the given entitlement, only if the currently stored entitlement with the same id is equal
+	// to old. A nil old means that the entitlement must not exist yet. It reports whether the entitlement was stored.
+	CompareAndSwap(old *EntitlementInfo, info EntitlementInfo) (bool, error)
+
+	// List returns all entitlements, ordered by id.
+	List() ([]EntitlementInfo, error)
+
+	// Delete removes the entitlement with the given id. Deleting an entitlement that does not exist is not an error.
+	Delete(id string) error
+}
+
+// ProcessedEventStore is implemented by the EntitlementStores that also record the ids of the events that were
+// applied to the entitlements, so that redelivered events are not applied twice. Once an entitlement is DELETED, only
+// the event that deleted it is remembered, as no other event can be applied to it anymore.
+type ProcessedEventStore interface {
+	EntitlementStore
+
+	// CompareAndSwapEvent is CompareAndSwap that also records, in the same transaction, that the event with the given
+	// id was applied to the entitlement.
+	CompareAndSwapEvent(eventId string, old *EntitlementInfo, info EntitlementInfo) (bool, error)
+
+	// IsProcessed reports whether the event with the given id was recorded by CompareAndSwapEvent.
+	IsProcessed(eventId string) (bool, error)
+}
+
+// MapStore is an EntitlementStore that keeps the entitlements, and the ids of the processed events, in memory. It is
+// the default store of the service.
+type MapStore struct {
+	mu           sync.RWMutex
+	entitlements map[string]EntitlementInfo
+
+	// processed maps the ids of the processed events to the ids of their entitlements, and events lists the ids of the
+	// processed events of each entitlement, so that they can be forgotten with the entitlement.
+	processed map[string]string
+	events    map[string][]string
+}
+
+var _ ProcessedEventStore = &MapStore{}
+
+// CreateMapStore creates a new, empty MapStore.
+func CreateMapStore() *MapStore {
+	return &MapStore{
+		entitlements: make(map[string]EntitlementInfo),
+		processed:    make(map[string]string),
+		events:       make(map[string][]string),
+	}
+}
+
+func (s *MapStore) Get(id string) (EntitlementInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, found := s.entitlements[id]
+	if !found {
+		return EntitlementInfo{}, ErrEntitlementNotFound
+	}
+	return info, nil
+}
+
+func (s *MapStore) Put(info EntitlementInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entitlements[info.Id] = info
+	return nil
+}
+
+func (s *MapStore) CompareAndSwap(old *EntitlementInfo, info EntitlementInfo) (bool, error) {
+	return s.CompareAndSwapEvent("", old, info)
+}
+
+// CompareAndSwapEvent is CompareAndSwap that also records that the event with the given id was applied to the
+// entitlement. An empty event id records nothing.
+func (s *MapStore) CompareAndSwapEvent(eventId string, old *EntitlementInfo, info EntitlementInfo) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, found := s.entitlements[info.Id]
+	if old == nil && found {
+		return false, nil
+	}
+	if old != nil && (!found || !reflect.DeepEqual(existing, *old)) {
+		return false, nil
+	}
+
+	s.entitlements[info.Id] = info
+
+	if info.State == DELETED {
+		s.forgetEvents(info.Id)
+	}
+	if eventId != "" {
+		s.processed[eventId] = info.Id
+		s.events[info.Id] = append(s.events[info.Id], eventId)
+	}
+	return true, nil
+}
+
+func (s *MapStore) IsProcessed(eventId string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, processed := s.processed[eventId]
+	return processed, nil
+}
+
+func (s *MapStore) List() ([]EntitlementInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]EntitlementInfo, 0, len(s.entitlements))
+	for _, info := range s.entitlements {
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+func (s *MapStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entitlements, id)
+	s.forgetEvents(id)
+	return nil
+}
+
+// forgetEvents forgets the processed events of the given entitlement.
+func (s *MapStore) forgetEvents(id string) {
+	for _, eventId := range s.events[id] {
+		delete(s.processed, eventId)
+	}
+	delete(s.events, id)
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmemory
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// Templates in the metadata are Go text/templates, which are rendered against the details of an entitlement. The
+// following fields are available: {{.entitlementId}}, {{.accountId}}, {{.serviceId}}, {{.planId}} and
+// {{.parameters.<name>}}. Values that are embedded in urls should be escaped, e.g. {{.parameters.name | urlquery}}.
+//
+// The parameters that the input parameter schema of the plan declares, but that an entitlement does not have, render
+// as their schema default, or as the empty string. Parameters that the schema does not declare are an error, which is
+// reported when the metadata is loaded.
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+func templateData(info EntitlementInfo, schema map[string]interface{}) map[string]interface{} {
+	parameters := map[string]interface{}{}
+	properties, _ := schema["properties"].(map[string]interface{})
+	for name, property := range properties {
+		parameters[name] = ""
+		if property, ok := property.(map[string]interface{}); ok && property["default"] != nil {
+			parameters[name] = property["default"]
+		}
+	}
+	for name, value := range info.Parameters {
+		parameters[name] = value
+	}
+
+	return map[string]interface{}{
+		"entitlementId": info.Id,
+		"accountId":     info.AccountId,
+		"serviceId":     info.ServiceId,
+		"planId":        info.PlanId,
+		"parameters":    parameters,
+	}
+}
+
+// renderTemplate renders the template against the given entitlement, whose parameters are described by the given
+// input parameter schema.
+func renderTemplate(
+	name string, text string, info EntitlementInfo, schema map[string]interface{}) (string, error) {
+
+	t, err := parseTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+	err = t.Execute(&buffer, templateData(info, schema))
+	if err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// trialRenderTemplate renders the template against an entitlement on the given plan that has none of its parameters,
+// so that templates that cannot be rendered are rejected when the metadata is loaded.
+func trialRenderTemplate(name string, text string, serviceId string, planDef PlanDefinition) error {
+	_, err := renderTemplate(name, text, EntitlementInfo{
+		Id:        "entitlement",
+		ServiceId: serviceId,
+		PlanId:    planDef.PlanId,
+		AccountId: "account",
+	}, planDef.InputParameterSchema)
+	return err
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmemory
+
+import (
+	"procurementlistenerservice/model"
+	"testing"
+)
+
+// optionalParameterSchema declares a required "size" parameter, and an optional "region" parameter with a default
+// and an optional "zone" parameter without one.
+var optionalParameterSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"size":   map[string]interface{}{"type": "integer"},
+		"region": map[string]interface{}{"type": "string", "default": "us"},
+		"zone":   map[string]interface{}{"type": "string"},
+	},
+	"required": []interface{}{"size"},
+}
+
+func TestLabelsWithOptionalParameters(t *testing.T) {
+	metadata := Metadata{
+		Services: []ServiceDefinition{
+			{ServiceId: "S1", Plans: []PlanDefinition{
+				{
+					PlanId:               "P1",
+					InputParameterSchema: optionalParameterSchema,
+					Labels: map[string]string{
+						"location": "{{.parameters.region}}/{{.parameters.zone}}",
+						"size":     "{{.parameters.size}}",
+					},
+				},
+			}},
+		},
+	}
+	err := metadata.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := createEvent("1", "E1", "P1")
+	e.Parameters = map[string]interface{}{"size": 3}
+	response, err := CreateService(metadata).OnEntitlementEvent(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != model.RESPONSESTATUS_ACCEPTED {
+		t.Fatalf("Unexpected status: '%v'", response.Status)
+	}
+	if response.Labels["location"] != "us/" || response.Labels["size"] != "3" {
+		t.Errorf("Unexpected labels: '%v'", response.Labels)
+	}
+}
+
+func TestInvalidLabelTemplates(t *testing.T) {
+	for _, text := range []string{
+		"{{.parameters.region",
+		"{{.parameters.undeclared}}",
+		"{{.unknown}}",
+	} {
+		metadata := Metadata{
+			Services: []ServiceDefinition{
+				{ServiceId: "S1", Plans: []PlanDefinition{
+					{PlanId: "P1", InputParameterSchema: optionalParameterSchema, Labels: map[string]string{"l": text}},
+				}},
+			},
+		}
+		if metadata.Validate() == nil {
+			t.Errorf("Expected an error for label template '%s'.", text)
+		}
+	}
+}
+
+func TestDashboardUrlWithOptionalParameters(t *testing.T) {
+	metadata := Metadata{
+		Services: []ServiceDefinition{
+			{ServiceId: "S1", DashboardUrl: "https://example.com/{{.entitlementId}}?zone={{.parameters.zone}}",
+				Plans: []PlanDefinition{{PlanId: "P1", InputParameterSchema: optionalParameterSchema}}},
+		},
+	}
+	err := metadata.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := createEvent("1", "E1", "P1")
+	e.Parameters = map[string]interface{}{"size": 3}
+	response, err := CreateService(metadata).OnEntitlementEvent(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.EntitlementDashboardUrl != "https://example.com/E1?zone=" {
+		t.Errorf("Unexpected dashboard url: '%s'", response.EntitlementDashboardUrl)
+	}
+}
+
+func TestInvalidDashboardUrlTemplates(t *testing.T) {
+	for _, text := range []string{
+		"https://example.com/{{.parameters.undeclared}}",
+		"https://example.com/{{.unknown}}",
+	} {
+		metadata := Metadata{
+			Services: []ServiceDefinition{
+				{ServiceId: "S1", DashboardUrl: text,
+					Plans: []PlanDefinition{{PlanId: "P1", InputParameterSchema: optionalParameterSchema}}},
+			},
+		}
+		if metadata.Validate() == nil {
+			t.Errorf("Expected an error for dashboard url template '%s'.", text)
+		}
+	}
+}
+
+func TestDashboardUrlFailureDoesNotChangeEntitlement(t *testing.T) {
+	// The metadata is not validated, so that the dashboard url of P2 fails to render.
+	service := CreateService(Metadata{
+		Services: []ServiceDefinition{
+			{ServiceId: "S1", Plans: []PlanDefinition{
+				{PlanId: "P1", AllowedPlanChanges: []string{"P2"}},
+				{PlanId: "P2", DashboardUrl: "https://example.com/{{.parameters.host}}"},
+			}},
+		},
+	})
+
+	_, err := service.OnEntitlementEvent(createEvent("1", "E1", "P2"))
+	if err == nil {
+		t.Error("Expected an error for a dashboard url that cannot be rendered.")
+	}
+	if entitlements, _ := service.ListEntitlements(); len(entitlements) != 0 {
+		t.Errorf("Entitlement was stored despite the error: '%+v'", entitlements)
+	}
+
+	_, err = service.OnEntitlementEvent(createEvent("2", "E2", "P1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := createEvent("3", "E2", "P2")
+	update.EventType = model.ENTITLEMENT_UPDATED
+	_, err = service.OnEntitlementEvent(update)
+	if err == nil {
+		t.Error("Expected an error for a dashboard url that cannot be rendered.")
+	}
+	if entitlements, _ := service.ListEntitlements(); len(entitlements) != 1 || entitlements[0].PlanId != "P1" {
+		t.Errorf("Entitlement was changed despite the error: '%+v'", entitlements)
+	}
+}
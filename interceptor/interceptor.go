@@ -0,0 +1,172 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package interceptor contains a composable decorator mechanism around model.PartnerBackendService, along with the
+// built-in interceptors for logging, timing, panic recovery and validation.
+package interceptor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"procurementlistenerservice/model"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Handler is the function form of a context-aware backend.
+type Handler func(ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error)
+
+// Interceptor decorates a Handler. An interceptor can inspect or modify the event before passing it on to next, and
+// the response after next returns, or it can short-circuit the call altogether.
+type Interceptor func(next Handler) Handler
+
+// chain is a backend that runs a list of interceptors around another backend.
+type chain struct {
+	handler Handler
+}
+
+var _ model.PartnerBackendService = chain{}
+var _ model.ContextPartnerBackendService = chain{}
+
+func (c chain) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return c.handler(context.Background(), e)
+}
+
+func (c chain) OnEntitlementEventContext(
+	ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+
+	return c.handler(ctx, e)
+}
+
+// Chain returns a backend that runs the given interceptors around the backend. The first interceptor is the
+// outermost one, i.e. it sees the event first and the response last.
+func Chain(backend model.PartnerBackendService, interceptors ...Interceptor) model.PartnerBackendService {
+	handler := Handler(model.AdaptContext(backend).OnEntitlementEventContext)
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		handler = interceptors[i](handler)
+	}
+	return chain{handler: handler}
+}
+
+// Logging logs every event, and the outcome of handling it.
+func Logging() Interceptor {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+			log.Printf("Handling entitlement event: '%+v'\n", e)
+			response, err := next(ctx, e)
+			if err != nil {
+				log.Printf("Entitlement event failed: eventId='%s' error='%v'\n", e.EventId, err)
+			} else {
+				log.Printf("Entitlement event handled: eventId='%s' status='%v'\n", e.EventId, response.Status)
+			}
+			return response, err
+		}
+	}
+}
+
+// TimingRecorder receives the time that it took to handle an event.
+type TimingRecorder func(e model.EntitlementEvent, response model.EntitlementEventResponse, err error,
+	elapsed time.Duration)
+
+// Timing measures the time that it takes to handle each event, and reports it to the recorder. If the recorder is
+// nil, the timings are logged.
+func Timing(recorder TimingRecorder) Interceptor {
+	if recorder == nil {
+		recorder = logTiming
+	}
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+			start := time.Now()
+			response, err := next(ctx, e)
+			recorder(e, response, err, time.Since(start))
+			return response, err
+		}
+	}
+}
+
+func logTiming(e model.EntitlementEvent, response model.EntitlementEventResponse, err error, elapsed time.Duration) {
+	log.Printf("Entitlement event timing: eventId='%s' eventType='%s' status='%v' elapsed='%v'\n",
+		e.EventId, e.EventType, response.Status, elapsed)
+}
+
+// Recovery turns panics in the downstream handlers into errors, so that a faulty backend fails the event instead of
+// the whole process.
+func Recovery() Interceptor {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e model.EntitlementEvent) (response model.EntitlementEventResponse, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic while handling entitlement event '%s': '%v'\n%s", e.EventId, r, debug.Stack())
+					response = model.EntitlementEventResponse{}
+					err = fmt.Errorf("Panic while handling entitlement event: '%v'", r)
+				}
+			}()
+			return next(ctx, e)
+		}
+	}
+}
+
+// Validation checks the events with model.ValidateEntitlementEvent, and refuses the invalid ones without passing them
+// on.
+func Validation() Interceptor {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+			err := model.ValidateEntitlementEvent(e)
+			if err != nil {
+				return model.EntitlementEventResponse{}, err
+			}
+			return next(ctx, e)
+		}
+	}
+}
+
+// builtins are the interceptors that can be referred to by name in the configuration.
+var builtins = map[string]func() Interceptor{
+	"logging":    Logging,
+	"timing":     func() Interceptor { return Timing(nil) },
+	"recovery":   Recovery,
+	"validation": Validation,
+}
+
+// FromNames returns the built-in interceptors with the given names, in the same order. The available names are
+// "logging", "timing", "recovery" and "validation".
+func FromNames(names []string) ([]Interceptor, error) {
+	interceptors := make([]Interceptor, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		create, ok := builtins[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown interceptor: '%s'. Available interceptors: %s.", name, availableNames())
+		}
+		interceptors = append(interceptors, create())
+	}
+	return interceptors, nil
+}
+
+func availableNames() string {
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interceptor
+
+import (
+	"context"
+	"procurementlistenerservice/model"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type backendFunc func(e model.EntitlementEvent) (model.EntitlementEventResponse, error)
+
+func (f backendFunc) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return f(e)
+}
+
+var accept = backendFunc(func(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return model.EntitlementEventResponse{Status: model.RESPONSESTATUS_ACCEPTED, EventId: e.EventId}, nil
+})
+
+var validEvent = model.EntitlementEvent{
+	EventId:       "1",
+	EventType:     model.ENTITLEMENT_CREATED,
+	EntitlementId: "E1",
+	ServiceId:     "S1",
+	PlanId:        "P1",
+}
+
+// tracing returns an interceptor that appends its name to the trace, before and after calling the next handler.
+func tracing(name string, trace *[]string) Interceptor {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+			*trace = append(*trace, name+">")
+			response, err := next(ctx, e)
+			*trace = append(*trace, "<"+name)
+			return response, err
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var trace []string
+	backend := Chain(accept, tracing("a", &trace), tracing("b", &trace))
+
+	response, err := backend.OnEntitlementEvent(validEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != model.RESPONSESTATUS_ACCEPTED {
+		t.Errorf("Unexpected status: '%v'", response.Status)
+	}
+
+	expected := []string{"a>", "b>", "<b", "<a"}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Errorf("Unexpected order: actual='%v', expected='%v'", trace, expected)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	panicking := backendFunc(func(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+		panic("boom")
+	})
+
+	_, err := Chain(panicking, Recovery()).OnEntitlementEvent(validEvent)
+	if err == nil {
+		t.Error("Expected the panic to be turned into an error.")
+	}
+}
+
+func TestValidation(t *testing.T) {
+	called := false
+	backend := backendFunc(func(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+		called = true
+		return accept(e)
+	})
+
+	_, err := Chain(backend, Validation()).OnEntitlementEvent(model.EntitlementEvent{EventId: "1"})
+	if _, ok := err.(*model.ValidationError); !ok {
+		t.Errorf("Expected a validation error: '%v'", err)
+	}
+	if called {
+		t.Error("The backend should not be called for invalid events.")
+	}
+}
+
+func TestTiming(t *testing.T) {
+	var recorded []string
+	recorder := func(e model.EntitlementEvent, r model.EntitlementEventResponse, err error, elapsed time.Duration) {
+		recorded = append(recorded, e.EventId)
+	}
+
+	_, err := Chain(accept, Timing(recorder)).OnEntitlementEvent(validEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(recorded, []string{"1"}) {
+		t.Errorf("Unexpected recordings: '%v'", recorded)
+	}
+}
+
+func TestFromNames(t *testing.T) {
+	interceptors, err := FromNames([]string{"logging", " timing", "recovery", "validation", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interceptors) != 4 {
+		t.Errorf("Unexpected interceptor count: '%d'", len(interceptors))
+	}
+
+	_, err = FromNames([]string{"retry"})
+	if err == nil {
+		t.Error("Expected an error for an unknown interceptor.")
+	}
+}
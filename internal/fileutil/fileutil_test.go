@@ -0,0 +1,85 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutil
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAtomically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	for _, contents := range []string{"first", "second"} {
+		if err := WriteAtomically(path, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ioutil.ReadFile(path)
+		if err != nil || string(actual) != contents {
+			t.Errorf("Unexpected contents: actual='%s', expected='%s', err='%v'", actual, contents, err)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected temporary file: '%v'", err)
+	}
+}
+
+func TestJsonMapRollsBackFailedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "map", "state.json")
+	if err := os.Mkdir(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := OpenJsonMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the directory is gone, the changes can no longer be written, and are rolled back.
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Put("k2", "v2"); err == nil {
+		t.Error("Expected an error for an unwritable file.")
+	}
+	if err := m.Delete("k1"); err == nil {
+		t.Error("Expected an error for an unwritable file.")
+	}
+
+	var keys []string
+	m.Each(func(key string, value json.RawMessage) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != "k1" {
+		t.Errorf("Unexpected keys: actual='%v', expected='[k1]'", keys)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// JsonMap is a map of JSON values, keyed by string, that is kept in memory, and written through to a JSON file on
+// every change. A change that cannot be written is rolled back.
+type JsonMap struct {
+	path   string
+	mu     sync.RWMutex
+	values map[string]json.RawMessage
+}
+
+// OpenJsonMap opens the JsonMap that is backed by the file at the given path. The file is created on the first write,
+// if it doesn't exist.
+func OpenJsonMap(path string) (*JsonMap, error) {
+	m := &JsonMap{
+		path:   path,
+		values: make(map[string]json.RawMessage),
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, fmt.Errorf("Unable to read file: '%v'.", err)
+	}
+
+	if len(contents) != 0 {
+		err = json.Unmarshal(contents, &m.values)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse file '%s': '%v'.", path, err)
+		}
+	}
+
+	return m, nil
+}
+
+// Get decodes the value with the given key into value, and reports whether it exists.
+func (m *JsonMap) Get(key string, value interface{}) (bool, error) {
+	m.mu.RLock()
+	raw, found := m.values[key]
+	m.mu.RUnlock()
+
+	if !found {
+		return false, nil
+	}
+	err := json.Unmarshal(raw, value)
+	if err != nil {
+		return false, fmt.Errorf("Unable to parse value '%s': '%v'.", key, err)
+	}
+	return true, nil
+}
+
+// Put inserts or replaces the value with the given key. Replacing a value with an equal one does not write the file.
+func (m *JsonMap) Put(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, existed := m.values[key]
+	if existed && bytes.Equal(previous, raw) {
+		return nil
+	}
+	m.values[key] = raw
+
+	err = m.flush()
+	if err != nil {
+		if existed {
+			m.values[key] = previous
+		} else {
+			delete(m.values, key)
+		}
+	}
+	return err
+}
+
+// Delete removes the value with the given key. Deleting a non-existent value is not an error.
+func (m *JsonMap) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, existed := m.values[key]
+	if !existed {
+		return nil
+	}
+	delete(m.values, key)
+
+	err := m.flush()
+	if err != nil {
+		m.values[key] = previous
+	}
+	return err
+}
+
+// Each calls fn with each key and its encoded value, in the lexical order of the keys, until fn returns an error.
+func (m *JsonMap) Each(fn func(key string, value json.RawMessage) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		err := fn(key, m.values[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the current contents to the file.
+func (m *JsonMap) flush() error {
+	contents, err := json.MarshalIndent(m.values, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = WriteAtomically(m.path, contents)
+	if err != nil {
+		return fmt.Errorf("Unable to write file: '%v'.", err)
+	}
+	return nil
+}
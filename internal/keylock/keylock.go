@@ -0,0 +1,66 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keylock provides a set of mutexes keyed by string, so that the operations on the same key never interleave,
+// while the operations on different keys run in parallel.
+package keylock
+
+import (
+	"sync"
+)
+
+// Locks is a set of mutexes keyed by string. The mutex of a key only exists while it is held or waited for.
+type Locks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+
+	// waiters is the number of goroutines that hold or wait for the lock. The lock is discarded when it drops to zero.
+	waiters int
+}
+
+// CreateLocks creates a new, empty set of locks.
+func CreateLocks() *Locks {
+	return &Locks{
+		locks: make(map[string]*keyLock),
+	}
+}
+
+// Lock locks the given key, and returns the function that unlocks it.
+func (l *Locks) Lock(key string) func() {
+	l.mu.Lock()
+	lock, found := l.locks[key]
+	if !found {
+		lock = &keyLock{}
+		l.locks[key] = lock
+	}
+	lock.waiters++
+	l.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"procurementlistenerservice/inmemory"
+	"procurementlistenerservice/internal/fileutil"
+	"procurementlistenerservice/internal/keylock"
+	"procurementlistenerservice/model"
+	"sync"
+	"time"
+)
+
+// SNAPSHOT_VERSION is the version of the snapshot format. Version 1 encodes the entitlement states by name, where the
+// snapshots without a version encode them by number. Both are read.
+const SNAPSHOT_VERSION int = 1
+
+// Snapshot is the state of the entitlements after a given journal entry.
+type Snapshot struct {
+	// Version is the version of the snapshot format (SNAPSHOT_VERSION).
+	Version int `json:"version"`
+
+	// Sequence is the sequence number of the last journal entry that is reflected in the snapshot.
+	Sequence uint64 `json:"sequence"`
+
+	// Time is the time at which the snapshot was taken.
+	Time time.Time `json:"time"`
+
+	// Entitlements is the state of the entitlements.
+	Entitlements []inmemory.EntitlementInfo `json:"entitlements"`
+}
+
+// Backend is a PartnerBackendService that journals the events before they are applied to the service (write-ahead),
+// so that no applied event is missing from the journal after a crash. The events that the service rejects or fails to
+// handle are followed by an entry that aborts them, and are not replayed.
+type Backend struct {
+	// mu is held shared while an event is journaled and applied, and exclusively while a snapshot is taken, so that a
+	// snapshot reflects exactly the journal entries up to its sequence number.
+	mu sync.RWMutex
+
+	// locks serializes the events of each entitlement from the journal append to the end of their handling, so that
+	// the events are journaled in the order in which they are applied, and replay to the same state.
+	locks        *keylock.Locks
+	service      *inmemory.InMemoryService
+	journal      *Journal
+	snapshotPath string
+}
+
+var _ model.AsyncPartnerBackendService = &Backend{}
+
+// CreateBackend creates a new Backend that journals the events that the given service accepts. Snapshots are written
+// to the given path, if it is not empty.
+func CreateBackend(service *inmemory.InMemoryService, journal *Journal, snapshotPath string) *Backend {
+	return &Backend{
+		locks:        keylock.CreateLocks(),
+		service:      service,
+		journal:      journal,
+		snapshotPath: snapshotPath,
+	}
+}
+
+func (b *Backend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	defer b.lock(e.EntitlementId)()
+
+	entry, err := b.journal.Append(e, "")
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	response, err := b.service.OnEntitlementEvent(e)
+	if err != nil || response.Status == model.RESPONSESTATUS_REJECTED {
+		return b.abort(entry, response, err)
+	}
+	return response, nil
+}
+
+func (b *Backend) OnEntitlementEventCompleted(
+	e model.EntitlementEvent, status model.ResponseStatus) (model.EntitlementEventResponse, error) {
+
+	defer b.lock(e.EntitlementId)()
+
+	entry, err := b.journal.Append(e, status.String())
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	response, err := b.service.OnEntitlementEventCompleted(e, status)
+	if err != nil {
+		return b.abort(entry, response, err)
+	}
+	return response, nil
+}
+
+// EntitlementOwner returns the account of the entitlement with the given id, from the service.
+func (b *Backend) EntitlementOwner(entitlementId string) (string, bool, error) {
+	return b.service.EntitlementOwner(entitlementId)
+}
+
+// lock serializes the journaling and handling of the events of the given entitlement, and returns the function that
+// ends it.
+func (b *Backend) lock(entitlementId string) func() {
+	b.mu.RLock()
+	unlock := b.locks.Lock(entitlementId)
+	return func() {
+		unlock()
+		b.mu.RUnlock()
+	}
+}
+
+// abort records that the given entry was not applied, and returns the service's response and error. If the abort
+// cannot be journaled, the event is failed, so that it is redelivered.
+func (b *Backend) abort(
+	entry Entry, response model.EntitlementEventResponse, err error) (model.EntitlementEventResponse, error) {
+
+	abortErr := b.journal.Abort(entry)
+	if abortErr != nil {
+		log.Printf("Unable to abort journal entry '%d': '%v'\n", entry.Sequence, abortErr)
+		return model.EntitlementEventResponse{}, abortErr
+	}
+	return response, err
+}
+
+// Snapshot writes the current state of the entitlements to the snapshot file, along with the sequence number of the
+// last journal entry.
+func (b *Backend) Snapshot() error {
+	if b.snapshotPath == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	entitlements, err := b.service.ListEntitlements()
+	sequence := b.journal.Sequence()
+	b.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("Unable to list entitlements: '%v'.", err)
+	}
+
+	return WriteSnapshot(b.snapshotPath, Snapshot{
+		Version:      SNAPSHOT_VERSION,
+		Sequence:     sequence,
+		Time:         time.Now().UTC(),
+		Entitlements: entitlements,
+	})
+}
+
+// RunSnapshots takes a snapshot at the given interval, until the given channel is closed.
+func (b *Backend) RunSnapshots(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := b.Snapshot()
+			if err != nil {
+				log.Printf("Unable to take snapshot: '%v'\n", err)
+			}
+		}
+	}
+}
+
+// Restore rebuilds the state of the given service: the snapshot at the given path is loaded into the service's
+// store, if it exists, and the journal entries that follow it are replayed. The service's store is expected to be
+// empty. It returns the number of replayed entries.
+func Restore(journalPath string, snapshotPath string, service *inmemory.InMemoryService) (int, error) {
+	var after uint64
+	if snapshotPath != "" {
+		snapshot, err := ReadSnapshot(snapshotPath)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if err == nil {
+			err = service.RestoreEntitlements(snapshot.Entitlements)
+			if err != nil {
+				return 0, err
+			}
+			after = snapshot.Sequence
+			log.Printf("Restored '%d' entitlements from snapshot at journal entry '%d'\n",
+				len(snapshot.Entitlements), after)
+		}
+	}
+
+	if _, err := os.Stat(journalPath); os.IsNotExist(err) {
+		return 0, nil
+	}
+	return Replay(journalPath, after, service)
+}
+
+// Replay applies the entries of the journal at the given path, whose sequence number is greater than after, to the
+// given service. Aborted entries are skipped. Entries that the service now rejects (e.g. because the metadata has
+// changed) are logged and skipped. The replay continues past the entries that the service fails to handle, and then
+// returns an error. It returns the number of replayed entries, which excludes the failed ones.
+func Replay(path string, after uint64, service model.AsyncPartnerBackendService) (int, error) {
+	aborted := map[uint64]bool{}
+	err := ReadFile(path, after, func(entry Entry) error {
+		if entry.Aborts != 0 {
+			aborted[entry.Aborts] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	failed := 0
+	var firstErr error
+	err = ReadFile(path, after, func(entry Entry) error {
+		if entry.Aborts != 0 || aborted[entry.Sequence] {
+			return nil
+		}
+
+		var response model.EntitlementEventResponse
+		var err error
+		if entry.Completion == "" {
+			response, err = service.OnEntitlementEvent(entry.Event)
+		} else {
+			var status model.ResponseStatus
+			status, err = model.ParseResponseStatus(entry.Completion)
+			if err == nil {
+				response, err = service.OnEntitlementEventCompleted(entry.Event, status)
+			}
+		}
+
+		if err != nil {
+			log.Printf("Unable to replay journal entry '%d': '%v'\n", entry.Sequence, err)
+			if failed == 0 {
+				firstErr = err
+			}
+			failed++
+			return nil
+		}
+		if response.Status == model.RESPONSESTATUS_REJECTED && entry.Completion == "" {
+			log.Printf("Journal entry '%d' was rejected on replay: '%+v'\n", entry.Sequence, response.Reason)
+		}
+		replayed++
+		return nil
+	})
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("Unable to replay '%d' journal entries: '%v'.", failed, firstErr)
+	}
+	return replayed, err
+}
+
+// ReadSnapshot reads the snapshot at the given path. If the snapshot does not exist, the returned error satisfies
+// os.IsNotExist.
+func ReadSnapshot(path string) (Snapshot, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	var header struct {
+		Version int `json:"version"`
+	}
+	err = json.Unmarshal(contents, &header)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("Unable to parse snapshot: '%v'.", err)
+	}
+	if header.Version > SNAPSHOT_VERSION {
+		return Snapshot{}, fmt.Errorf("Snapshot '%s' has format version '%d', but this service reads up to version "+
+			"'%d'.", path, header.Version, SNAPSHOT_VERSION)
+	}
+
+	var snapshot Snapshot
+	err = json.Unmarshal(contents, &snapshot)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("Unable to parse snapshot: '%v'.", err)
+	}
+	return snapshot, nil
+}
+
+// WriteSnapshot writes the given snapshot to a temporary file, and atomically renames it over the given path, so
+// that a crash never leaves a partially written snapshot behind.
+func WriteSnapshot(path string, snapshot Snapshot) error {
+	contents, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = fileutil.WriteAtomically(path, contents)
+	if err != nil {
+		return fmt.Errorf("Unable to write snapshot: '%v'.", err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package journal keeps an append-only journal of the entitlement events that were accepted, from which the state of
+// the entitlements can be rebuilt by replaying the events. It serves both as an audit trail and for disaster
+// recovery. Periodic snapshots of the state shorten the replay on startup.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"procurementlistenerservice/model"
+	"sync"
+	"time"
+)
+
+// Entry is a single record of the journal.
+type Entry struct {
+	// Sequence is the position of the entry in the journal, starting from 1.
+	Sequence uint64 `json:"sequence"`
+
+	// Time is the time at which the entry was appended.
+	Time time.Time `json:"time"`
+
+	// Event is the event that was accepted.
+	Event model.EntitlementEvent `json:"event"`
+
+	// Completion is set for the completions of asynchronously handled events, to the status of the completion.
+	Completion string `json:"completion,omitempty"`
+
+	// Aborts is set on the entries that record that the entry with the given sequence number was not applied, because
+	// the service rejected or failed to handle its event. The Event of such entries is empty.
+	Aborts uint64 `json:"aborts,omitempty"`
+}
+
+// Journal is an append-only file of entries, one JSON object per line. Every entry is synced to disk before Append
+// returns.
+type Journal struct {
+	mu       sync.Mutex
+	file     *os.File
+	sequence uint64
+}
+
+// Open opens the journal at the given path, creating it if it does not exist. An incomplete last entry, as left
+// behind by a crash during a write, is removed.
+func Open(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open journal: '%v'.", err)
+	}
+
+	var sequence uint64
+	var end int64
+	err = readEntries(file, func(e Entry, offset int64) error {
+		sequence = e.Sequence
+		end = offset
+		return nil
+	})
+	if err == nil {
+		// Drop anything after the last complete entry, and continue appending from there.
+		err = file.Truncate(end)
+	}
+	if err == nil {
+		_, err = file.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to read journal: '%v'.", err)
+	}
+
+	return &Journal{file: file, sequence: sequence}, nil
+}
+
+// Append appends an entry for the given event to the journal. The completion is the status of the completion, if
+// the entry records the completion of an asynchronously handled event, and empty otherwise.
+func (j *Journal) Append(e model.EntitlementEvent, completion string) (Entry, error) {
+	return j.append(Entry{Event: e, Completion: completion})
+}
+
+// Abort appends an entry that records that the given entry was not applied.
+func (j *Journal) Abort(aborted Entry) error {
+	_, err := j.append(Entry{Aborts: aborted.Sequence})
+	return err
+}
+
+// append assigns the next sequence number and the current time to the given entry, and appends it to the journal.
+func (j *Journal) append(entry Entry) (Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry.Sequence = j.sequence + 1
+	entry.Time = time.Now().UTC()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("Unable to append to journal: '%v'.", err)
+	}
+
+	j.sequence = entry.Sequence
+	return entry, nil
+}
+
+// Sequence returns the sequence number of the last entry of the journal.
+func (j *Journal) Sequence() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.sequence
+}
+
+// Close closes the journal.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// ReadFile calls fn for each entry of the journal at the given path whose sequence number is greater than after, in
+// order.
+func ReadFile(path string, after uint64, fn func(Entry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to open journal: '%v'.", err)
+	}
+	defer file.Close()
+
+	return readEntries(file, func(e Entry, _ int64) error {
+		if e.Sequence <= after {
+			return nil
+		}
+		return fn(e)
+	})
+}
+
+// readEntries calls fn for each complete entry in the given file, along with the offset at which the entry ends. An
+// incomplete last line is ignored, but any other malformed line is an error.
+func readEntries(r io.Reader, fn func(e Entry, offset int64) error) error {
+	reader := bufio.NewReader(r)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var e Entry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return fmt.Errorf("Malformed journal entry ending at offset '%d': '%v'.", offset, err)
+		}
+		err = fn(e, offset)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"procurementlistenerservice/inmemory"
+	"procurementlistenerservice/model"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+var metadata = inmemory.Metadata{
+	Services: []inmemory.ServiceDefinition{
+		{
+			ServiceId: "S1",
+			Plans: []inmemory.PlanDefinition{
+				{PlanId: "P1", AllowedPlanChanges: []string{"P2"}},
+				{PlanId: "P2", AllowedPlanChanges: []string{"P1"}},
+				{PlanId: "Async", AsyncProvisioning: true},
+			},
+		},
+	},
+}
+
+func created(eventId string, entitlementId string, planId string) model.EntitlementEvent {
+	return model.EntitlementEvent{
+		EventId:       eventId,
+		EventType:     model.ENTITLEMENT_CREATED,
+		EntitlementId: entitlementId,
+		ServiceId:     "S1",
+		PlanId:        planId,
+		AccountId:     "A1",
+	}
+}
+
+func transition(eventId string, entitlementId string, eventType model.EntitlementEventType) model.EntitlementEvent {
+	return model.EntitlementEvent{EventId: eventId, EventType: eventType, EntitlementId: entitlementId}
+}
+
+// handle sends the given events to the backend, and returns the resulting entitlements.
+func handle(t *testing.T, b *Backend, service *inmemory.InMemoryService) []inmemory.EntitlementInfo {
+	for _, e := range []model.EntitlementEvent{
+		created("1", "E1", "P1"),
+		created("2", "E2", "Async"),
+		transition("3", "E1", model.ENTITLEMENT_CANCELLED),
+		transition("4", "E3", model.ENTITLEMENT_CANCELLED), // Rejected, and aborted in the journal.
+	} {
+		if _, err := b.OnEntitlementEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.OnEntitlementEventCompleted(created("2", "E2", "Async"), model.RESPONSESTATUS_ACCEPTED); err != nil {
+		t.Fatal(err)
+	}
+
+	entitlements, err := service.ListEntitlements()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entitlements
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.log")
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := inmemory.CreateService(metadata)
+	expected := handle(t, CreateBackend(service, j, ""), service)
+	j.Close()
+
+	// A crash in the middle of a write leaves an incomplete entry behind.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"sequence": 7, "event": {"eventId":`)
+	f.Close()
+
+	replayed := inmemory.CreateService(metadata)
+	count, err := Replay(path, 0, replayed)
+	if err != nil || count != 4 {
+		t.Fatalf("Unexpected replay: count='%d' err='%v'", count, err)
+	}
+	actual, _ := replayed.ListEntitlements()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected entitlements after replay: actual='%+v' expected='%+v'", actual, expected)
+	}
+
+	// Reopening the journal drops the incomplete entry, and continues the sequence.
+	j, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	entry, err := j.Append(transition("6", "E1", model.ENTITLEMENT_REACTIVATED), "")
+	if err != nil || entry.Sequence != 7 {
+		t.Fatalf("Unexpected entry: '%+v' '%v'", entry, err)
+	}
+	if err := ReadFile(path, 6, func(e Entry) error {
+		if e.Event.EventId != "6" {
+			t.Errorf("Unexpected entry: '%+v'", e)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.log")
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	// The service fails to handle an unknown event type, but only the aborted entry is skipped without an error.
+	aborted, _ := j.Append(transition("1", "E1", "ENTITLEMENT_UNKNOWN"), "")
+	j.Abort(aborted)
+	j.Append(created("2", "E1", "P1"), "")
+	j.Append(transition("3", "E1", "ENTITLEMENT_UNKNOWN"), "")
+	j.Append(transition("4", "E1", model.ENTITLEMENT_CANCELLED), "")
+
+	replayed := inmemory.CreateService(metadata)
+	count, err := Replay(path, 0, replayed)
+	if err == nil || count != 2 {
+		t.Fatalf("Unexpected replay: count='%d' err='%v'", count, err)
+	}
+	actual, _ := replayed.ListEntitlements()
+	if len(actual) != 1 || actual[0].State != inmemory.CANCELLED {
+		t.Errorf("Unexpected entitlements after replay: '%+v'", actual)
+	}
+}
+
+func TestJournalBeforeApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.log")
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := inmemory.CreateService(metadata)
+	b := CreateBackend(service, j, "")
+
+	// A journal that cannot be written fails the event before the service applies it.
+	j.Close()
+	if _, err := b.OnEntitlementEvent(created("1", "E1", "P1")); err == nil {
+		t.Fatal("Expected an error for a closed journal.")
+	}
+	entitlements, _ := service.ListEntitlements()
+	if len(entitlements) != 0 {
+		t.Errorf("Unexpected entitlements: '%+v'", entitlements)
+	}
+}
+
+func TestConcurrentEventsReplayInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.log")
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	service := inmemory.CreateService(metadata)
+	b := CreateBackend(service, j, "")
+
+	// The outcome of each event depends on the events of the same entitlement before it, so the replay only reaches
+	// the same state if the events were journaled in the order in which they were applied.
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		id := "E" + strconv.Itoa(i)
+		if _, err := b.OnEntitlementEvent(created(id+"-0", id, "P1")); err != nil {
+			t.Fatal(err)
+		}
+
+		upgrade := transition(id+"-1", id, model.ENTITLEMENT_UPDATED)
+		upgrade.PlanId = "P2"
+		downgrade := transition(id+"-4", id, model.ENTITLEMENT_UPDATED)
+		downgrade.PlanId = "P1"
+		for _, e := range []model.EntitlementEvent{
+			upgrade,
+			transition(id+"-2", id, model.ENTITLEMENT_CANCELLED),
+			transition(id+"-3", id, model.ENTITLEMENT_REACTIVATED),
+			downgrade,
+		} {
+			wg.Add(1)
+			go func(e model.EntitlementEvent) {
+				defer wg.Done()
+				if _, err := b.OnEntitlementEvent(e); err != nil {
+					t.Error(err)
+				}
+			}(e)
+		}
+	}
+	wg.Wait()
+	expected, _ := service.ListEntitlements()
+
+	replayed := inmemory.CreateService(metadata)
+	if _, err := Replay(path, 0, replayed); err != nil {
+		t.Fatal(err)
+	}
+	actual, _ := replayed.ListEntitlements()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected entitlements after replay: actual='%+v' expected='%+v'", actual, expected)
+	}
+}
+
+func TestRestoreFromSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.log")
+	snapshotPath := filepath.Join(dir, "journal.log.snapshot")
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	service := inmemory.CreateService(metadata)
+	b := CreateBackend(service, j, snapshotPath)
+	handle(t, b, service)
+
+	if err := b.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.OnEntitlementEvent(transition("5", "E2", model.ENTITLEMENT_DELETED)); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := service.ListEntitlements()
+
+	// Only the entries after the snapshot are replayed.
+	restored := inmemory.CreateService(metadata)
+	count, err := Restore(path, snapshotPath, restored)
+	if err != nil || count != 1 {
+		t.Fatalf("Unexpected restore: count='%d' err='%v'", count, err)
+	}
+	actual, _ := restored.ListEntitlements()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected entitlements after restore: actual='%+v' expected='%+v'", actual, expected)
+	}
+}
+
+func TestReadUnversionedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.log.snapshot")
+
+	// Snapshots without a version encode the states by number.
+	contents := `{"sequence": 3, "entitlements": [{"id": "E1", "state": 2, "serviceId": "S1", "planId": "P1"}]}`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := ReadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Entitlements) != 1 || snapshot.Entitlements[0].State != inmemory.CANCELLED {
+		t.Errorf("Unexpected entitlements: '%+v'", snapshot.Entitlements)
+	}
+}
@@ -15,28 +15,159 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"procurementlistenerservice/async"
+	"procurementlistenerservice/auth"
+	"procurementlistenerservice/boltstore"
+	"procurementlistenerservice/execplugin"
+	"procurementlistenerservice/forwarding"
 	"procurementlistenerservice/inmemory"
+	"procurementlistenerservice/interceptor"
+	"procurementlistenerservice/journal"
+	"procurementlistenerservice/model"
+	"procurementlistenerservice/owners"
+	"procurementlistenerservice/routing"
 	"procurementlistenerservice/server"
+	"procurementlistenerservice/shadow"
+	"procurementlistenerservice/sqlitestore"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // Options contains the options for the service.
 type Options struct {
-	Port         int
-	MetadataFile string
+	Port                   int
+	PathPrefix             string
+	MetadataFile           string
+	PendingEventsFile      string
+	MarketplaceCallbackUrl string
+	RequestTimeout         time.Duration
+	Interceptors           string
+	RoutesFile             string
+	RouteOwnersFile        string
+	ForwardingUrl          string
+	ForwardingTimeout      time.Duration
+	CommandsFile           string
+	ExecOwnersFile         string
+	ShadowBackend          string
+	ShadowStore            string
+	ShadowStoreFile        string
+	DiffLogFile            string
+	Store                  string
+	StoreFile              string
+	BackupEndpoint         bool
+	JournalFile            string
+	SnapshotInterval       time.Duration
+	SnapshotFile           string
+	ReplayJournal          string
+	ShutdownTimeout        time.Duration
+	SignatureKeysFile      string
+	SignatureMaxSkew       time.Duration
+	JwksFile               string
+	JwtIssuer              string
+	JwtAudience            string
+	JwtAccountClaim        string
+	TlsCertFile            string
+	TlsKeyFile             string
+	TlsClientCaFile        string
+	TlsRequireClientCert   bool
+	TlsAllowedClientNames  string
 }
 
 var options Options
 
 func init() {
 	flag.IntVar(&options.Port, "port", 11000, "use '--port' option to specify the port for service to listen on")
+	flag.StringVar(&options.PathPrefix, "pathPrefix", "", "use '--pathPrefix' option to serve all endpoints under "+
+		"the given path prefix (e.g. '/procurement')")
 	flag.StringVar(&options.MetadataFile, "metadataFile", "metadata.json", "use '--metadataFile'"+
 		"option to specify the metadata file that contains service definitions")
+	flag.StringVar(&options.PendingEventsFile, "pendingEventsFile", "pending.json", "use '--pendingEventsFile' "+
+		"option to specify the file that records the events that are being handled asynchronously")
+	flag.StringVar(&options.MarketplaceCallbackUrl, "marketplaceCallbackUrl", "", "use '--marketplaceCallbackUrl' "+
+		"option to specify the marketplace endpoint that is notified when asynchronous events are completed")
+	flag.DurationVar(&options.RequestTimeout, "requestTimeout", server.DEFAULT_REQUEST_TIMEOUT, "use "+
+		"'--requestTimeout' option to specify the time the backend is given to handle an event (0 disables it)")
+	flag.StringVar(&options.Interceptors, "interceptors", "recovery", "use '--interceptors' option to specify a "+
+		"comma separated list of interceptors to run around the backend (logging, timing, recovery, validation)")
+	flag.StringVar(&options.RoutesFile, "routesFile", "", "use '--routesFile' option to specify the file that "+
+		"routes events to backends by service and plan (defaults to routes.json next to the metadata file, if any)")
+	flag.StringVar(&options.RouteOwnersFile, "routeOwnersFile", "routeOwners.json", "use '--routeOwnersFile' "+
+		"option to specify the file that records the backend that each entitlement was routed to")
+	flag.StringVar(&options.ForwardingUrl, "forwardingUrl", "", "use '--forwardingUrl' option to specify an upstream "+
+		"url that events are forwarded to (as the 'forwarding' backend, or for all events if there are no routes)")
+	flag.DurationVar(&options.ForwardingTimeout, "forwardingTimeout", forwarding.DEFAULT_TIMEOUT, "use "+
+		"'--forwardingTimeout' option to specify the timeout of a single call to the forwarding upstream")
+	flag.StringVar(&options.CommandsFile, "commandsFile", "", "use '--commandsFile' option to specify the file that "+
+		"configures the commands that handle events (as the 'exec' backend, or for all events if there are no routes)")
+	flag.StringVar(&options.ExecOwnersFile, "execOwnersFile", "execOwners.json", "use '--execOwnersFile' option "+
+		"to specify the file that records the service and plan of the entitlements that the commands handle")
+	flag.StringVar(&options.ShadowBackend, "shadowBackend", "", "use '--shadowBackend' option to specify a backend "+
+		"(inmemory, store, forwarding or exec) that also receives all events, to compare its responses with the "+
+		"primary's")
+	flag.StringVar(&options.ShadowStore, "shadowStore", "", "use '--shadowStore' option to run a second in-memory "+
+		"service on the given entitlement store (memory, sqlite or bolt) as the 'store' shadow backend")
+	flag.StringVar(&options.ShadowStoreFile, "shadowStoreFile", "shadow.db", "use '--shadowStoreFile' option to "+
+		"specify the database file of a persistent shadow store")
+	flag.StringVar(&options.DiffLogFile, "diffLogFile", "diff.log", "use '--diffLogFile' option to specify the "+
+		"file that records the mismatches between the primary and the shadow backends")
+	flag.StringVar(&options.Store, "store", "memory", "use '--store' option to specify where the entitlements are "+
+		"kept (memory, sqlite or bolt)")
+	flag.StringVar(&options.StoreFile, "storeFile", "entitlements.db", "use '--storeFile' option to specify the "+
+		"database file of persistent entitlement stores")
+	flag.BoolVar(&options.BackupEndpoint, "backupEndpoint", false, "use '--backupEndpoint' option to serve a copy "+
+		"of the bolt store at /backup, which requires '--jwksFile', '--signatureKeysFile' or required client "+
+		"certificates")
+	flag.StringVar(&options.JournalFile, "journalFile", "", "use '--journalFile' option to specify the file that "+
+		"journals the accepted events, from which the entitlements are rebuilt on startup")
+	flag.DurationVar(&options.SnapshotInterval, "snapshotInterval", 5*time.Minute, "use '--snapshotInterval' "+
+		"option to specify how often the entitlements are snapshotted, with '--snapshotFile' or '--journalFile'")
+	flag.StringVar(&options.SnapshotFile, "snapshotFile", "", "use '--snapshotFile' option to specify the file "+
+		"that the entitlements are snapshotted to on shutdown and periodically, and restored from on startup "+
+		"(not with '--journalFile')")
+	flag.StringVar(&options.ReplayJournal, "replayJournal", "", "use '--replayJournal' option to replay the given "+
+		"journal into a fresh entitlement store (as selected by '--store'), and exit")
+	flag.DurationVar(&options.ShutdownTimeout, "shutdownTimeout", 30*time.Second, "use '--shutdownTimeout' option to "+
+		"specify how long in-flight requests are given to finish on SIGTERM, before the backend state is flushed")
+	flag.StringVar(&options.SignatureKeysFile, "signatureKeysFile", "", "use '--signatureKeysFile' option to "+
+		"require entitlement events to be signed with one of the keys in the given file, which is re-read on SIGHUP")
+	flag.DurationVar(&options.SignatureMaxSkew, "signatureMaxSkew", auth.DEFAULT_MAX_SKEW, "use "+
+		"'--signatureMaxSkew' option to specify how far the timestamp of a signed event may be from the local clock")
+	flag.StringVar(&options.JwksFile, "jwksFile", "", "use '--jwksFile' option to require entitlement events to carry "+
+		"a bearer token that is signed with one of the keys in the given JWKS file, which is re-read on SIGHUP")
+	flag.StringVar(&options.JwtIssuer, "jwtIssuer", "", "use '--jwtIssuer' option to specify the required issuer of "+
+		"the bearer tokens")
+	flag.StringVar(&options.JwtAudience, "jwtAudience", "", "use '--jwtAudience' option to specify the required "+
+		"audience of the bearer tokens")
+	flag.StringVar(&options.JwtAccountClaim, "jwtAccountClaim", "", "use '--jwtAccountClaim' option to refuse "+
+		"entitlement events for entitlements that are not owned by the account in the given claim of the bearer token")
+	flag.StringVar(&options.TlsCertFile, "tlsCertFile", "", "use '--tlsCertFile' option to serve TLS with the given "+
+		"PEM certificate (chain), which is reloaded when it changes")
+	flag.StringVar(&options.TlsKeyFile, "tlsKeyFile", "", "use '--tlsKeyFile' option to specify the PEM private key "+
+		"of the TLS certificate")
+	flag.StringVar(&options.TlsClientCaFile, "tlsClientCaFile", "", "use '--tlsClientCaFile' option to verify client "+
+		"certificates against the CAs in the given PEM bundle")
+	flag.BoolVar(&options.TlsRequireClientCert, "tlsRequireClientCert", false, "use '--tlsRequireClientCert' option "+
+		"to reject clients without a valid certificate")
+	flag.StringVar(&options.TlsAllowedClientNames, "tlsAllowedClientNames", "", "use '--tlsAllowedClientNames' "+
+		"option to specify a comma separated list of the subject or DNS names that client certificates must carry "+
+		"(implies '--tlsRequireClientCert')")
 	flag.Parse()
 }
 
 func main() {
+	if options.SnapshotFile != "" && options.JournalFile != "" {
+		log.Fatal("The '--snapshotFile' and '--journalFile' options cannot be combined, the journal keeps its own " +
+			"snapshots.")
+	}
 
 	metadata, err := inmemory.ReadMetadataFile(options.MetadataFile)
 	if err != nil {
@@ -47,9 +178,450 @@ func main() {
 	log.Println("Loaded metadata:")
 	log.Printf("%+v\n", metadata)
 
-	s, err := server.CreateServer(options.Port, inmemory.CreateService(metadata))
+	store, err := createStore(options.Store, options.StoreFile)
+	if err != nil {
+		log.Fatalf("Error opening entitlement store: '%v'\n", err)
+	}
+
+	if closer, ok := store.(io.Closer); ok {
+		onShutdown(closer.Close)
+	}
+
+	service := inmemory.CreateServiceWithStore(metadata, store)
+
+	if options.ReplayJournal != "" {
+		replayJournal(service)
+		return
+	}
+
+	if options.SnapshotFile != "" {
+		err = restoreSnapshot(service)
+		if err != nil {
+			log.Fatalf("Error restoring snapshot: '%v'\n", err)
+		}
+		snapshot := func() error {
+			return service.WriteSnapshot(options.SnapshotFile)
+		}
+		onShutdown(snapshot)
+		if options.SnapshotInterval > 0 {
+			go every(options.SnapshotInterval, func() {
+				err := snapshot()
+				if err != nil {
+					log.Printf("Unable to write snapshot: '%v'\n", err)
+				}
+			})
+		}
+	}
+
+	var inmemoryBackend model.PartnerBackendService = service
+	if options.JournalFile != "" {
+		inmemoryBackend, err = createJournalBackend(service)
+		if err != nil {
+			log.Fatalf("Error opening journal: '%v'\n", err)
+		}
+	}
+
+	backend, resolver, err := createBackend(metadata, inmemoryBackend)
+	if err != nil {
+		log.Fatalf("Error creating backend: '%v'\n", err)
+	}
+
+	pendingStore, err := async.OpenFilePendingStore(options.PendingEventsFile)
+	if err != nil {
+		log.Fatalf("Error opening pending events file: '%v'\n", err)
+	}
+
+	var notifier async.Notifier
+	if options.MarketplaceCallbackUrl != "" {
+		notifier = async.CreateHTTPNotifier(options.MarketplaceCallbackUrl)
+	}
+
+	tracker := async.CreateTracker(pendingStore, notifier, backend)
+	err = tracker.ResumeNotifications()
+	if err != nil {
+		log.Printf("Unable to deliver pending completions: '%v'\n", err)
+	}
+
+	interceptors, err := interceptor.FromNames(strings.Split(options.Interceptors, ","))
+	if err != nil {
+		log.Fatalf("Error configuring interceptors: '%v'\n", err)
+	}
+
+	serverOptions := []server.Option{
+		server.WithPathPrefix(options.PathPrefix),
+		server.WithAsyncTracker(tracker),
+		server.WithRequestTimeout(options.RequestTimeout),
+		server.WithInterceptors(interceptors...),
+	}
+	if options.TlsCertFile != "" || options.TlsKeyFile != "" || options.TlsClientCaFile != "" {
+		serverOptions = append(serverOptions, server.WithTLS(server.TLSConfig{
+			CertFile:           options.TlsCertFile,
+			KeyFile:            options.TlsKeyFile,
+			ClientCAFile:       options.TlsClientCaFile,
+			RequireClientCert:  options.TlsRequireClientCert,
+			AllowedClientNames: splitNames(options.TlsAllowedClientNames),
+		}))
+	}
+	if options.SignatureKeysFile != "" {
+		verifier, err := auth.CreateSignatureVerifier(options.SignatureKeysFile, options.SignatureMaxSkew)
+		if err != nil {
+			log.Fatalf("Error reading signing keys: '%v'\n", err)
+		}
+		log.Printf("Verifying entitlement event signatures with the keys in '%s'\n", options.SignatureKeysFile)
+		go reloadOnSignal(verifier.Reload)
+		serverOptions = append(serverOptions, server.WithMiddleware(verifier.Middleware))
+	}
+	if options.JwksFile != "" {
+		verifier, err := auth.CreateTokenVerifier(options.JwksFile, options.JwtIssuer, options.JwtAudience)
+		if err != nil {
+			log.Fatalf("Error configuring bearer token authentication: '%v'\n", err)
+		}
+		log.Printf("Verifying bearer tokens with the keys in '%s'\n", options.JwksFile)
+		go reloadOnSignal(verifier.Reload)
+		serverOptions = append(serverOptions, server.WithMiddleware(verifier.Middleware),
+			server.WithIdempotencyScope(auth.IdempotencyScope(options.JwtAccountClaim)))
+		if options.JwtAccountClaim != "" {
+			if resolver == nil {
+				log.Fatal("The '--jwtAccountClaim' option requires a primary backend that records the accounts of the " +
+					"entitlements: the in-memory, exec or a routing backend.")
+			}
+			serverOptions = append(serverOptions, server.WithInterceptors(
+				auth.AccountClaim(options.JwtAccountClaim, resolver.EntitlementOwner)))
+		}
+	}
+	if options.BackupEndpoint {
+		boltStore, ok := store.(*boltstore.Store)
+		if !ok {
+			log.Fatalf("The backup endpoint requires the bolt store: '%s'\n", options.Store)
+		}
+		clientCertRequired := options.TlsClientCaFile != "" &&
+			(options.TlsRequireClientCert || len(splitNames(options.TlsAllowedClientNames)) != 0)
+		if options.JwksFile == "" && options.SignatureKeysFile == "" && !clientCertRequired {
+			log.Fatal("The backup endpoint requires the callers to be authenticated.")
+		}
+		serverOptions = append(serverOptions, server.WithHandler("GET", "/backup", boltStore.BackupHandler()))
+	}
+	for _, hook := range shutdownHooks {
+		serverOptions = append(serverOptions, server.WithShutdownHook(hook))
+	}
+
+	s, err := server.CreateServer(options.Port, backend, serverOptions...)
 	if err != nil {
 		log.Fatalf("Error creating server: '%v'\n", err)
 	}
-	s.Start()
+
+	stopped := make(chan struct{})
+	go shutdownOnSignal(s, stopped)
+
+	err = s.Start()
+	if err != nil {
+		log.Fatalf("Error running server: '%v'\n", err)
+	}
+	<-stopped
+}
+
+// shutdownOnSignal shuts the server down gracefully when the service receives SIGTERM or an interrupt, and closes
+// the stopped channel once the backend state has been flushed.
+func shutdownOnSignal(s *server.Server, stopped chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	log.Printf("Received '%v', shutting down\n", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Error shutting down: '%v'\n", err)
+	}
+	close(stopped)
+}
+
+// createStore returns the entitlement store of the given kind (memory, sqlite or bolt), which keeps the entitlements
+// in the given file if it is persistent.
+func createStore(kind string, file string) (inmemory.EntitlementStore, error) {
+	switch kind {
+	case "memory":
+		return inmemory.CreateMapStore(), nil
+	case "sqlite":
+		log.Printf("Keeping entitlements in SQLite database '%s'\n", file)
+		return sqlitestore.Open(file)
+	case "bolt":
+		log.Printf("Keeping entitlements in bbolt database '%s'\n", file)
+		return boltstore.Open(file)
+	}
+	return nil, fmt.Errorf("Unknown entitlement store: '%s'.", kind)
+}
+
+// replayJournal replays the journal given by the '--replayJournal' option into the store of the given service, which
+// must be empty.
+func replayJournal(service *inmemory.InMemoryService) {
+	entitlements, err := service.ListEntitlements()
+	if err != nil {
+		log.Fatalf("Error reading entitlement store: '%v'\n", err)
+	}
+	if len(entitlements) != 0 {
+		log.Fatalf("The entitlement store is not empty: '%d' entitlements\n", len(entitlements))
+	}
+
+	replayed, err := journal.Replay(options.ReplayJournal, 0, service)
+	if err != nil {
+		log.Fatalf("Error replaying journal: '%v'\n", err)
+	}
+
+	entitlements, err = service.ListEntitlements()
+	if err != nil {
+		log.Fatalf("Error reading entitlement store: '%v'\n", err)
+	}
+	log.Printf("Replayed '%d' journal entries into '%d' entitlements\n", replayed, len(entitlements))
+}
+
+// restoreSnapshot restores the entitlements of the given service from the snapshot given by the '--snapshotFile'
+// option, if it exists. State that is already in a persistent store is not restored.
+func restoreSnapshot(service *inmemory.InMemoryService) error {
+	snapshot, err := inmemory.ReadSnapshotFile(options.SnapshotFile)
+	if os.IsNotExist(err) {
+		log.Printf("No snapshot at '%s', starting empty\n", options.SnapshotFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entitlements, err := service.ListEntitlements()
+	if err != nil {
+		return err
+	}
+	if len(entitlements) != 0 {
+		log.Printf("Entitlement store is not empty, not restoring snapshot '%s'\n", options.SnapshotFile)
+		return nil
+	}
+
+	err = service.RestoreEntitlements(snapshot.Entitlements)
+	if err != nil {
+		return fmt.Errorf("Snapshot '%s' cannot be restored: %v", options.SnapshotFile, err)
+	}
+	log.Printf("Restored '%d' entitlements from snapshot '%s' taken at '%v'\n",
+		len(snapshot.Entitlements), options.SnapshotFile, snapshot.Time)
+	return nil
+}
+
+// splitNames splits a comma separated list of names, ignoring the empty ones.
+func splitNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// reloadOnSignal calls reload whenever the service receives SIGHUP, e.g. to pick up rotated keys.
+func reloadOnSignal(reload func() error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		err := reload()
+		if err != nil {
+			log.Printf("Unable to reload, keeping the current configuration: '%v'\n", err)
+		} else {
+			log.Print("Reloaded configuration")
+		}
+	}
+}
+
+// shutdownHooks flush the backend state when the server is shut down. They are run in the reverse order of their
+// registration, once the in-flight requests have been drained.
+var shutdownHooks []func() error
+
+// onShutdown registers a function that is run when the server is shut down.
+func onShutdown(hook func() error) {
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// every calls fn at the given interval, forever.
+func every(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		fn()
+	}
+}
+
+// createJournalBackend rebuilds the state of the given service from the journal given by the '--journalFile' option
+// and its latest snapshot, and returns a backend that journals the events that the service accepts. State that is
+// already in a persistent store is not rebuilt.
+func createJournalBackend(service *inmemory.InMemoryService) (*journal.Backend, error) {
+	snapshotPath := options.JournalFile + ".snapshot"
+
+	entitlements, err := service.ListEntitlements()
+	if err != nil {
+		return nil, err
+	}
+	if len(entitlements) == 0 {
+		replayed, err := journal.Restore(options.JournalFile, snapshotPath, service)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Replayed '%d' journal entries from '%s'\n", replayed, options.JournalFile)
+	} else {
+		log.Printf("Entitlement store is not empty, not replaying journal '%s'\n", options.JournalFile)
+	}
+
+	j, err := journal.Open(options.JournalFile)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := journal.CreateBackend(service, j, snapshotPath)
+	onShutdown(func() error {
+		err := backend.Snapshot()
+		if err != nil {
+			j.Close()
+			return err
+		}
+		return j.Close()
+	})
+	if options.SnapshotInterval > 0 {
+		go backend.RunSnapshots(options.SnapshotInterval, nil)
+	}
+	return backend, nil
+}
+
+// createBackend returns the backend that handles the incoming events. If a shadow backend is configured, the events
+// are also sent to it, and its responses are compared with the primary's. It also returns the primary backend as the
+// resolver of the owners of the entitlements, if it knows them, and nil otherwise.
+func createBackend(metadata inmemory.Metadata, inmemoryBackend model.PartnerBackendService) (
+	model.PartnerBackendService, owners.Resolver, error) {
+
+	backends, err := createBackends(metadata, inmemoryBackend)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	primary, err := createPrimaryBackend(backends)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolver, _ := primary.(owners.Resolver)
+
+	if options.ShadowBackend == "" {
+		return primary, resolver, nil
+	}
+
+	shadowBackend, ok := backends[options.ShadowBackend]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unknown shadow backend: '%s'.", options.ShadowBackend)
+	}
+	if router, ok := primary.(*routing.Router); shadowBackend == primary || ok && router.RoutesTo(options.ShadowBackend) {
+		return nil, nil, fmt.Errorf("The shadow backend must differ from the primary backend: '%s'.", options.ShadowBackend)
+	}
+
+	diffLog, err := shadow.OpenFileDiffLog(options.DiffLogFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Sending events to shadow backend '%s', mismatches are recorded in '%s'\n",
+		options.ShadowBackend, options.DiffLogFile)
+	backend := shadow.CreateBackend(primary, shadowBackend, diffLog)
+	onShutdown(func() error {
+		backend.Wait()
+		return diffLog.Close()
+	})
+	return backend, resolver, nil
+}
+
+// createBackends returns the available backends by name: the in-memory service, and the shadow store, forwarding and
+// exec backends if they are configured. The shadow store backend is a second in-memory service on its own store.
+func createBackends(metadata inmemory.Metadata, inmemoryBackend model.PartnerBackendService) (
+	map[string]model.PartnerBackendService, error) {
+
+	backends := map[string]model.PartnerBackendService{
+		"inmemory": inmemoryBackend,
+	}
+
+	if options.ShadowStore != "" {
+		if options.ShadowBackend != "store" {
+			return nil, fmt.Errorf("The shadow store is only used as the 'store' shadow backend: '%s'.",
+				options.ShadowBackend)
+		}
+		store, err := createStore(options.ShadowStore, options.ShadowStoreFile)
+		if err != nil {
+			return nil, err
+		}
+		if closer, ok := store.(io.Closer); ok {
+			onShutdown(closer.Close)
+		}
+		backends["store"] = inmemory.CreateServiceWithStore(metadata, store)
+	}
+
+	if options.ForwardingUrl != "" {
+		forwarder, err := forwarding.CreateBackend(options.ForwardingUrl,
+			forwarding.WithTimeout(options.ForwardingTimeout))
+		if err != nil {
+			return nil, err
+		}
+		backends["forwarding"] = forwarder
+	}
+
+	if options.CommandsFile != "" {
+		config, err := execplugin.ReadConfigFile(options.CommandsFile)
+		if err != nil {
+			return nil, err
+		}
+		ownerStore, err := owners.OpenFileStore(options.ExecOwnersFile)
+		if err != nil {
+			return nil, err
+		}
+		backends["exec"], err = execplugin.CreateBackend(config, execplugin.WithOwnerStore(ownerStore))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return backends, nil
+}
+
+// createPrimaryBackend returns the backend whose responses go back to the marketplace. If there is a routes file, the
+// events are routed between the available backends accordingly. Otherwise, the forwarding or the exec backend handles
+// all events if one of them is configured, and the in-memory service if neither is.
+func createPrimaryBackend(backends map[string]model.PartnerBackendService) (model.PartnerBackendService, error) {
+	routesFile := options.RoutesFile
+	if routesFile == "" {
+		defaultFile := filepath.Join(filepath.Dir(options.MetadataFile), "routes.json")
+		if _, err := os.Stat(defaultFile); err == nil {
+			routesFile = defaultFile
+		}
+	}
+
+	if routesFile == "" {
+		candidates := make([]string, 0, len(backends))
+		for name := range backends {
+			if name != "inmemory" && name != options.ShadowBackend {
+				candidates = append(candidates, name)
+			}
+		}
+		switch len(candidates) {
+		case 0:
+			return backends["inmemory"], nil
+		case 1:
+			return backends[candidates[0]], nil
+		}
+		return nil, fmt.Errorf("A routes file is required when several backends are configured: '%v'.", candidates)
+	}
+
+	config, err := routing.ReadConfigFile(routesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loaded routes from '%s': %+v\n", routesFile, config)
+
+	ownerStore, err := owners.OpenFileStore(options.RouteOwnersFile)
+	if err != nil {
+		return nil, err
+	}
+	return routing.CreateRouter(backends, config, routing.WithOwnerStore(ownerStore))
 }
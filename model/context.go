@@ -0,0 +1,65 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "context"
+
+// ContextPartnerBackendService is the context-aware variant of PartnerBackendService. The context is cancelled when
+// the caller goes away, or when the request deadline of the server expires. Backends can use it to abandon work, and
+// to pass deadlines and trace data on to their own downstream calls.
+type ContextPartnerBackendService interface {
+	// OnEntitlementEventContext gets invoked when a new entitlement event is received.
+	OnEntitlementEventContext(ctx context.Context, e EntitlementEvent) (EntitlementEventResponse, error)
+}
+
+// contextAdapter adapts a PartnerBackendService to ContextPartnerBackendService, by ignoring the context.
+type contextAdapter struct {
+	PartnerBackendService
+}
+
+func (a contextAdapter) OnEntitlementEventContext(
+	ctx context.Context, e EntitlementEvent) (EntitlementEventResponse, error) {
+
+	return a.OnEntitlementEvent(e)
+}
+
+// AdaptContext returns the context-aware variant of the given service. If the service already implements
+// ContextPartnerBackendService, it is returned as is. Otherwise, the context is not visible to the service, but the
+// deadline is still enforced by the server on behalf of the caller.
+func AdaptContext(s PartnerBackendService) ContextPartnerBackendService {
+	if c, ok := s.(ContextPartnerBackendService); ok {
+		return c
+	}
+	return contextAdapter{s}
+}
+
+// backgroundAdapter adapts a ContextPartnerBackendService to PartnerBackendService, using a background context.
+type backgroundAdapter struct {
+	ContextPartnerBackendService
+}
+
+func (a backgroundAdapter) OnEntitlementEvent(e EntitlementEvent) (EntitlementEventResponse, error) {
+	return a.OnEntitlementEventContext(context.Background(), e)
+}
+
+// FromContextService returns a PartnerBackendService for a backend that only implements the context-aware interface,
+// so that it can be used wherever a PartnerBackendService is expected. The returned service still implements
+// ContextPartnerBackendService, and AdaptContext unwraps it.
+func FromContextService(c ContextPartnerBackendService) PartnerBackendService {
+	if s, ok := c.(PartnerBackendService); ok {
+		return s
+	}
+	return backgroundAdapter{c}
+}
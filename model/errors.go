@@ -0,0 +1,122 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// ERRORCODE_INVALIDREQUEST indicates that the request was malformed, or did not pass validation.
+	ERRORCODE_INVALIDREQUEST = "INVALID_REQUEST"
+
+	// ERRORCODE_CONFLICT indicates that the request conflicts with an earlier request.
+	ERRORCODE_CONFLICT = "CONFLICT"
+
+	// ERRORCODE_NOTFOUND indicates that the resource that the request refers to does not exist.
+	ERRORCODE_NOTFOUND = "NOT_FOUND"
+
+	// ERRORCODE_DEADLINEEXCEEDED indicates that the request could not be handled in time, and should be retried.
+	ERRORCODE_DEADLINEEXCEEDED = "DEADLINE_EXCEEDED"
+
+	// ERRORCODE_UNAVAILABLE indicates that the backend is temporarily unable to handle the request, which should be
+	// retried later.
+	ERRORCODE_UNAVAILABLE = "UNAVAILABLE"
+
+	// ERRORCODE_UNAUTHENTICATED indicates that the request did not carry valid credentials.
+	ERRORCODE_UNAUTHENTICATED = "UNAUTHENTICATED"
+
+	// ERRORCODE_INTERNAL indicates that the request could not be handled due to an internal error.
+	ERRORCODE_INTERNAL = "INTERNAL_ERROR"
+)
+
+// ErrorResponse is the body that is returned for the requests that could not be handled.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes why a request could not be handled.
+type ErrorDetail struct {
+	// Code is the machine readable error code (e.g. ERRORCODE_INVALIDREQUEST).
+	Code string `json:"code"`
+
+	// Message is the human readable description of the error.
+	Message string `json:"message"`
+
+	// FieldErrors are the problems with individual fields of the request, if any.
+	FieldErrors []FieldError `json:"fieldErrors,omitempty"`
+}
+
+// FieldError describes a problem with a particular field of a request.
+type FieldError struct {
+	// Field is the JSON pointer to the offending field within the request (e.g. "/parameters/size").
+	Field string `json:"field"`
+
+	// Message is the human readable description of the problem.
+	Message string `json:"message"`
+}
+
+// ValidationError is the error that is returned when an entitlement event is not valid. Backends can return it from
+// OnEntitlementEvent to refuse an event, with details about the offending fields.
+type ValidationError struct {
+	Message     string
+	FieldErrors []FieldError
+}
+
+// NewFieldValidationError creates a new ValidationError for a single offending field.
+func NewFieldValidationError(field string, format string, args ...interface{}) *ValidationError {
+	message := fmt.Sprintf(format, args...)
+	return &ValidationError{
+		Message: message,
+		FieldErrors: []FieldError{
+			{Field: field, Message: message},
+		},
+	}
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.FieldErrors) == 0 {
+		return e.Message
+	}
+
+	details := make([]string, 0, len(e.FieldErrors))
+	for _, f := range e.FieldErrors {
+		details = append(details, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return fmt.Sprintf("%s {%s}", e.Message, strings.Join(details, "; "))
+}
+
+// UnavailableError is the error that is returned when a backend is temporarily unable to handle events, e.g. because
+// its upstream is down. The event is failed as retryable, rather than as an internal error.
+type UnavailableError struct {
+	Message string
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Message
+}
+
+// JsonPointer creates a JSON pointer (RFC 6901) from the given path components.
+func JsonPointer(components ...string) string {
+	var b strings.Builder
+	for _, c := range components {
+		b.WriteString("/")
+		c = strings.Replace(c, "~", "~0", -1)
+		c = strings.Replace(c, "/", "~1", -1)
+		b.WriteString(c)
+	}
+	return b.String()
+}
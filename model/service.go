@@ -15,7 +15,10 @@
 // package model contains the abstract data model for the Procurement Listener Service.
 package model
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // EntitlementEventType is the underlying type for entitlement event related enum values.
 type EntitlementEventType string
@@ -90,11 +93,35 @@ const (
 	RESPONSESTATUS_ASYNC ResponseStatus = iota
 )
 
+var responseStatusNames = map[ResponseStatus]string{
+	RESPONSESTATUS_INVALIDREQUEST: "INVALIDREQUEST",
+	RESPONSESTATUS_ACCEPTED:       "ACCEPTED",
+	RESPONSESTATUS_REJECTED:       "REJECTED",
+	RESPONSESTATUS_ASYNC:          "ASYNC",
+}
+
+func (s ResponseStatus) String() string {
+	if name, ok := responseStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("ResponseStatus(%d)", int(s))
+}
+
+// ParseResponseStatus returns the ResponseStatus with the given name (e.g. "ACCEPTED").
+func ParseResponseStatus(name string) (ResponseStatus, error) {
+	for status, n := range responseStatusNames {
+		if strings.EqualFold(n, name) {
+			return status, nil
+		}
+	}
+	return RESPONSESTATUS_INVALIDREQUEST, fmt.Errorf("Unknown response status: '%s'.", name)
+}
+
 // EntitlementEventResponse represents a response to an entitlement event notification that was received from the source system.
 type EntitlementEventResponse struct {
 
 	// The response status for the
-	Status ResponseStatus `json:-`
+	Status ResponseStatus `json:"-"`
 
 	// eventId is the id of the event that this response is being returned for.
 	EventId string `json:"eventId"`
@@ -104,42 +131,110 @@ type EntitlementEventResponse struct {
 	EntitlementDashboardUrl string `json:"entitlementDashboardUrl"`
 
 	// labels are optional custom parameters that the backend would like to attach to the entitlement.
-	Labels struct{} `json:"labels"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// reason explains why the event was rejected. It is only set when Status is RESPONSESTATUS_REJECTED.
+	Reason *RejectionReason `json:"reason,omitempty"`
+}
+
+// RejectionReason describes why a backend rejected an entitlement event.
+type RejectionReason struct {
+	// Code is the machine readable reason code (e.g. REJECTIONREASON_ILLEGALTRANSITION).
+	Code string `json:"code"`
+
+	// Message is the human readable description of the reason, that can be shown to the buyer.
+	Message string `json:"message"`
+}
+
+const (
+	// REJECTIONREASON_UNSPECIFIED is used when the backend did not specify a reason for a rejection.
+	REJECTIONREASON_UNSPECIFIED = "UNSPECIFIED"
+
+	// REJECTIONREASON_ENTITLEMENTNOTFOUND indicates that the event refers to an unknown entitlement.
+	REJECTIONREASON_ENTITLEMENTNOTFOUND = "ENTITLEMENT_NOT_FOUND"
+
+	// REJECTIONREASON_ILLEGALTRANSITION indicates that the event is not allowed in the entitlement's current state.
+	REJECTIONREASON_ILLEGALTRANSITION = "ILLEGAL_TRANSITION"
+
+	// REJECTIONREASON_PLANCHANGENOTALLOWED indicates that the requested plan or service change is not allowed.
+	REJECTIONREASON_PLANCHANGENOTALLOWED = "PLAN_CHANGE_NOT_ALLOWED"
+
+	// REJECTIONREASON_PROVISIONINGFAILED indicates that the entitlement could not be provisioned.
+	REJECTIONREASON_PROVISIONINGFAILED = "PROVISIONING_FAILED"
+)
+
+// NewRejection creates a RejectionReason with the given code, and a formatted message.
+func NewRejection(code string, format string, args ...interface{}) *RejectionReason {
+	return &RejectionReason{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
 }
 
 // PartnerBackendService is the service interface that needs to be implemented by the backends to listen and react to incoming procurement events.
+//
+// A backend can refuse an invalid event by returning a *ValidationError, which is reported back to the caller along
+// with its field errors.
+//
+// A backend can respond to an event with RESPONSESTATUS_ASYNC, if the event cannot be handled within the lifetime of
+// the request. In that case, the event is recorded as pending, and it needs to be completed later on. Backends that
+// need to update their own state at completion time should implement AsyncPartnerBackendService.
 type PartnerBackendService interface {
-	// TODO: Add support for async handling of the events.
 	// OnEntitlementvents gets invoked when a new entitlement event is received.
 	OnEntitlementEvent(e EntitlementEvent) (EntitlementEventResponse, error)
 }
 
+// AsyncPartnerBackendService is an optional extension of PartnerBackendService for backends that respond to events
+// asynchronously.
+type AsyncPartnerBackendService interface {
+	PartnerBackendService
+
+	// OnEntitlementEventCompleted gets invoked when an event, for which RESPONSESTATUS_ASYNC was returned earlier, is
+	// completed with the given status (either RESPONSESTATUS_ACCEPTED or RESPONSESTATUS_REJECTED). The returned
+	// response is sent to the marketplace.
+	OnEntitlementEventCompleted(e EntitlementEvent, status ResponseStatus) (EntitlementEventResponse, error)
+}
+
+// ValidateEntitlementEvent checks the given event for the presence and validity of the fields that are required for
+// its event type. All problems that are found are reported, as a *ValidationError.
 func ValidateEntitlementEvent(e EntitlementEvent) error {
+	var fieldErrors []FieldError
+	invalid := func(field string, value interface{}) {
+		fieldErrors = append(fieldErrors, FieldError{
+			Field:   JsonPointer(field),
+			Message: fmt.Sprintf("Field '%s' does not have a valid value: '%v'.", field, value),
+		})
+	}
+
 	if e.EventId == "" {
-		return fmt.Errorf("Field 'eventId' does not have a valid value: '%v'.", e.EventId)
+		invalid("eventId", e.EventId)
 	}
 
 	if e.EntitlementId == "" {
-		return fmt.Errorf("Field 'entitlementId' does not have a valid value: '%v'.", e.EntitlementId)
+		invalid("entitlementId", e.EntitlementId)
 	}
 
 	switch e.EventType {
 	case ENTITLEMENT_CREATED:
 		if e.ServiceId == "" {
-			return fmt.Errorf("Field 'serviceId' does not have a valid value: '%v'.", e.ServiceId)
+			invalid("serviceId", e.ServiceId)
 		}
 		if e.PlanId == "" {
-			return fmt.Errorf("Field 'planId' does not have a valid value: '%v'.", e.PlanId)
+			invalid("planId", e.PlanId)
 		}
-		break
-	case ENTITLEMENT_DELETED:
-	case ENTITLEMENT_UPDATED:
-	case ENTITLEMENT_CANCELLED:
-	case ENTITLEMENT_REACTIVATED:
-		break
+	case ENTITLEMENT_DELETED,
+		ENTITLEMENT_UPDATED,
+		ENTITLEMENT_CANCELLED,
+		ENTITLEMENT_REACTIVATED:
 	default:
-		return fmt.Errorf("Field 'eventType' doesn't have a valid value: '%v'.", e.EventType)
+		invalid("eventType", e.EventType)
 	}
 
+	if len(fieldErrors) != 0 {
+		return &ValidationError{
+			Message:     "The entitlement event is not valid.",
+			FieldErrors: fieldErrors,
+		}
+	}
 	return nil
 }
@@ -0,0 +1,171 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package owners keeps a durable record of the service and plan of each entitlement, and of the backend that it was
+// handed to. Only ENTITLEMENT_CREATED events are guaranteed to carry the service and plan ids, so the backends that
+// dispatch events by service and plan look up the subsequent events of an entitlement in these records, even across
+// restarts.
+package owners
+
+import (
+	"fmt"
+	"procurementlistenerservice/internal/fileutil"
+	"procurementlistenerservice/model"
+	"sync"
+)
+
+// Record is the owner record of an entitlement.
+type Record struct {
+	// ServiceId is the id of the service of the entitlement.
+	ServiceId string `json:"serviceId"`
+
+	// PlanId is the id of the current plan of the entitlement.
+	PlanId string `json:"planId"`
+
+	// Backend is the name of the backend that the entitlement was handed to, if any.
+	Backend string `json:"backend,omitempty"`
+
+	// AccountId is the id of the account that the entitlement was created for.
+	AccountId string `json:"accountId,omitempty"`
+}
+
+// Resolver is implemented by the backends that know the account that owns each of their entitlements, so that the
+// events of an entitlement can be checked against its owner.
+type Resolver interface {
+	// EntitlementOwner returns the id of the account that owns the entitlement with the given id, and reports whether
+	// the entitlement exists.
+	EntitlementOwner(entitlementId string) (accountId string, found bool, err error)
+}
+
+// Store is the storage interface for owner records.
+type Store interface {
+	// Get returns the record of the entitlement with the given id, if it exists.
+	Get(entitlementId string) (Record, bool, error)
+
+	// Put inserts or replaces the record of the entitlement with the given id.
+	Put(entitlementId string, record Record) error
+
+	// Delete removes the record of the entitlement with the given id. Deleting a non-existent record is not an error.
+	Delete(entitlementId string) error
+}
+
+// Update updates the owner record of the entitlement of the given event, once the named backend has responded to the
+// event, or completed it, with the given status. A creation records the service, plan and account of the entitlement,
+// an accepted plan change updates the plan, and an accepted deletion or a rejected asynchronous creation removes the
+// record. A synchronously rejected event leaves the record unchanged, and must not be passed in.
+func Update(store Store, e model.EntitlementEvent, backend string, status model.ResponseStatus) error {
+	var err error
+	switch {
+	case e.EventType == model.ENTITLEMENT_CREATED && status != model.RESPONSESTATUS_REJECTED:
+		err = store.Put(e.EntitlementId, Record{
+			ServiceId: e.ServiceId, PlanId: e.PlanId, Backend: backend, AccountId: e.AccountId})
+	case e.EventType == model.ENTITLEMENT_CREATED:
+		// The asynchronous creation was rejected, so there is no entitlement.
+		err = store.Delete(e.EntitlementId)
+	case e.EventType == model.ENTITLEMENT_UPDATED && status == model.RESPONSESTATUS_ACCEPTED && e.PlanId != "":
+		var record Record
+		var found bool
+		record, found, err = store.Get(e.EntitlementId)
+		if err == nil && found && record.PlanId != e.PlanId {
+			record.PlanId = e.PlanId
+			err = store.Put(e.EntitlementId, record)
+		}
+	case e.EventType == model.ENTITLEMENT_DELETED && status == model.RESPONSESTATUS_ACCEPTED:
+		err = store.Delete(e.EntitlementId)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Unable to record the owner of entitlement '%s': '%v'.", e.EntitlementId, err)
+	}
+	return nil
+}
+
+// Unhandled returns the response that rejects an event of the given service, which no backend of this provider
+// handles.
+func Unhandled(e model.EntitlementEvent, serviceId string) model.EntitlementEventResponse {
+	return model.EntitlementEventResponse{
+		Status:  model.RESPONSESTATUS_REJECTED,
+		EventId: e.EventId,
+		Reason: model.NewRejection(model.REJECTIONREASON_UNSPECIFIED,
+			"The service '%s' is not handled by this provider.", serviceId),
+	}
+}
+
+// MemoryStore is a Store that keeps the records in memory only, so that they are lost on restart.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records map[string]Record
+}
+
+var _ Store = &MemoryStore{}
+
+// CreateMemoryStore creates a new, empty MemoryStore.
+func CreateMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (s *MemoryStore) Get(entitlementId string) (Record, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, found := s.records[entitlementId]
+	return record, found, nil
+}
+
+func (s *MemoryStore) Put(entitlementId string, record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[entitlementId] = record
+	return nil
+}
+
+func (s *MemoryStore) Delete(entitlementId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, entitlementId)
+	return nil
+}
+
+// FileStore is a Store that keeps the records in memory, and writes them through to a JSON file on every change.
+type FileStore struct {
+	records *fileutil.JsonMap
+}
+
+var _ Store = &FileStore{}
+
+// OpenFileStore opens the FileStore that is backed by the file at the given path. The file is created on the first
+// write, if it doesn't exist.
+func OpenFileStore(path string) (*FileStore, error) {
+	records, err := fileutil.OpenJsonMap(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open owners file: '%v'.", err)
+	}
+	return &FileStore{records: records}, nil
+}
+
+func (s *FileStore) Get(entitlementId string) (Record, bool, error) {
+	var record Record
+	found, err := s.records.Get(entitlementId, &record)
+	return record, found, err
+}
+
+func (s *FileStore) Put(entitlementId string, record Record) error {
+	return s.records.Put(entitlementId, record)
+}
+
+func (s *FileStore) Delete(entitlementId string) error {
+	return s.records.Delete(entitlementId)
+}
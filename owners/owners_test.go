@@ -0,0 +1,57 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package owners
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreIsDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "owners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "owners.json")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := Record{ServiceId: "S1", PlanId: "P1", Backend: "exec"}
+	for _, id := range []string{"E1", "E2"} {
+		if err := store.Put(id, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("E2"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, found, err := reopened.Get("E1")
+	if err != nil || !found || actual != record {
+		t.Errorf("Unexpected record for 'E1': '%+v' found='%v' err='%v'", actual, found, err)
+	}
+	if _, found, _ := reopened.Get("E2"); found {
+		t.Error("The deleted record for 'E2' was not removed.")
+	}
+}
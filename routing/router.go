@@ -0,0 +1,257 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package routing contains a backend that dispatches entitlement events to different backends, based on the service
+// and plan of the entitlement.
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"procurementlistenerservice/model"
+	"procurementlistenerservice/owners"
+)
+
+// Route maps the entitlements of a service, and optionally a subset of its plans, to a named backend.
+type Route struct {
+	// ServiceId is the id of the service that the route applies to. An empty value or "*" matches all services.
+	ServiceId string `json:"serviceId"`
+
+	// Plan is a glob pattern (e.g. "enterprise-*") that the plan id needs to match. An empty value matches all plans.
+	Plan string `json:"plan"`
+
+	// Backend is the name of the backend that the matching events are routed to.
+	Backend string `json:"backend"`
+}
+
+// Config is the route table, as read from the routes file.
+type Config struct {
+	// Routes are evaluated in order, and the first matching route wins.
+	Routes []Route `json:"routes"`
+
+	// Fallback is the name of the backend that handles the events that do not match any route. If it is empty,
+	// such events are rejected.
+	Fallback string `json:"fallback"`
+}
+
+// Router is a backend that dispatches each ENTITLEMENT_CREATED event to the backend of the first route that matches
+// its service and plan.
+//
+// Once a backend has accepted the creation of an entitlement, the router records it as the owner of the entitlement,
+// and sends all subsequent events of the entitlement to it, even if they name another plan. The record is removed
+// once the entitlement is deleted. Events for entitlements without a record are routed by their service and plan, if
+// they carry them, and are sent to the fallback backend otherwise.
+type Router struct {
+	routes   []Route
+	backends map[string]model.PartnerBackendService
+	fallback string
+	owners   owners.Store
+}
+
+// Option is a configuration option for the router.
+type Option func(*Router) error
+
+// WithOwnerStore configures the store that keeps the owner records of the entitlements. By default, the records are
+// kept in memory only, and are lost on restart.
+func WithOwnerStore(store owners.Store) Option {
+	return func(r *Router) error {
+		r.owners = store
+		return nil
+	}
+}
+
+var _ model.PartnerBackendService = &Router{}
+var _ model.ContextPartnerBackendService = &Router{}
+var _ model.AsyncPartnerBackendService = &Router{}
+var _ owners.Resolver = &Router{}
+
+// CreateRouter creates a new Router with the given named backends, and the given route table.
+func CreateRouter(
+	backends map[string]model.PartnerBackendService, config Config, options ...Option) (*Router, error) {
+
+	r := &Router{
+		routes:   config.Routes,
+		backends: make(map[string]model.PartnerBackendService),
+		fallback: config.Fallback,
+		owners:   owners.CreateMemoryStore(),
+	}
+
+	for _, option := range options {
+		err := option(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, backend := range backends {
+		r.backends[name] = backend
+	}
+
+	for _, route := range config.Routes {
+		if _, ok := r.backends[route.Backend]; !ok {
+			return nil, fmt.Errorf("Route refers to an unknown backend: '%s'.", route.Backend)
+		}
+		if _, err := path.Match(route.Plan, ""); err != nil {
+			return nil, fmt.Errorf("Route has an invalid plan pattern: '%s'.", route.Plan)
+		}
+	}
+
+	if config.Fallback != "" {
+		if _, ok := r.backends[config.Fallback]; !ok {
+			return nil, fmt.Errorf("Fallback refers to an unknown backend: '%s'.", config.Fallback)
+		}
+	}
+
+	return r, nil
+}
+
+// ReadConfigFile opens the file with the given path, reads contents as JSON, and returns the parsed route table.
+func ReadConfigFile(path string) (Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("Unable to read routes file: '%s'.\n", path)
+	}
+
+	var config Config
+	err = json.Unmarshal(contents, &config)
+	if err != nil {
+		return Config{}, fmt.Errorf("Unable to parse routes file: '%v'.\n", err)
+	}
+
+	return config, nil
+}
+
+func (r *Router) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return r.OnEntitlementEventContext(context.Background(), e)
+}
+
+func (r *Router) OnEntitlementEventContext(
+	ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+
+	name, backend, err := r.route(e)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+	if backend == nil {
+		log.Printf("No route for entitlement event: eventId='%s' serviceId='%s' planId='%s'\n",
+			e.EventId, e.ServiceId, e.PlanId)
+		return owners.Unhandled(e, e.ServiceId), nil
+	}
+
+	response, err := model.AdaptContext(backend).OnEntitlementEventContext(ctx, e)
+	if err != nil || response.Status == model.RESPONSESTATUS_REJECTED {
+		return response, err
+	}
+
+	err = owners.Update(r.owners, e, name, response.Status)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+	return response, nil
+}
+
+// OnEntitlementEventCompleted forwards the completion to the backend that the event was routed to, if that backend
+// handles completions, and updates the owner record of the entitlement.
+func (r *Router) OnEntitlementEventCompleted(
+	e model.EntitlementEvent, status model.ResponseStatus) (model.EntitlementEventResponse, error) {
+
+	name, backend, err := r.route(e)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+
+	response := model.EntitlementEventResponse{
+		Status:  status,
+		EventId: e.EventId,
+	}
+	if async, ok := backend.(model.AsyncPartnerBackendService); ok {
+		response, err = async.OnEntitlementEventCompleted(e, status)
+		if err != nil {
+			return response, err
+		}
+	}
+
+	err = owners.Update(r.owners, e, name, status)
+	if err != nil {
+		return model.EntitlementEventResponse{}, err
+	}
+	return response, nil
+}
+
+// EntitlementOwner returns the account of the entitlement with the given id, from its owner record. The records that
+// were written before the accounts were recorded are resolved by the backend that the entitlement was handed to, if it
+// knows the owners of its entitlements.
+func (r *Router) EntitlementOwner(entitlementId string) (string, bool, error) {
+	record, found, err := r.owners.Get(entitlementId)
+	if err != nil || !found {
+		return "", false, err
+	}
+	if resolver, ok := r.backends[record.Backend].(owners.Resolver); ok && record.AccountId == "" {
+		return resolver.EntitlementOwner(entitlementId)
+	}
+	return record.AccountId, true, nil
+}
+
+// RoutesTo returns whether the route table or the fallback sends events to the backend with the given name.
+func (r *Router) RoutesTo(name string) bool {
+	for _, route := range r.routes {
+		if route.Backend == name {
+			return true
+		}
+	}
+	return r.fallback != "" && r.fallback == name
+}
+
+// route returns the name of the backend that should handle the given event, and the backend itself. It returns a nil
+// backend if there is no matching route, and no fallback.
+func (r *Router) route(e model.EntitlementEvent) (string, model.PartnerBackendService, error) {
+	record, found, err := r.owners.Get(e.EntitlementId)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to read the owner of entitlement '%s': '%v'.", e.EntitlementId, err)
+	}
+	if found {
+		if backend, ok := r.backends[record.Backend]; ok {
+			return record.Backend, backend, nil
+		}
+		log.Printf("Entitlement '%s' is owned by an unknown backend: '%s'\n", e.EntitlementId, record.Backend)
+	}
+
+	if e.ServiceId != "" {
+		for _, route := range r.routes {
+			if route.matches(e.ServiceId, e.PlanId) {
+				return route.Backend, r.backends[route.Backend], nil
+			}
+		}
+	}
+
+	if r.fallback != "" {
+		return r.fallback, r.backends[r.fallback], nil
+	}
+	return "", nil, nil
+}
+
+func (r Route) matches(serviceId string, planId string) bool {
+	if r.ServiceId != "" && r.ServiceId != "*" && r.ServiceId != serviceId {
+		return false
+	}
+	if r.Plan == "" {
+		return true
+	}
+	matched, _ := path.Match(r.Plan, planId)
+	return matched
+}
@@ -0,0 +1,293 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"procurementlistenerservice/model"
+	"procurementlistenerservice/owners"
+	"testing"
+)
+
+// recordingBackend accepts every event, and records the ids of the events it receives.
+type recordingBackend struct {
+	events []string
+}
+
+func (b *recordingBackend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	b.events = append(b.events, e.EventId)
+	return model.EntitlementEventResponse{Status: model.RESPONSESTATUS_ACCEPTED, EventId: e.EventId}, nil
+}
+
+func TestRouting(t *testing.T) {
+	storage := &recordingBackend{}
+	compute := &recordingBackend{}
+	enterprise := &recordingBackend{}
+	fallback := &recordingBackend{}
+
+	router, err := CreateRouter(map[string]model.PartnerBackendService{
+		"storage":    storage,
+		"compute":    compute,
+		"enterprise": enterprise,
+		"fallback":   fallback,
+	}, Config{
+		Routes: []Route{
+			{ServiceId: "compute", Plan: "enterprise-*", Backend: "enterprise"},
+			{ServiceId: "compute", Backend: "compute"},
+			{ServiceId: "storage", Backend: "storage"},
+		},
+		Fallback: "fallback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []model.EntitlementEvent{
+		{EventId: "1", EventType: model.ENTITLEMENT_CREATED, EntitlementId: "E1", ServiceId: "storage", PlanId: "p"},
+		{EventId: "2", EventType: model.ENTITLEMENT_CREATED, EntitlementId: "E2", ServiceId: "compute", PlanId: "p"},
+		{EventId: "3", EventType: model.ENTITLEMENT_CREATED, EntitlementId: "E3", ServiceId: "compute",
+			PlanId: "enterprise-large"},
+		{EventId: "4", EventType: model.ENTITLEMENT_CREATED, EntitlementId: "E4", ServiceId: "other", PlanId: "p"},
+		{EventId: "5", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E3"},
+		{EventId: "6", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "unknown"},
+	}
+	for _, e := range events {
+		_, err := router.OnEntitlementEvent(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(name string, b *recordingBackend, ids ...string) {
+		if len(b.events) != len(ids) {
+			t.Errorf("Unexpected events for '%s': actual='%v', expected='%v'", name, b.events, ids)
+			return
+		}
+		for i := range ids {
+			if b.events[i] != ids[i] {
+				t.Errorf("Unexpected events for '%s': actual='%v', expected='%v'", name, b.events, ids)
+				return
+			}
+		}
+	}
+	expect("storage", storage, "1")
+	expect("compute", compute, "2")
+	expect("enterprise", enterprise, "3", "5")
+	expect("fallback", fallback, "4", "6")
+}
+
+// rejectingBackend rejects every event.
+type rejectingBackend struct{}
+
+func (b rejectingBackend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return model.EntitlementEventResponse{Status: model.RESPONSESTATUS_REJECTED, EventId: e.EventId}, nil
+}
+
+func TestOwnerRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "owners.json")
+
+	compute := &recordingBackend{}
+	enterprise := &recordingBackend{}
+	fallback := &recordingBackend{}
+	createRouter := func() *Router {
+		store, err := owners.OpenFileStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router, err := CreateRouter(map[string]model.PartnerBackendService{
+			"compute":    compute,
+			"enterprise": enterprise,
+			"rejecting":  rejectingBackend{},
+			"fallback":   fallback,
+		}, Config{
+			Routes: []Route{
+				{ServiceId: "compute", Plan: "enterprise-*", Backend: "enterprise"},
+				{ServiceId: "compute", Backend: "compute"},
+				{ServiceId: "rejected", Backend: "rejecting"},
+			},
+			Fallback: "fallback",
+		}, WithOwnerStore(store))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return router
+	}
+
+	send := func(router *Router, e model.EntitlementEvent) {
+		_, err := router.OnEntitlementEvent(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := createRouter()
+	send(router, model.EntitlementEvent{
+		EventId: "1", EventType: model.ENTITLEMENT_CREATED, EntitlementId: "E1", ServiceId: "compute", PlanId: "p"})
+	send(router, model.EntitlementEvent{
+		EventId: "2", EventType: model.ENTITLEMENT_CREATED, EntitlementId: "E2", ServiceId: "rejected", PlanId: "p"})
+
+	// After a restart, the events of E1 still go to its owner, even when they name a plan of another route. The
+	// rejected creation of E2 left no owner behind.
+	router = createRouter()
+	send(router, model.EntitlementEvent{
+		EventId: "3", EventType: model.ENTITLEMENT_UPDATED, EntitlementId: "E1", ServiceId: "compute",
+		PlanId: "enterprise-large"})
+	send(router, model.EntitlementEvent{EventId: "4", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E1"})
+	send(router, model.EntitlementEvent{EventId: "5", EventType: model.ENTITLEMENT_DELETED, EntitlementId: "E1"})
+	send(router, model.EntitlementEvent{EventId: "6", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E2"})
+
+	// The deletion removed the owner of E1.
+	send(router, model.EntitlementEvent{EventId: "7", EventType: model.ENTITLEMENT_CANCELLED, EntitlementId: "E1"})
+
+	expectEvents := func(name string, b *recordingBackend, ids ...string) {
+		if len(b.events) != len(ids) {
+			t.Errorf("Unexpected events for '%s': actual='%v', expected='%v'", name, b.events, ids)
+			return
+		}
+		for i := range ids {
+			if b.events[i] != ids[i] {
+				t.Errorf("Unexpected events for '%s': actual='%v', expected='%v'", name, b.events, ids)
+				return
+			}
+		}
+	}
+	expectEvents("compute", compute, "1", "3", "4", "5")
+	expectEvents("enterprise", enterprise)
+	expectEvents("fallback", fallback, "6", "7")
+}
+
+// resolvingBackend accepts every event, and knows the owners of its entitlements.
+type resolvingBackend struct {
+	recordingBackend
+	accounts map[string]string
+}
+
+func (b *resolvingBackend) EntitlementOwner(entitlementId string) (string, bool, error) {
+	accountId, found := b.accounts[entitlementId]
+	return accountId, found, nil
+}
+
+func TestEntitlementOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "owners.json")
+
+	backends := map[string]model.PartnerBackendService{
+		"remote": &recordingBackend{},
+		"local":  &resolvingBackend{accounts: map[string]string{"E2": "A2"}},
+	}
+	createRouter := func() *Router {
+		store, err := owners.OpenFileStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router, err := CreateRouter(backends, Config{Fallback: "remote"}, WithOwnerStore(store))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return router
+	}
+
+	router := createRouter()
+	if _, err := router.OnEntitlementEvent(model.EntitlementEvent{EventId: "1", EventType: model.ENTITLEMENT_CREATED,
+		EntitlementId: "E1", ServiceId: "s", PlanId: "p", AccountId: "A1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record without an account is resolved by the backend that owns the entitlement.
+	store, err := owners.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("E2", owners.Record{ServiceId: "s", PlanId: "p", Backend: "local"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The account of the entitlement that the remote backend handles is known after a restart.
+	router = createRouter()
+	for _, test := range []struct {
+		entitlementId string
+		accountId     string
+		found         bool
+	}{
+		{"E1", "A1", true},
+		{"E2", "A2", true},
+		{"E3", "", false},
+	} {
+		accountId, found, err := router.EntitlementOwner(test.entitlementId)
+		if err != nil || accountId != test.accountId || found != test.found {
+			t.Errorf("Unexpected owner of '%s': accountId='%s' found='%v' err='%v'", test.entitlementId, accountId,
+				found, err)
+		}
+	}
+
+	if _, err := router.OnEntitlementEvent(model.EntitlementEvent{EventId: "2", EventType: model.ENTITLEMENT_DELETED,
+		EntitlementId: "E1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := router.EntitlementOwner("E1"); found {
+		t.Error("The owner of the deleted entitlement 'E1' was not removed.")
+	}
+}
+
+func TestNoRoute(t *testing.T) {
+	router, err := CreateRouter(map[string]model.PartnerBackendService{}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := router.OnEntitlementEvent(model.EntitlementEvent{
+		EventId: "1", EventType: model.ENTITLEMENT_CREATED, EntitlementId: "E1", ServiceId: "s", PlanId: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != model.RESPONSESTATUS_REJECTED {
+		t.Errorf("Unexpected status: '%v'", response.Status)
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	_, err := CreateRouter(map[string]model.PartnerBackendService{}, Config{
+		Routes: []Route{{ServiceId: "s", Backend: "missing"}},
+	})
+	if err == nil {
+		t.Error("Expected an error for a route to an unknown backend.")
+	}
+}
+
+func TestRoutesTo(t *testing.T) {
+	backends := map[string]model.PartnerBackendService{
+		"a": &recordingBackend{}, "b": &recordingBackend{}, "c": &recordingBackend{},
+	}
+	router, err := CreateRouter(backends, Config{Routes: []Route{{ServiceId: "s", Backend: "a"}}, Fallback: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{"a": true, "b": true, "c": false, "": false} {
+		if actual := router.RoutesTo(name); actual != expected {
+			t.Errorf("Unexpected routing to '%s': actual='%v', expected='%v'", name, actual, expected)
+		}
+	}
+}
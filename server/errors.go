@@ -0,0 +1,65 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"procurementlistenerservice/model"
+)
+
+// errorBody creates the JSON body of an error response.
+func errorBody(code string, message string, fieldErrors []model.FieldError) []byte {
+	body, err := json.Marshal(model.ErrorResponse{
+		Error: model.ErrorDetail{
+			Code:        code,
+			Message:     message,
+			FieldErrors: fieldErrors,
+		},
+	})
+	if err != nil {
+		log.Printf("Error marshalling error response: '%v'\n", err)
+		return nil
+	}
+	return body
+}
+
+// validationErrorBody creates the JSON body of an error response for the given validation error.
+func validationErrorBody(err *model.ValidationError) []byte {
+	return errorBody(model.ERRORCODE_INVALIDREQUEST, err.Message, err.FieldErrors)
+}
+
+// internalErrorBody creates the JSON body of an error response for internal errors. The details of the error are
+// only logged, and not sent back to the caller.
+func internalErrorBody() []byte {
+	return errorBody(model.ERRORCODE_INTERNAL, "An internal error occurred while handling the request.", nil)
+}
+
+// writeResponse writes the given status code and JSON body, if any, to the response.
+func writeResponse(w http.ResponseWriter, code int, body []byte) {
+	if body != nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(code)
+	if body != nil {
+		w.Write(body)
+	}
+}
+
+// writeError writes an error response with the given status code, error code and message.
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeResponse(w, status, errorBody(code, message, nil))
+}
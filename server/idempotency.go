@@ -0,0 +1,200 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"procurementlistenerservice/model"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_IDEMPOTENCY_CAPACITY is the default number of responses that are kept by the IdempotencyCache.
+	DEFAULT_IDEMPOTENCY_CAPACITY int = 10000
+
+	// DEFAULT_IDEMPOTENCY_TTL is the default duration for which a response is kept by the IdempotencyCache.
+	DEFAULT_IDEMPOTENCY_TTL time.Duration = 24 * time.Hour
+)
+
+// cacheKey identifies an event within the scope of the caller that delivered it.
+type cacheKey struct {
+	scope   string
+	eventId string
+}
+
+// cachedResponse is the response that was returned for the first delivery of an event.
+type cachedResponse struct {
+	key     cacheKey
+	digest  [sha256.Size]byte
+	code    int
+	body    []byte
+	expires time.Time
+
+	// done is closed once the response is available. Until then, the event is being handled.
+	done chan struct{}
+}
+
+// IdempotencyCache keeps the responses that were returned for entitlement events, keyed by EventId, so that
+// redeliveries of the same event get exactly the same response, without being handled again. The responses are kept
+// separately for each caller scope, so that a caller never gets the response to the event of another caller.
+type IdempotencyCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[cacheKey]*list.Element
+	order    *list.List
+}
+
+// CreateIdempotencyCache creates a new IdempotencyCache that holds up to capacity responses, each for the duration
+// of ttl.
+func CreateIdempotencyCache(capacity int, ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[cacheKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Reset clears all cached responses.
+func (c *IdempotencyCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[cacheKey]*list.Element)
+	c.order = list.New()
+}
+
+// do returns the cached response for the given event, if the event has been seen before in the given caller scope.
+// Otherwise, it invokes the handler and caches its response. Concurrent deliveries of the same event wait for the
+// first one to complete. A redelivered event with a different payload results in http.StatusConflict.
+func (c *IdempotencyCache) do(scope string, e model.EntitlementEvent, handler func() (int, []byte)) (int, []byte) {
+	digest, err := digestOf(e)
+	if err != nil {
+		return handler()
+	}
+	key := cacheKey{scope: scope, eventId: e.EventId}
+
+	var element *list.Element
+	for {
+		c.mu.Lock()
+		entry, found := c.lookup(key)
+		if !found {
+			element = c.insert(&cachedResponse{
+				key:    key,
+				digest: digest,
+				done:   make(chan struct{}),
+			})
+			c.mu.Unlock()
+			break
+		}
+		c.mu.Unlock()
+
+		<-entry.done
+
+		c.mu.Lock()
+		current, stillCached := c.entries[key]
+		stillCached = stillCached && current.Value.(*cachedResponse) == entry
+		c.mu.Unlock()
+		if !stillCached {
+			// The first delivery didn't produce a cacheable response; handle this one afresh.
+			continue
+		}
+
+		if entry.digest != digest {
+			return http.StatusConflict, errorBody(model.ERRORCODE_CONFLICT,
+				"An event with the same eventId, but a different payload, has already been received.", nil)
+		}
+		return entry.code, entry.body
+	}
+
+	code, body := handler()
+
+	c.mu.Lock()
+	entry := element.Value.(*cachedResponse)
+	if code >= 500 {
+		// Server side failures are transient, and redeliveries should be handled again.
+		if c.entries[key] == element {
+			c.remove(element)
+		}
+	} else {
+		entry.code = code
+		entry.body = body
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	close(entry.done)
+	c.mu.Unlock()
+
+	return code, body
+}
+
+// lookup returns the entry for the given key, if there is one and it has not expired. Must be called with mu held.
+func (c *IdempotencyCache) lookup(key cacheKey) (*cachedResponse, bool) {
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	entry := element.Value.(*cachedResponse)
+	if isDone(entry) && time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	return entry, true
+}
+
+// insert adds the entry to the cache, evicting the oldest completed entries if the cache is at capacity. Must be
+// called with mu held.
+func (c *IdempotencyCache) insert(entry *cachedResponse) *list.Element {
+	for element := c.order.Front(); element != nil && c.order.Len() >= c.capacity; {
+		next := element.Next()
+		if isDone(element.Value.(*cachedResponse)) {
+			c.remove(element)
+		}
+		element = next
+	}
+
+	element := c.order.PushBack(entry)
+	c.entries[entry.key] = element
+	return element
+}
+
+// remove removes the given element from the cache. Must be called with mu held.
+func (c *IdempotencyCache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*cachedResponse).key)
+	c.order.Remove(element)
+}
+
+func isDone(entry *cachedResponse) bool {
+	select {
+	case <-entry.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// digestOf returns a digest of the event's contents, that is independent of the formatting of the original payload.
+func digestOf(e model.EntitlementEvent) ([sha256.Size]byte, error) {
+	contents, err := json.Marshal(e)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(contents), nil
+}
@@ -15,51 +15,358 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"procurementlistenerservice/async"
+	"procurementlistenerservice/interceptor"
 	"procurementlistenerservice/model"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Server is the main struct for the backend service.
 type Server struct {
-	port    int
-	service model.PartnerBackendService
+	port           int
+	service        model.ContextPartnerBackendService
+	tracker        *async.Tracker
+	idempotency    *IdempotencyCache
+	scope          func(context.Context) string
+	requestTimeout time.Duration
+	interceptors   []interceptor.Interceptor
+	middleware     []Middleware
+	handlers       []route
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	shutdownHooks  []func() error
+	pathPrefix     string
+	router         *mux.Router
+	certificates   *certificateReloader
+
+	// backendCalls tracks the backend invocations that are still running, including the ones whose request has
+	// already timed out.
+	backendCalls sync.WaitGroup
+
+	mu         sync.Mutex
+	httpServer *http.Server
+}
+
+// Middleware decorates an http.Handler, e.g. to authenticate the requests before they are handled.
+type Middleware func(next http.Handler) http.Handler
+
+// route is an additional endpoint of the server.
+type route struct {
+	method  string
+	path    string
+	handler http.Handler
+}
+
+const (
+	// DEFAULT_REQUEST_TIMEOUT is the default time that the backend is given to handle an entitlement event.
+	DEFAULT_REQUEST_TIMEOUT time.Duration = 30 * time.Second
+
+	// RETRY_AFTER_SECONDS is the delay that is suggested to the caller, when the backend runs out of time or is
+	// unavailable.
+	RETRY_AFTER_SECONDS int = 5
+
+	// DEFAULT_READ_TIMEOUT is the default time that a client is given to send a complete request.
+	DEFAULT_READ_TIMEOUT time.Duration = 30 * time.Second
+
+	// DEFAULT_WRITE_TIMEOUT is the default time from the end of reading a request until its response must be written.
+	// It leaves room for the backend to use up DEFAULT_REQUEST_TIMEOUT.
+	DEFAULT_WRITE_TIMEOUT time.Duration = DEFAULT_REQUEST_TIMEOUT + 15*time.Second
+
+	// DEFAULT_IDLE_TIMEOUT is the default time that an idle keep-alive connection is kept open.
+	DEFAULT_IDLE_TIMEOUT time.Duration = 120 * time.Second
+)
+
+// Option is a configuration option for the Server.
+type Option func(*Server) error
+
+// WithAsyncTracker configures the tracker that records the events that the backend responds to with
+// RESPONSESTATUS_ASYNC. It also enables the endpoints for listing and completing the pending events.
+func WithAsyncTracker(tracker *async.Tracker) Option {
+	return func(s *Server) error {
+		s.tracker = tracker
+		return nil
+	}
+}
+
+// WithIdempotencyCache configures the cache that is used for replaying the responses to redelivered events. By
+// default, a cache with DEFAULT_IDEMPOTENCY_CAPACITY and DEFAULT_IDEMPOTENCY_TTL is used.
+func WithIdempotencyCache(cache *IdempotencyCache) Option {
+	return func(s *Server) error {
+		s.idempotency = cache
+		return nil
+	}
+}
+
+// WithIdempotencyScope configures the function that returns the scope of the caller of a request, from the request
+// context (e.g. the authenticated account). The responses to redelivered events are only replayed to callers in the
+// same scope; the events of other callers are handled afresh, and pass through the interceptors again. By default,
+// all callers share one scope.
+func WithIdempotencyScope(scope func(ctx context.Context) string) Option {
+	return func(s *Server) error {
+		s.scope = scope
+		return nil
+	}
+}
+
+// WithRequestTimeout configures the time that the backend is given to handle an entitlement event. Once it elapses,
+// the context that is passed to the backend is cancelled, and the caller gets a retryable response. A zero timeout
+// disables the deadline. By default, DEFAULT_REQUEST_TIMEOUT is used.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return fmt.Errorf("Request timeout must not be negative: '%v'", timeout)
+		}
+		s.requestTimeout = timeout
+		return nil
+	}
+}
+
+// WithInterceptors configures the interceptors that are run around the backend, for every entitlement event. The
+// first interceptor is the outermost one. Repeated uses of this option append to the chain.
+func WithInterceptors(interceptors ...interceptor.Interceptor) Option {
+	return func(s *Server) error {
+		s.interceptors = append(s.interceptors, interceptors...)
+		return nil
+	}
+}
+
+// WithMiddleware configures the middleware that is run around the built-in endpoints (the entitlement event endpoint
+// and the pending event endpoints) and the additional endpoints, e.g. to authenticate the callers. The first middleware
+// is the outermost one. Repeated uses of this option append to the chain.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(s *Server) error {
+		s.middleware = append(s.middleware, middleware...)
+		return nil
+	}
+}
+
+// WithHandler registers an additional endpoint (e.g. for administration) with the given method and path. The endpoint
+// is run behind the same middleware as the built-in endpoints.
+func WithHandler(method string, path string, handler http.Handler) Option {
+	return func(s *Server) error {
+		s.handlers = append(s.handlers, route{method: method, path: path, handler: handler})
+		return nil
+	}
+}
+
+// WithHTTPTimeouts configures the read, write and idle timeouts of the HTTP server. A zero timeout disables the
+// respective limit. By default, DEFAULT_READ_TIMEOUT, DEFAULT_WRITE_TIMEOUT and DEFAULT_IDLE_TIMEOUT are used.
+func WithHTTPTimeouts(read time.Duration, write time.Duration, idle time.Duration) Option {
+	return func(s *Server) error {
+		if read < 0 || write < 0 || idle < 0 {
+			return fmt.Errorf("HTTP timeouts must not be negative: read='%v' write='%v' idle='%v'", read, write, idle)
+		}
+		s.readTimeout = read
+		s.writeTimeout = write
+		s.idleTimeout = idle
+		return nil
+	}
 }
 
-// CreateServer creates a new Server instance for serving incoming requests at the given port.
-func CreateServer(serverPort int, service model.PartnerBackendService) (*Server, error) {
-	return &Server{
-		port:    serverPort,
-		service: service,
-	}, nil
+// WithPathPrefix configures a path prefix (e.g. "/procurement") under which all endpoints of the server are served,
+// so that its handler can be mounted next to other handlers.
+func WithPathPrefix(prefix string) Option {
+	return func(s *Server) error {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("Path prefix must start with '/': '%s'", prefix)
+		}
+		s.pathPrefix = prefix
+		return nil
+	}
+}
+
+// WithTLS configures the server to terminate TLS with the given certificates, and optionally to require client
+// certificates. The certificate files are reloaded when they change.
+func WithTLS(config TLSConfig) Option {
+	return func(s *Server) error {
+		certificates, err := createCertificateReloader(config)
+		if err != nil {
+			return err
+		}
+		s.certificates = certificates
+		return nil
+	}
+}
+
+// WithShutdownHook registers a function that flushes backend state when the server is shut down. The hooks are run
+// after the in-flight requests have been drained, in the reverse order of their registration, so that state is
+// flushed before whatever it depends on is closed.
+func WithShutdownHook(hook func() error) Option {
+	return func(s *Server) error {
+		s.shutdownHooks = append(s.shutdownHooks, hook)
+		return nil
+	}
+}
+
+// CreateServer creates a new Server instance for serving incoming requests at the given port. If the service
+// implements model.ContextPartnerBackendService, the context-aware variant is used.
+func CreateServer(serverPort int, service model.PartnerBackendService, options ...Option) (*Server, error) {
+	s := &Server{
+		port:           serverPort,
+		service:        model.AdaptContext(service),
+		idempotency:    CreateIdempotencyCache(DEFAULT_IDEMPOTENCY_CAPACITY, DEFAULT_IDEMPOTENCY_TTL),
+		requestTimeout: DEFAULT_REQUEST_TIMEOUT,
+		readTimeout:    DEFAULT_READ_TIMEOUT,
+		writeTimeout:   DEFAULT_WRITE_TIMEOUT,
+		idleTimeout:    DEFAULT_IDLE_TIMEOUT,
+	}
+
+	for _, option := range options {
+		err := option(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to configure server: '%v'", err)
+		}
+	}
+
+	if len(s.interceptors) != 0 {
+		s.service = model.AdaptContext(interceptor.Chain(model.FromContextService(s.service), s.interceptors...))
+	}
+
+	s.router = mux.NewRouter()
+	if s.pathPrefix != "" {
+		s.registerDispatchers(s.router.PathPrefix(s.pathPrefix).Subrouter())
+	} else {
+		s.registerDispatchers(s.router)
+	}
+
+	return s, nil
+}
+
+// Handler returns the http.Handler that serves the endpoints of the server, under the configured path prefix. It
+// can be mounted in an existing HTTP server, or used with httptest.NewServer. When the handler is used instead of
+// Start, Shutdown only drains the backend calls and flushes the backend state; draining the HTTP connections is up to
+// the owner of the HTTP server.
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
+// Start serves the handler of the server at the configured port, with request logging. It blocks until the server
+// fails, or until Shutdown is called, in which case nil is returned.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	if s.httpServer != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("Server is already started.")
+	}
+	s.httpServer = &http.Server{
+		Addr:         ":" + strconv.Itoa(s.port),
+		Handler:      handlers.LoggingHandler(os.Stderr, s.Handler()),
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+		IdleTimeout:  s.idleTimeout,
+	}
+	httpServer := s.httpServer
+	s.mu.Unlock()
+
+	var err error
+	if s.certificates != nil {
+		httpServer.TLSConfig = s.certificates.tlsConfig()
+		log.Printf("Starting TLS server on port '%d'\n", s.port)
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Starting server on port '%d'\n", s.port)
+		err = httpServer.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting new connections, and waits until the in-flight requests and the backend calls that they
+// started are done. It then runs the shutdown hooks, to flush the state of the backend. If the context is done
+// before the requests are drained, the context's error is returned, but the hooks are still run.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	httpServer := s.httpServer
+	s.mu.Unlock()
+
+	var err error
+	if httpServer != nil {
+		log.Print("Shutting down server, draining in-flight requests")
+		err = httpServer.Shutdown(ctx)
+	}
+	if err == nil {
+		err = s.waitForBackendCalls(ctx)
+	}
+	if err != nil {
+		log.Printf("Unable to drain in-flight requests: '%v'\n", err)
+	}
+
+	for i := len(s.shutdownHooks) - 1; i >= 0; i-- {
+		hookErr := s.shutdownHooks[i]()
+		if hookErr != nil {
+			log.Printf("Error flushing backend state: '%v'\n", hookErr)
+			if err == nil {
+				err = hookErr
+			}
+		}
+	}
+	return err
 }
 
-// Start initiates the http service and starts listening to incoming connections.
-func (s *Server) Start() {
-	router := mux.NewRouter()
+// waitForBackendCalls blocks until the running backend calls are done, or until the context is done.
+func (s *Server) waitForBackendCalls(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.backendCalls.Wait()
+		close(done)
+	}()
 
-	http.Handle("/", handlers.LoggingHandler(os.Stderr, router))
-	s.registerDispatchers(router)
-	log.Printf("Starting server on port '%d'\n", s.port)
-	http.ListenAndServe(":"+strconv.Itoa(s.port), nil)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (s *Server) registerDispatchers(router *mux.Router) {
-	log.Print("Registering dispatcher at /entitlementEvents")
-	router.HandleFunc("/entitlementEvents", s.onEntitlementEvent).Methods("POST")
+	log.Printf("Registering dispatcher at %s/entitlementEvents\n", s.pathPrefix)
+	router.Handle("/entitlementEvents", s.withMiddleware(http.HandlerFunc(s.onEntitlementEvent))).Methods("POST")
+
+	if s.tracker != nil {
+		log.Printf("Registering dispatcher at %s/pendingEvents\n", s.pathPrefix)
+		router.Handle("/pendingEvents", s.withMiddleware(http.HandlerFunc(s.onListPendingEvents))).Methods("GET")
+		router.Handle("/pendingEvents/{eventId}/completion",
+			s.withMiddleware(http.HandlerFunc(s.onCompletePendingEvent))).Methods("POST")
+	}
+
+	for _, r := range s.handlers {
+		log.Printf("Registering dispatcher at %s%s\n", s.pathPrefix, r.path)
+		router.Handle(r.path, s.withMiddleware(r.handler)).Methods(r.method)
+	}
+}
+
+// withMiddleware wraps the handler in the configured middleware.
+func (s *Server) withMiddleware(handler http.Handler) http.Handler {
+	wrapped := handler
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		wrapped = s.middleware[i](wrapped)
+	}
+	return wrapped
 }
 
 func (s *Server) onEntitlementEvent(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("Unable to read body: '%v'\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, model.ERRORCODE_INVALIDREQUEST, "Unable to read the request body.")
 		return
 	}
 
@@ -67,49 +374,218 @@ func (s *Server) onEntitlementEvent(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &notification)
 	if err != nil {
 		log.Printf("Unable to parse body: '%v'\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, model.ERRORCODE_INVALIDREQUEST,
+			fmt.Sprintf("Unable to parse the request body: %v", err))
 		return
 	}
 
 	err = model.ValidateEntitlementEvent(notification)
 	if err != nil {
 		log.Printf("Invalid entitlement event received: '%v'\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		if validationErr, ok := err.(*model.ValidationError); ok {
+			writeResponse(w, http.StatusBadRequest, validationErrorBody(validationErr))
+		} else {
+			writeError(w, http.StatusBadRequest, model.ERRORCODE_INVALIDREQUEST, err.Error())
+		}
 		return
 	}
 
-	response, err := s.service.OnEntitlementEvent(notification)
+	scope := ""
+	if s.scope != nil {
+		scope = s.scope(r.Context())
+	}
+	code, responseBytes := s.idempotency.do(scope, notification, func() (int, []byte) {
+		return s.dispatchEntitlementEvent(r.Context(), notification)
+	})
+	if code == http.StatusConflict {
+		log.Printf("Event redelivered with a different payload: '%s'\n", notification.EventId)
+	}
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER_SECONDS))
+	}
+
+	writeResponse(w, code, responseBytes)
+}
+
+// backendResult is the outcome of a backend invocation.
+type backendResult struct {
+	response model.EntitlementEventResponse
+	err      error
+}
+
+// invokeBackend calls the backend with a context that is bound by the request timeout. If the backend doesn't return
+// before the context is done, the context's error is returned. The backend call is left to run to completion in that
+// case, and its result is discarded. A panic in the backend is returned as an error.
+func (s *Server) invokeBackend(
+	ctx context.Context, notification model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+
+	if s.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+
+	results := make(chan backendResult, 1)
+	s.backendCalls.Add(1)
+	go func() {
+		defer s.backendCalls.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic while handling entitlement event '%s': '%v'\n%s", notification.EventId, r,
+					debug.Stack())
+				results <- backendResult{err: fmt.Errorf("Panic while handling entitlement event: '%v'", r)}
+			}
+		}()
+		response, err := s.service.OnEntitlementEventContext(ctx, notification)
+		results <- backendResult{response, err}
+	}()
+
+	select {
+	case result := <-results:
+		return result.response, result.err
+	case <-ctx.Done():
+		return model.EntitlementEventResponse{}, ctx.Err()
+	}
+}
+
+// dispatchEntitlementEvent hands the event over to the backend, and returns the HTTP status code and body that should
+// be sent back for the backend's response.
+func (s *Server) dispatchEntitlementEvent(ctx context.Context, notification model.EntitlementEvent) (int, []byte) {
+	response, err := s.invokeBackend(ctx, notification)
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		log.Printf("Backend did not handle entitlement event in time: '%s' '%v'\n", notification.EventId, err)
+		return http.StatusServiceUnavailable, errorBody(model.ERRORCODE_DEADLINEEXCEEDED,
+			"The event could not be handled in time. Retry the request later.", nil)
+	}
+	if _, ok := err.(*model.UnavailableError); ok {
+		log.Printf("Backend is unavailable for entitlement event: '%s' '%v'\n", notification.EventId, err)
+		return http.StatusServiceUnavailable, errorBody(model.ERRORCODE_UNAVAILABLE,
+			"The event cannot be handled right now. Retry the request later.", nil)
+	}
+	if validationErr, ok := err.(*model.ValidationError); ok {
+		log.Printf("Entitlement event refused as invalid: '%v'\n", err)
+		return http.StatusBadRequest, validationErrorBody(validationErr)
+	}
 	if err != nil {
 		log.Printf("Error handling entitlement event: '%v'\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, internalErrorBody()
+	}
+
+	if response.Status == model.RESPONSESTATUS_REJECTED && response.Reason == nil {
+		response.Reason = model.NewRejection(model.REJECTIONREASON_UNSPECIFIED, "The event was rejected.")
 	}
 
 	responseBytes, err := json.Marshal(response)
 	if err != nil {
 		log.Printf("Error marshalling response: '%v'\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, internalErrorBody()
 	}
 
 	switch response.Status {
 	case model.RESPONSESTATUS_INVALIDREQUEST:
-		w.WriteHeader(http.StatusBadRequest)
-		break
+		return http.StatusBadRequest,
+			errorBody(model.ERRORCODE_INVALIDREQUEST, "The entitlement event is not valid.", nil)
 	case model.RESPONSESTATUS_ACCEPTED:
-		w.WriteHeader(http.StatusOK)
-		w.Write(responseBytes)
-		break
+		return http.StatusOK, responseBytes
 	case model.RESPONSESTATUS_ASYNC:
-		w.WriteHeader(http.StatusAccepted)
-		break
+		if s.tracker == nil {
+			log.Printf("Async response without a tracker, event will not be completed: '%s'\n", notification.EventId)
+		} else {
+			err = s.tracker.Track(notification)
+			if err != nil {
+				log.Printf("Error tracking pending event: '%v'\n", err)
+				return http.StatusInternalServerError, internalErrorBody()
+			}
+		}
+		return http.StatusAccepted, responseBytes
 	case model.RESPONSESTATUS_REJECTED:
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(responseBytes)
-		break
+		// Rejections are business decisions, and are kept distinct from the protocol errors that result in
+		// http.StatusBadRequest.
+		return http.StatusUnprocessableEntity, responseBytes
+	}
 
-	default:
-		log.Printf("Unknown response status: '%d' response: '%v'\n", response.Status, response)
+	log.Printf("Unknown response status: '%d' response: '%v'\n", response.Status, response)
+	return http.StatusInternalServerError, internalErrorBody()
+}
 
+// completionRequest is the body of a request to complete a pending event.
+type completionRequest struct {
+	// Status is the final status of the event, either "ACCEPTED" or "REJECTED".
+	Status string `json:"status"`
+
+	// Reason optionally explains why the event was rejected.
+	Reason *model.RejectionReason `json:"reason"`
+}
+
+func (s *Server) onListPendingEvents(w http.ResponseWriter, r *http.Request) {
+	pending, err := s.tracker.Pending()
+	if err != nil {
+		log.Printf("Error listing pending events: '%v'\n", err)
+		writeResponse(w, http.StatusInternalServerError, internalErrorBody())
+		return
+	}
+
+	responseBytes, err := json.Marshal(pending)
+	if err != nil {
+		log.Printf("Error marshalling response: '%v'\n", err)
+		writeResponse(w, http.StatusInternalServerError, internalErrorBody())
+		return
+	}
+
+	writeResponse(w, http.StatusOK, responseBytes)
+}
+
+func (s *Server) onCompletePendingEvent(w http.ResponseWriter, r *http.Request) {
+	eventId := mux.Vars(r)["eventId"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Unable to read body: '%v'\n", err)
+		writeError(w, http.StatusBadRequest, model.ERRORCODE_INVALIDREQUEST, "Unable to read the request body.")
+		return
 	}
+
+	var request completionRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		log.Printf("Unable to parse body: '%v'\n", err)
+		writeError(w, http.StatusBadRequest, model.ERRORCODE_INVALIDREQUEST,
+			fmt.Sprintf("Unable to parse the request body: %v", err))
+		return
+	}
+
+	status, err := model.ParseResponseStatus(request.Status)
+	if err != nil || (status != model.RESPONSESTATUS_ACCEPTED && status != model.RESPONSESTATUS_REJECTED) {
+		log.Printf("Invalid completion status: '%s'\n", request.Status)
+		writeResponse(w, http.StatusBadRequest, validationErrorBody(model.NewFieldValidationError(
+			model.JsonPointer("status"), "Status must be either 'ACCEPTED' or 'REJECTED': '%s'.", request.Status)))
+		return
+	}
+
+	notification, err := s.tracker.Complete(eventId, status, request.Reason)
+	if err == async.ErrPendingEventNotFound {
+		writeError(w, http.StatusNotFound, model.ERRORCODE_NOTFOUND,
+			fmt.Sprintf("Pending event not found: '%s'.", eventId))
+		return
+	}
+	if err != nil {
+		log.Printf("Error completing pending event: '%v'\n", err)
+		if notification.EventId != "" {
+			// The event was completed, but the marketplace could not be notified.
+			writeError(w, http.StatusBadGateway, model.ERRORCODE_INTERNAL,
+				"The event was completed, but the marketplace could not be notified. Retry the completion.")
+		} else {
+			writeResponse(w, http.StatusInternalServerError, internalErrorBody())
+		}
+		return
+	}
+
+	responseBytes, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("Error marshalling response: '%v'\n", err)
+		writeResponse(w, http.StatusInternalServerError, internalErrorBody())
+		return
+	}
+
+	writeResponse(w, http.StatusOK, responseBytes)
 }
@@ -0,0 +1,457 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"procurementlistenerservice/async"
+	"procurementlistenerservice/interceptor"
+	"procurementlistenerservice/model"
+	"testing"
+	"time"
+)
+
+// slowBackend is a context-aware backend that blocks until its context is done, and reports the context's error.
+type slowBackend struct {
+	observed chan error
+}
+
+func (b *slowBackend) OnEntitlementEventContext(
+	ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+
+	<-ctx.Done()
+	b.observed <- ctx.Err()
+	return model.EntitlementEventResponse{}, ctx.Err()
+}
+
+// acceptingBackend is a plain backend that accepts every event.
+type acceptingBackend struct{}
+
+func (b acceptingBackend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return model.EntitlementEventResponse{
+		Status:  model.RESPONSESTATUS_ACCEPTED,
+		EventId: e.EventId,
+	}, nil
+}
+
+// blockingBackend accepts every event, but only once it is released.
+type blockingBackend struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	close(b.started)
+	<-b.release
+	return model.EntitlementEventResponse{Status: model.RESPONSESTATUS_ACCEPTED, EventId: e.EventId}, nil
+}
+
+// panickingBackend panics on every event.
+type panickingBackend struct{}
+
+func (b panickingBackend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	panic("backend failure")
+}
+
+// unavailableBackend fails every event as temporarily unavailable.
+type unavailableBackend struct{}
+
+func (b unavailableBackend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return model.EntitlementEventResponse{}, &model.UnavailableError{Message: "Upstream is down."}
+}
+
+var testEvent = model.EntitlementEvent{
+	EventId:       "1",
+	EventType:     model.ENTITLEMENT_CREATED,
+	EntitlementId: "E1",
+	ServiceId:     "S1",
+	PlanId:        "P1",
+}
+
+func TestRequestTimeout(t *testing.T) {
+	backend := &slowBackend{observed: make(chan error, 1)}
+	s, err := CreateServer(0, model.FromContextService(backend), WithRequestTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := s.dispatchEntitlementEvent(context.Background(), testEvent)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("Unexpected code: actual='%d', expected='%d'", code, http.StatusServiceUnavailable)
+	}
+
+	var response model.ErrorResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Error.Code != model.ERRORCODE_DEADLINEEXCEEDED {
+		t.Errorf("Unexpected error code: '%s'", response.Error.Code)
+	}
+
+	select {
+	case err := <-backend.observed:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Unexpected context error observed by the backend: '%v'", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("The backend did not observe the deadline.")
+	}
+}
+
+func TestContextAdapter(t *testing.T) {
+	s, err := CreateServer(0, acceptingBackend{}, WithRequestTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := s.dispatchEntitlementEvent(context.Background(), testEvent)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected code: actual='%d', expected='%d'", code, http.StatusOK)
+	}
+}
+
+// freePort returns a local port that is not in use.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestBackendPanic(t *testing.T) {
+	s, err := CreateServer(0, panickingBackend{}, WithRequestTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := s.dispatchEntitlementEvent(context.Background(), testEvent)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("Unexpected code: actual='%d', expected='%d'", code, http.StatusInternalServerError)
+	}
+
+	var response model.ErrorResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Error.Code != model.ERRORCODE_INTERNAL {
+		t.Errorf("Unexpected error code: '%s'", response.Error.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("The backend call was not completed: '%v'", err)
+	}
+}
+
+func TestBackendUnavailable(t *testing.T) {
+	s, err := CreateServer(0, unavailableBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer := httptest.NewServer(s.Handler())
+	defer testServer.Close()
+
+	body, err := json.Marshal(testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.Post(testServer.URL+"/entitlementEvents", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusServiceUnavailable || response.Header.Get("Retry-After") == "" {
+		t.Errorf("Unexpected response: code='%d' Retry-After='%s'", response.StatusCode,
+			response.Header.Get("Retry-After"))
+	}
+	var errorResponse model.ErrorResponse
+	err = json.NewDecoder(response.Body).Decode(&errorResponse)
+	if err != nil || errorResponse.Error.Code != model.ERRORCODE_UNAVAILABLE {
+		t.Errorf("Unexpected error: '%+v' '%v'", errorResponse, err)
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	// The caller is taken from a header, and only caller 'A' is allowed to deliver events.
+	type callerKey struct{}
+	caller := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, r.Header.Get("Caller"))))
+		})
+	}
+	onlyA := func(next interceptor.Handler) interceptor.Handler {
+		return func(ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+			if ctx.Value(callerKey{}) != "A" {
+				return model.EntitlementEventResponse{}, model.NewFieldValidationError(model.JsonPointer("eventId"), "Caller is not allowed.")
+			}
+			return next(ctx, e)
+		}
+	}
+	s, err := CreateServer(0, acceptingBackend{}, WithMiddleware(caller), WithInterceptors(onlyA),
+		WithIdempotencyScope(func(ctx context.Context) string { return ctx.Value(callerKey{}).(string) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer := httptest.NewServer(s.Handler())
+	defer testServer.Close()
+
+	changed := testEvent
+	changed.PlanId = "P2"
+	for _, test := range []struct {
+		caller   string
+		event    model.EntitlementEvent
+		expected int
+	}{
+		{"A", testEvent, http.StatusOK},
+		{"A", testEvent, http.StatusOK},
+		{"A", changed, http.StatusConflict},
+		// Another caller neither gets the cached response, nor learns that the event exists.
+		{"B", testEvent, http.StatusBadRequest},
+		{"C", changed, http.StatusBadRequest},
+	} {
+		body, err := json.Marshal(test.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := http.NewRequest("POST", testServer.URL+"/entitlementEvents", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Caller", test.caller)
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != test.expected {
+			t.Errorf("Unexpected status code for caller '%s': actual='%d', expected='%d'", test.caller,
+				response.StatusCode, test.expected)
+		}
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	backend := &blockingBackend{started: make(chan struct{}), release: make(chan struct{})}
+	flushed := make(chan struct{})
+	port := freePort(t)
+	s, err := CreateServer(port, backend, WithShutdownHook(func() error {
+		close(flushed)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+
+	body, err := json.Marshal(testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := make(chan int, 1)
+	go func() {
+		url := fmt.Sprintf("http://localhost:%d/entitlementEvents", port)
+		for i := 0; i < 50; i++ {
+			response, err := http.Post(url, "application/json", bytes.NewReader(body))
+			if err == nil {
+				response.Body.Close()
+				codes <- response.StatusCode
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		codes <- 0
+	}()
+	<-backend.started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-flushed:
+		t.Fatal("The backend state was flushed before the in-flight request was drained.")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(backend.release)
+	if code := <-codes; code != http.StatusOK {
+		t.Errorf("Unexpected code: actual='%d', expected='%d'", code, http.StatusOK)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Unexpected shutdown error: '%v'", err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Unexpected start error: '%v'", err)
+	}
+	select {
+	case <-flushed:
+	default:
+		t.Error("The backend state was not flushed.")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	backend := &blockingBackend{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(backend.release)
+	flushed := false
+	s, err := CreateServer(0, backend, WithRequestTimeout(10*time.Millisecond), WithShutdownHook(func() error {
+		flushed = true
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The request times out, but the backend call keeps running.
+	code, _ := s.dispatchEntitlementEvent(context.Background(), testEvent)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("Unexpected code: actual='%d', expected='%d'", code, http.StatusServiceUnavailable)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Unexpected shutdown error: actual='%v', expected='%v'", err, context.DeadlineExceeded)
+	}
+	if !flushed {
+		t.Error("The backend state was not flushed after the shutdown timeout.")
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	s, err := CreateServer(0, acceptingBackend{}, WithPathPrefix("/procurement/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer := httptest.NewServer(s.Handler())
+	defer testServer.Close()
+
+	body, err := json.Marshal(testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]int{
+		"/procurement/entitlementEvents": http.StatusOK,
+		"/entitlementEvents":             http.StatusNotFound,
+	} {
+		response, err := http.Post(testServer.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != expected {
+			t.Errorf("Unexpected code for '%s': actual='%d', expected='%d'", path, response.StatusCode, expected)
+		}
+	}
+}
+
+func TestInvalidPathPrefix(t *testing.T) {
+	_, err := CreateServer(0, acceptingBackend{}, WithPathPrefix("procurement"))
+	if err == nil {
+		t.Error("Expected an error for a path prefix without a leading '/'.")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	middleware := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				if r.Header.Get("Authorization") == "" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pendingStore, err := async.OpenFilePendingStore(filepath.Join(dir, "pending.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := CreateServer(0, acceptingBackend{},
+		WithAsyncTracker(async.CreateTracker(pendingStore, nil, acceptingBackend{})),
+		WithMiddleware(middleware("outer"), middleware("inner")),
+		WithHandler("GET", "/backup", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer := httptest.NewServer(s.Handler())
+	defer testServer.Close()
+
+	body, err := json.Marshal(testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []struct {
+		method string
+		path   string
+		body   []byte
+	}{
+		{"POST", "/entitlementEvents", body},
+		{"GET", "/pendingEvents", nil},
+		{"POST", "/pendingEvents/1/completion", []byte(`{"status": "ACCEPTED"}`)},
+		{"GET", "/backup", nil},
+	}
+	for _, request := range requests {
+		order = nil
+		r, err := http.NewRequest(request.method, testServer.URL+request.path, bytes.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Unexpected code for '%s': actual='%d', expected='%d'", request.path, response.StatusCode,
+				http.StatusUnauthorized)
+		}
+		if len(order) != 1 || order[0] != "outer" {
+			t.Errorf("Unexpected middleware order for '%s': '%v'", request.path, order)
+		}
+	}
+}
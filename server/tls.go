@@ -0,0 +1,224 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// TLS_RELOAD_CHECK_INTERVAL is how often the certificate files are checked for changes, at most.
+	TLS_RELOAD_CHECK_INTERVAL time.Duration = 10 * time.Second
+)
+
+// TLSConfig configures the server to terminate TLS, and optionally to authenticate its clients with certificates.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate (chain) and private key of the server.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is the PEM encoded bundle of the CAs that client certificates are verified against. Without it,
+	// client certificates are not requested.
+	ClientCAFile string
+
+	// RequireClientCert rejects the connections without a valid client certificate. Otherwise, a client certificate
+	// is only verified if the client presents one.
+	RequireClientCert bool
+
+	// AllowedClientNames, if not empty, are the subject common names or DNS names that client certificates must
+	// carry. It implies RequireClientCert, so that clients without a certificate are rejected as well.
+	AllowedClientNames []string
+}
+
+// Validate checks that the certificate and key are given, and that the client options are consistent.
+func (c TLSConfig) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("Both a certificate and a key file are required for TLS.")
+	}
+	if c.ClientCAFile == "" && (c.RequireClientCert || len(c.AllowedClientNames) != 0) {
+		return fmt.Errorf("A client CA file is required to verify client certificates.")
+	}
+	return nil
+}
+
+// certificateReloader keeps the certificates of a TLSConfig, and reloads them when their files change, so that
+// renewed certificates are picked up without a restart.
+type certificateReloader struct {
+	config        TLSConfig
+	checkInterval time.Duration
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	files       map[string]os.FileInfo
+	lastCheck   time.Time
+}
+
+func createCertificateReloader(config TLSConfig) (*certificateReloader, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &certificateReloader{
+		config:        config,
+		checkInterval: TLS_RELOAD_CHECK_INTERVAL,
+	}
+	err = r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// paths returns the paths of the files that the certificates are loaded from.
+func (r *certificateReloader) paths() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+// load reads the certificate files. The caller must hold the lock, unless the reloader is not shared yet.
+func (r *certificateReloader) load() error {
+	files := map[string]os.FileInfo{}
+	for _, path := range r.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		files[path] = info
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load certificate '%s' and key '%s': '%v'.", r.config.CertFile,
+			r.config.KeyFile, err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No certificates in client CA file '%s'.", r.config.ClientCAFile)
+		}
+	}
+
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.files = files
+	return nil
+}
+
+// current returns the current certificates, after reloading them if their files changed since they were loaded. If
+// the changed files cannot be loaded (e.g. because only the certificate was replaced so far), the previous
+// certificates are kept, and the files are checked again later.
+func (r *certificateReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastCheck) >= r.checkInterval {
+		r.lastCheck = now
+		if r.changed() {
+			err := r.load()
+			if err != nil {
+				log.Printf("Unable to reload TLS certificates, keeping the current ones: '%v'\n", err)
+			} else {
+				log.Printf("Reloaded TLS certificate '%s'\n", r.config.CertFile)
+			}
+		}
+	}
+	return r.certificate, r.clientCAs
+}
+
+// changed reports whether any of the files was modified or replaced since the certificates were loaded. Replaced
+// files are detected by their identity too, since modification times can be coarse.
+func (r *certificateReloader) changed() bool {
+	for _, path := range r.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return true
+		}
+		loaded := r.files[path]
+		if !os.SameFile(info, loaded) || !info.ModTime().Equal(loaded.ModTime()) || info.Size() != loaded.Size() {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig returns the configuration for the HTTP server, which picks up the current certificates for every
+// handshake. The protocols are set explicitly, since the HTTP server only adds them to its own copy of the
+// configuration, and the configuration of each connection replaces it.
+func (r *certificateReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		certificate, clientCAs := r.current()
+		config := &tls.Config{
+			MinVersion:       base.MinVersion,
+			NextProtos:       base.NextProtos,
+			Certificates:     []tls.Certificate{*certificate},
+			ClientCAs:        clientCAs,
+			VerifyConnection: r.verifyClientName,
+		}
+		switch {
+		case clientCAs == nil:
+			config.ClientAuth = tls.NoClientCert
+		case r.config.RequireClientCert || len(r.config.AllowedClientNames) != 0:
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		return config, nil
+	}
+	return base
+}
+
+// verifyClientName checks that the verified client certificate carries one of the allowed names, if any.
+func (r *certificateReloader) verifyClientName(state tls.ConnectionState) error {
+	if len(r.config.AllowedClientNames) == 0 {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("Client certificate is required.")
+	}
+
+	leaf := state.PeerCertificates[0]
+	names := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	for _, allowed := range r.config.AllowedClientNames {
+		for _, name := range names {
+			if name != "" && name == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Client certificate name is not allowed: '%v'.", names)
+}
@@ -0,0 +1,272 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate along with its private key.
+type testCertificate struct {
+	certificate *x509.Certificate
+	der         []byte
+	key         *ecdsa.PrivateKey
+}
+
+// createCertificate creates a certificate with the given common name and serial number, signed by the given CA, or
+// self-signed if the CA is nil.
+func createCertificate(t *testing.T, name string, serial int64, ca *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.certificate, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCertificate{certificate: certificate, der: der, key: key}
+}
+
+// write writes the certificate and key as PEM files with the given prefix, and returns their paths.
+func (c testCertificate) write(t *testing.T, dir string, prefix string) (string, string) {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, prefix+".crt")
+	keyFile := filepath.Join(dir, prefix+".key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsClient returns a client that trusts the CA, and presents the given client certificate, if any.
+func tlsClient(ca testCertificate, client *testCertificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	config := &tls.Config{RootCAs: roots}
+	if client != nil {
+		config.Certificates = []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := createCertificate(t, "ca", 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := createCertificate(t, "server", 2, &ca).write(t, dir, "server")
+	allowed := createCertificate(t, "marketplace", 3, &ca)
+	other := createCertificate(t, "other", 4, &ca)
+	untrusted := createCertificate(t, "marketplace", 5, nil)
+
+	// The allowed names imply that a client certificate is required.
+	configs := []struct {
+		require bool
+		names   []string
+	}{
+		{true, []string{"marketplace"}},
+		{false, []string{"marketplace"}},
+		{false, nil},
+	}
+	for _, c := range configs {
+		restricted := c.require || len(c.names) != 0
+		certificates, err := createCertificateReloader(TLSConfig{
+			CertFile:           certFile,
+			KeyFile:            keyFile,
+			ClientCAFile:       caFile,
+			RequireClientCert:  c.require,
+			AllowedClientNames: c.names,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		testServer.TLS = certificates.tlsConfig()
+		testServer.StartTLS()
+
+		tests := []struct {
+			name    string
+			client  *testCertificate
+			allowed bool
+		}{
+			{"allowed name", &allowed, true},
+			{"other name", &other, len(c.names) == 0},
+			// The client only presents a certificate that is issued by one of the CAs that the server accepts.
+			{"untrusted", &untrusted, !restricted},
+			{"no certificate", nil, !restricted},
+		}
+		for _, test := range tests {
+			response, err := tlsClient(ca, test.client).Get(testServer.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+			if test.allowed && err != nil {
+				t.Errorf("Unexpected error for '%s' (%+v): '%v'", test.name, c, err)
+			}
+			if !test.allowed && err == nil {
+				t.Errorf("Expected an error for '%s' (%+v).", test.name, c)
+			}
+		}
+		testServer.Close()
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := createCertificate(t, "ca", 1, nil)
+	certFile, keyFile := createCertificate(t, "server", 2, &ca).write(t, dir, "server")
+	certificates, err := createCertificateReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificates.checkInterval = 0
+
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	testServer.TLS = certificates.tlsConfig()
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	serial := func() int64 {
+		response, err := tlsClient(ca, nil).Get(testServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		return response.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if actual := serial(); actual != 2 {
+		t.Errorf("Unexpected serial number: actual='%d', expected='%d'", actual, 2)
+	}
+
+	// A key that does not match the certificate yet is not picked up.
+	renewed := createCertificate(t, "server", 3, &ca)
+	renewed.write(t, dir, "renewed")
+	err = os.Rename(filepath.Join(dir, "renewed.crt"), certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := serial(); actual != 2 {
+		t.Errorf("Unexpected serial number with a mismatched key: actual='%d', expected='%d'", actual, 2)
+	}
+
+	err = os.Rename(filepath.Join(dir, "renewed.key"), keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := serial(); actual != 3 {
+		t.Errorf("Unexpected serial number after renewal: actual='%d', expected='%d'", actual, 3)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := createCertificate(t, "ca", 1, nil)
+	certFile, keyFile := createCertificate(t, "server", 2, &ca).write(t, dir, "server")
+	certificates, err := createCertificateReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	testServer.EnableHTTP2 = true
+	testServer.TLS = certificates.tlsConfig()
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	client := tlsClient(ca, nil)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	response, err := client.Get(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ProtoMajor != 2 {
+		t.Errorf("Unexpected protocol: actual='%s', expected='%s'", response.Proto, "HTTP/2.0")
+	}
+}
+
+func TestInvalidTLSConfig(t *testing.T) {
+	configs := []TLSConfig{
+		{CertFile: "server.crt"},
+		{CertFile: "server.crt", KeyFile: "server.key", RequireClientCert: true},
+		{CertFile: "server.crt", KeyFile: "server.key", AllowedClientNames: []string{"marketplace"}},
+	}
+	for _, config := range configs {
+		if config.Validate() == nil {
+			t.Errorf("Expected an error for '%+v'.", config)
+		}
+	}
+}
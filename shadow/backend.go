@@ -0,0 +1,173 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shadow contains a backend that sends each event to a primary backend, and also to a shadow backend, so that
+// a new backend implementation can be verified against the current one on live traffic.
+package shadow
+
+import (
+	"context"
+	"log"
+	"procurementlistenerservice/model"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DEFAULT_SHADOW_TIMEOUT is the default time that the shadow backend is given to handle an event.
+	DEFAULT_SHADOW_TIMEOUT time.Duration = 30 * time.Second
+
+	// SHADOW_QUEUE_SIZE is the number of events that can wait for the shadow backend. Further events are not sent to
+	// the shadow backend until it catches up, and are recorded in the diff log as dropped.
+	SHADOW_QUEUE_SIZE int = 1000
+)
+
+// Backend is a PartnerBackendService that returns the responses of its primary backend. Each event is also sent to
+// the shadow backend, in the background and in order, and the mismatches between the two responses are recorded in
+// the diff log.
+//
+// Only the outcome of the events is compared: the status, the dashboard url, the labels, and the code of the
+// rejection reason. Errors are compared by their presence only, as their messages are specific to each backend.
+type Backend struct {
+	primary model.PartnerBackendService
+	shadow  model.PartnerBackendService
+	diffLog DiffLog
+	timeout time.Duration
+	queue   chan func()
+	pending sync.WaitGroup
+	dropped uint64
+}
+
+var _ model.PartnerBackendService = &Backend{}
+var _ model.ContextPartnerBackendService = &Backend{}
+var _ model.AsyncPartnerBackendService = &Backend{}
+
+// CreateBackend creates a new Backend with the given primary and shadow backends, that records the mismatches in the
+// given diff log.
+func CreateBackend(primary model.PartnerBackendService, shadow model.PartnerBackendService, diffLog DiffLog) *Backend {
+	b := &Backend{
+		primary: primary,
+		shadow:  shadow,
+		diffLog: diffLog,
+		timeout: DEFAULT_SHADOW_TIMEOUT,
+		queue:   make(chan func(), SHADOW_QUEUE_SIZE),
+	}
+	go b.run()
+	return b
+}
+
+func (b *Backend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	return b.OnEntitlementEventContext(context.Background(), e)
+}
+
+func (b *Backend) OnEntitlementEventContext(
+	ctx context.Context, e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+
+	response, err := model.AdaptContext(b.primary).OnEntitlementEventContext(ctx, e)
+
+	b.compare(e, "", outcome(response, err), func() (model.EntitlementEventResponse, error) {
+		// The shadow backend outlives the request, so it is not bound to the request's context.
+		shadowCtx, cancel := context.WithTimeout(context.Background(), b.timeout)
+		defer cancel()
+		return model.AdaptContext(b.shadow).OnEntitlementEventContext(shadowCtx, e)
+	})
+
+	return response, err
+}
+
+// OnEntitlementEventCompleted forwards the completion to the primary backend, and to the shadow backend if it handles
+// completions.
+func (b *Backend) OnEntitlementEventCompleted(
+	e model.EntitlementEvent, status model.ResponseStatus) (model.EntitlementEventResponse, error) {
+
+	response := model.EntitlementEventResponse{Status: status, EventId: e.EventId}
+	var err error
+	if async, ok := b.primary.(model.AsyncPartnerBackendService); ok {
+		response, err = async.OnEntitlementEventCompleted(e, status)
+	}
+
+	if async, ok := b.shadow.(model.AsyncPartnerBackendService); ok {
+		b.compare(e, status.String(), outcome(response, err), func() (model.EntitlementEventResponse, error) {
+			return async.OnEntitlementEventCompleted(e, status)
+		})
+	}
+
+	return response, err
+}
+
+// Dropped returns the number of events that were not sent to the shadow backend, because it was falling behind.
+func (b *Backend) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// Wait waits for the shadow backend to handle all events that were sent to it.
+func (b *Backend) Wait() {
+	b.pending.Wait()
+}
+
+// run calls the shadow backend for the queued events, one at a time.
+func (b *Backend) run() {
+	for task := range b.queue {
+		task()
+		b.pending.Done()
+	}
+}
+
+// compare queues a call to the shadow backend, and records its outcome if it differs from the primary's.
+func (b *Backend) compare(e model.EntitlementEvent, completion string, primary Outcome,
+	call func() (model.EntitlementEventResponse, error)) {
+
+	task := func() {
+		shadow := outcome(call())
+		diffs := differences(primary, shadow)
+		if len(diffs) == 0 {
+			return
+		}
+
+		log.Printf("Shadow backend mismatch: eventId='%s' differences='%v'\n", e.EventId, diffs)
+		err := b.diffLog.Record(Mismatch{
+			Time:        time.Now().UTC(),
+			Event:       e,
+			Completion:  completion,
+			Primary:     primary,
+			Shadow:      shadow,
+			Differences: diffs,
+		})
+		if err != nil {
+			log.Printf("Unable to record shadow backend mismatch: '%v'\n", err)
+		}
+	}
+
+	b.pending.Add(1)
+	select {
+	case b.queue <- task:
+	default:
+		b.pending.Done()
+		dropped := atomic.AddUint64(&b.dropped, 1)
+		log.Printf("Shadow backend is falling behind, not sending event: eventId='%s' dropped='%d'\n",
+			e.EventId, dropped)
+		err := b.diffLog.Record(Mismatch{
+			Time:        time.Now().UTC(),
+			Event:       e,
+			Completion:  completion,
+			Primary:     primary,
+			Differences: []string{"The event was not sent to the shadow backend, which is falling behind."},
+			Dropped:     true,
+		})
+		if err != nil {
+			log.Printf("Unable to record dropped shadow event: '%v'\n", err)
+		}
+	}
+}
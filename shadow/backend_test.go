@@ -0,0 +1,136 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadow
+
+import (
+	"errors"
+	"procurementlistenerservice/model"
+	"sync"
+	"testing"
+)
+
+// fakeBackend responds with the given status to all events, and records the ids of the events it receives.
+type fakeBackend struct {
+	mu     sync.Mutex
+	status model.ResponseStatus
+	err    error
+	events []string
+}
+
+func (b *fakeBackend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, e.EventId)
+	return model.EntitlementEventResponse{Status: b.status, EventId: e.EventId}, b.err
+}
+
+type memoryDiffLog struct {
+	mu         sync.Mutex
+	mismatches []Mismatch
+}
+
+func (l *memoryDiffLog) Record(m Mismatch) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mismatches = append(l.mismatches, m)
+	return nil
+}
+
+func TestShadow(t *testing.T) {
+	primary := &fakeBackend{status: model.RESPONSESTATUS_ACCEPTED}
+	shadow := &fakeBackend{status: model.RESPONSESTATUS_ACCEPTED}
+	diffLog := &memoryDiffLog{}
+	b := CreateBackend(primary, shadow, diffLog)
+
+	for _, id := range []string{"1", "2", "3"} {
+		response, err := b.OnEntitlementEvent(model.EntitlementEvent{EventId: id})
+		if err != nil || response.Status != model.RESPONSESTATUS_ACCEPTED {
+			t.Fatalf("Unexpected response: %+v '%v'", response, err)
+		}
+	}
+	b.Wait()
+
+	if len(diffLog.mismatches) != 0 {
+		t.Errorf("Unexpected mismatches: %+v", diffLog.mismatches)
+	}
+	if len(shadow.events) != 3 || shadow.events[0] != "1" || shadow.events[2] != "3" {
+		t.Errorf("Expected the shadow to receive all events in order, got '%v'", shadow.events)
+	}
+
+	// Only the primary's response goes back to the caller.
+	shadow.status = model.RESPONSESTATUS_REJECTED
+	response, _ := b.OnEntitlementEvent(model.EntitlementEvent{EventId: "4"})
+	if response.Status != model.RESPONSESTATUS_ACCEPTED {
+		t.Errorf("Expected the primary's response, got %+v", response)
+	}
+	b.Wait()
+
+	shadow.err = errors.New("Failed.")
+	b.OnEntitlementEvent(model.EntitlementEvent{EventId: "5"})
+	b.Wait()
+
+	if len(diffLog.mismatches) != 2 {
+		t.Fatalf("Expected 2 mismatches, got %+v", diffLog.mismatches)
+	}
+	m := diffLog.mismatches[0]
+	if m.Event.EventId != "4" || m.Primary.Status != "ACCEPTED" || m.Shadow.Status != "REJECTED" ||
+		len(m.Differences) != 1 {
+		t.Errorf("Unexpected mismatch: %+v", m)
+	}
+	if m := diffLog.mismatches[1]; m.Event.EventId != "5" || m.Shadow.Error != "Failed." {
+		t.Errorf("Unexpected mismatch: %+v", m)
+	}
+}
+
+// blockingBackend accepts every event, but blocks on the first one until it is released.
+type blockingBackend struct {
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) OnEntitlementEvent(e model.EntitlementEvent) (model.EntitlementEventResponse, error) {
+	b.once.Do(func() {
+		close(b.started)
+		<-b.release
+	})
+	return model.EntitlementEventResponse{Status: model.RESPONSESTATUS_ACCEPTED, EventId: e.EventId}, nil
+}
+
+func TestDroppedEvents(t *testing.T) {
+	primary := &fakeBackend{status: model.RESPONSESTATUS_ACCEPTED}
+	shadow := &blockingBackend{started: make(chan struct{}), release: make(chan struct{})}
+	diffLog := &memoryDiffLog{}
+	b := CreateBackend(primary, shadow, diffLog)
+
+	b.OnEntitlementEvent(model.EntitlementEvent{EventId: "blocking"})
+	<-shadow.started
+
+	// The queue fills up while the shadow backend is blocked, and the next event is dropped.
+	for i := 0; i < SHADOW_QUEUE_SIZE; i++ {
+		b.OnEntitlementEvent(model.EntitlementEvent{EventId: "queued"})
+	}
+	b.OnEntitlementEvent(model.EntitlementEvent{EventId: "dropped"})
+	close(shadow.release)
+	b.Wait()
+
+	if b.Dropped() != 1 {
+		t.Errorf("Unexpected number of dropped events: '%d'", b.Dropped())
+	}
+	if len(diffLog.mismatches) != 1 || !diffLog.mismatches[0].Dropped ||
+		diffLog.mismatches[0].Event.EventId != "dropped" {
+		t.Errorf("Expected the dropped event to be recorded, got %+v", diffLog.mismatches)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"procurementlistenerservice/model"
+	"sync"
+	"time"
+)
+
+// Outcome is what a backend returned for an event.
+type Outcome struct {
+	Status                  string                 `json:"status"`
+	EntitlementDashboardUrl string                 `json:"entitlementDashboardUrl,omitempty"`
+	Labels                  map[string]string      `json:"labels,omitempty"`
+	Reason                  *model.RejectionReason `json:"reason,omitempty"`
+	Error                   string                 `json:"error,omitempty"`
+}
+
+// Mismatch records an event, for which the shadow backend returned something different than the primary backend, or
+// that was not sent to the shadow backend at all.
+type Mismatch struct {
+	Time        time.Time              `json:"time"`
+	Event       model.EntitlementEvent `json:"event"`
+	Completion  string                 `json:"completion,omitempty"`
+	Primary     Outcome                `json:"primary"`
+	Shadow      Outcome                `json:"shadow"`
+	Differences []string               `json:"differences"`
+
+	// Dropped is set when the event was not sent to the shadow backend, because it was falling behind. The state of
+	// the shadow backend may differ from the primary's from then on.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// DiffLog records the mismatches between the primary and the shadow backends.
+type DiffLog interface {
+	Record(m Mismatch) error
+}
+
+// FileDiffLog is a DiffLog that appends the mismatches to a file, as JSON lines.
+type FileDiffLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+var _ DiffLog = &FileDiffLog{}
+
+// OpenFileDiffLog opens the diff log at the given path, creating it if it does not exist.
+func OpenFileDiffLog(path string) (*FileDiffLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open diff log: '%v'.", err)
+	}
+	return &FileDiffLog{file: file}, nil
+}
+
+func (l *FileDiffLog) Record(m Mismatch) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying file.
+func (l *FileDiffLog) Close() error {
+	return l.file.Close()
+}
+
+func outcome(response model.EntitlementEventResponse, err error) Outcome {
+	if err != nil {
+		return Outcome{Error: err.Error()}
+	}
+	return Outcome{
+		Status:                  response.Status.String(),
+		EntitlementDashboardUrl: response.EntitlementDashboardUrl,
+		Labels:                  response.Labels,
+		Reason:                  response.Reason,
+	}
+}
+
+// differences returns the human readable differences between the given outcomes.
+func differences(primary Outcome, shadow Outcome) []string {
+	var diffs []string
+	add := func(field string, p interface{}, s interface{}) {
+		diffs = append(diffs, fmt.Sprintf("%s: primary='%v' shadow='%v'", field, p, s))
+	}
+
+	if (primary.Error == "") != (shadow.Error == "") {
+		add("error", primary.Error, shadow.Error)
+		return diffs
+	}
+	if primary.Status != shadow.Status {
+		add("status", primary.Status, shadow.Status)
+	}
+	if primary.EntitlementDashboardUrl != shadow.EntitlementDashboardUrl {
+		add("entitlementDashboardUrl", primary.EntitlementDashboardUrl, shadow.EntitlementDashboardUrl)
+	}
+	if !equalLabels(primary.Labels, shadow.Labels) {
+		add("labels", primary.Labels, shadow.Labels)
+	}
+	if reasonCode(primary.Reason) != reasonCode(shadow.Reason) {
+		add("reason", reasonCode(primary.Reason), reasonCode(shadow.Reason))
+	}
+	return diffs
+}
+
+func equalLabels(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if other, ok := b[k]; !ok || other != v {
+			return false
+		}
+	}
+	return true
+}
+
+func reasonCode(reason *model.RejectionReason) string {
+	if reason == nil {
+		return ""
+	}
+	return reason.Code
+}
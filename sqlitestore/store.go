@@ -0,0 +1,278 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlitestore contains an EntitlementStore that keeps the entitlements in a SQLite database, so that they
+// survive restarts.
+package sqlitestore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"procurementlistenerservice/inmemory"
+	"reflect"
+)
+
+// migrations are the schema changes of the database, in order. The schema version of a database is the number of
+// migrations that have been applied to it. Migrations must never be changed once released, only appended.
+var migrations = []string{
+	`CREATE TABLE entitlements (
+		id           TEXT NOT NULL,
+		state        TEXT NOT NULL,
+		service_id   TEXT NOT NULL,
+		plan_id      TEXT NOT NULL,
+		account_id   TEXT NOT NULL,
+		requestor_id TEXT NOT NULL,
+		parameters   TEXT,
+		labels       TEXT,
+		CONSTRAINT entitlements_id_unique UNIQUE (id)
+	)`,
+	`CREATE INDEX entitlements_account_id ON entitlements (account_id)`,
+}
+
+const columns = "id, state, service_id, plan_id, account_id, requestor_id, parameters, labels"
+
+// Store is an EntitlementStore that keeps the entitlements in a SQLite database.
+type Store struct {
+	db *sql.DB
+}
+
+var _ inmemory.EntitlementStore = &Store{}
+
+// Open opens the SQLite database at the given path, creating it if it does not exist, and migrates its schema to the
+// current version.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_txlock=immediate", path))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open database '%s': '%v'.", path, err)
+	}
+
+	// SQLite allows a single writer at a time, so a single connection avoids lock contention between writers.
+	db.SetMaxOpenConns(1)
+
+	s := &Store{db: db}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to migrate database '%s': '%v'.", path, err)
+	}
+
+	return s, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies the migrations that have not been applied to the database yet, each in its own transaction.
+func (s *Store) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	for {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		var version int
+		err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+		if err == nil && version > len(migrations) {
+			err = fmt.Errorf("Database schema version '%d' is newer than the supported version '%d'.",
+				version, len(migrations))
+		}
+		if err != nil || version == len(migrations) {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec(migrations[version])
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, version+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration '%d' failed: '%v'.", version+1, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Store) Get(id string) (inmemory.EntitlementInfo, error) {
+	return get(s.db, id)
+}
+
+func (s *Store) Put(info inmemory.EntitlementInfo) error {
+	values, err := encode(info)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO entitlements (`+columns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, values...)
+	return err
+}
+
+func (s *Store) CompareAndSwap(old *inmemory.EntitlementInfo, info inmemory.EntitlementInfo) (bool, error) {
+	values, err := encode(info)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	existing, err := get(tx, info.Id)
+	if err == inmemory.ErrEntitlementNotFound {
+		if old != nil {
+			return false, nil
+		}
+		_, err = tx.Exec(`INSERT INTO entitlements (`+columns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, values...)
+		if isUniqueViolation(err) {
+			return false, nil
+		}
+	} else if err == nil {
+		if old == nil || !reflect.DeepEqual(existing, *old) {
+			return false, nil
+		}
+		_, err = tx.Exec(`UPDATE entitlements SET state = ?, service_id = ?, plan_id = ?, account_id = ?, `+
+			`requestor_id = ?, parameters = ?, labels = ? WHERE id = ?`, append(values[1:], values[0])...)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) List() ([]inmemory.EntitlementInfo, error) {
+	rows, err := s.db.Query(`SELECT ` + columns + ` FROM entitlements ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]inmemory.EntitlementInfo, 0)
+	for rows.Next() {
+		info, err := decode(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, info)
+	}
+	return list, rows.Err()
+}
+
+func (s *Store) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM entitlements WHERE id = ?`, id)
+	return err
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func get(q queryer, id string) (inmemory.EntitlementInfo, error) {
+	info, err := decode(q.QueryRow(`SELECT `+columns+` FROM entitlements WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return inmemory.EntitlementInfo{}, inmemory.ErrEntitlementNotFound
+	}
+	return info, err
+}
+
+// encode returns the column values of the given entitlement, in the order of columns.
+func encode(info inmemory.EntitlementInfo) ([]interface{}, error) {
+	parameters, err := encodeJson(info.Parameters == nil, info.Parameters)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode parameters: '%v'.", err)
+	}
+	labels, err := encodeJson(info.Labels == nil, info.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode labels: '%v'.", err)
+	}
+
+	return []interface{}{
+		info.Id, info.State.String(), info.ServiceId, info.PlanId, info.AccountId, info.RequestorId, parameters, labels,
+	}, nil
+}
+
+// encodeJson encodes the given value as a JSON column. Nil values are stored as NULL, so that they can be told apart
+// from empty ones.
+func encodeJson(isNil bool, value interface{}) (sql.NullString, error) {
+	if isNil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func decode(row scanner) (inmemory.EntitlementInfo, error) {
+	var info inmemory.EntitlementInfo
+	var state string
+	var parameters, labels sql.NullString
+
+	err := row.Scan(&info.Id, &state, &info.ServiceId, &info.PlanId, &info.AccountId, &info.RequestorId,
+		&parameters, &labels)
+	if err != nil {
+		return inmemory.EntitlementInfo{}, err
+	}
+
+	info.State, err = inmemory.ParseEntitlementState(state)
+	if err != nil {
+		return inmemory.EntitlementInfo{}, err
+	}
+	if parameters.Valid {
+		err = json.Unmarshal([]byte(parameters.String), &info.Parameters)
+		if err != nil {
+			return inmemory.EntitlementInfo{}, fmt.Errorf("Unable to decode parameters of '%s': '%v'.", info.Id, err)
+		}
+	}
+	if labels.Valid {
+		err = json.Unmarshal([]byte(labels.String), &info.Labels)
+		if err != nil {
+			return inmemory.EntitlementInfo{}, fmt.Errorf("Unable to decode labels of '%s': '%v'.", info.Id, err)
+		}
+	}
+
+	return info, nil
+}
+
+// isUniqueViolation reports whether the given error is a violation of the unique constraint on the entitlement id.
+func isUniqueViolation(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
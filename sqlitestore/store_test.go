@@ -0,0 +1,71 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlitestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"procurementlistenerservice/conformance"
+	"procurementlistenerservice/inmemory"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := Open(filepath.Join(dir, "entitlements.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	conformance.StoreTests(t, store)
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "entitlements.db")
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := inmemory.EntitlementInfo{Id: "E1", State: inmemory.CANCELLED, Labels: map[string]string{}}
+	if err := store.Put(info); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// Reopening the database does not apply the migrations again, and keeps the entitlements.
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	actual, err := store.Get("E1")
+	if err != nil || actual.State != inmemory.CANCELLED || actual.Labels == nil || actual.Parameters != nil {
+		t.Errorf("Unexpected entitlement: '%+v' '%v'", actual, err)
+	}
+}